@@ -16,6 +16,8 @@ package bcc
 
 import (
 	"fmt"
+	"hash/fnv"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
@@ -69,6 +71,9 @@ type Module struct {
 	rawTracepoints map[string]int
 	perfEvents     map[string][]int
 	perfBuffers    map[string]*PerfBuffer
+	// USDT contexts holding the semaphores of the probes attached to with
+	// AttachUSDT, closed in Close
+	usdts []unsafe.Pointer
 }
 
 type compileRequest struct {
@@ -171,6 +176,9 @@ func (bpf *Module) Close() {
 		C.bpf_detach_uprobe(evNameCS)
 		C.free(unsafe.Pointer(evNameCS))
 	}
+	for _, ctx := range bpf.usdts {
+		closeUSDTContext(ctx)
+	}
 	for k, v := range bpf.tracepoints {
 		C.bpf_close_perf_event_fd((C.int)(v))
 		parts := strings.SplitN(k, ":", 2)
@@ -271,6 +279,28 @@ var (
 	uprobeRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
 )
 
+// maxUprobeEventNameLen is the maximum length of the name of a uprobe event
+// for libbcc to create it in tracefs, which allows 63 characters, with the
+// suffix _bcc_<pid> it appends.
+const maxUprobeEventNameLen = 63 - len("_bcc_") - 7
+
+// uprobeEventName returns the name of the event of the uprobe at addr in
+// the binary at path, shortened with a hash of the path if it's too long,
+// e.g. for the paths of binaries in containers.
+func uprobeEventName(prefix, path string, addr uint64) string {
+	evName := fmt.Sprintf("%s_%s_0x%x", prefix, uprobeRegexp.ReplaceAllString(path, "_"), addr)
+	if len(evName) <= maxUprobeEventNameLen {
+		return evName
+	}
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	evName = fmt.Sprintf("%s_%s_%08x_0x%x", prefix, uprobeRegexp.ReplaceAllString(filepath.Base(path), "_"), h.Sum32(), addr)
+	if len(evName) <= maxUprobeEventNameLen {
+		return evName
+	}
+	return fmt.Sprintf("%s_%08x_0x%x", prefix, h.Sum32(), addr)
+}
+
 func (bpf *Module) attachProbe(evName string, attachType uint32, fnName string, fd int, maxActive int) error {
 	if _, ok := bpf.kprobes[evName]; ok {
 		return nil
@@ -409,16 +439,14 @@ func (bpf *Module) AttachPerfEvent(evType, evConfig int, samplePeriod int, sampl
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
 // A pid can be given to attach to, or -1 to attach to all processes
 //
-// Presently attempts to trace processes running in a different namespace
-// to the tracer will fail due to limitations around namespace-switching
-// in multi-threaded programs (such as Go programs)
+// For a pid, the binary is looked up in the mount namespace of the process,
+// e.g. in its container, through /proc/<pid>/root
 func (bpf *Module) AttachUprobe(name, symbol string, fd, pid int) error {
 	path, addr, err := resolveSymbolPath(name, symbol, 0x0, pid)
 	if err != nil {
 		return err
 	}
-	evName := fmt.Sprintf("p_%s_0x%x", uprobeRegexp.ReplaceAllString(path, "_"), addr)
-	return bpf.attachUProbe(evName, BPF_PROBE_ENTRY, path, addr, fd, pid)
+	return bpf.attachUProbe(uprobeEventName("p", path, addr), BPF_PROBE_ENTRY, path, addr, fd, pid)
 }
 
 // AttachMatchingUprobes attaches a uprobe fd to all symbols in the library or binary
@@ -427,11 +455,11 @@ func (bpf *Module) AttachUprobe(name, symbol string, fd, pid int) error {
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
 // A pid can be given, or -1 to attach to all processes
 //
-// Presently attempts to trace processes running in a different namespace
-// to the tracer will fail due to limitations around namespace-switching
-// in multi-threaded programs (such as Go programs)
+// For a pid, the binary is looked up in the mount namespace of the process,
+// e.g. in its container, through /proc/<pid>/root
 func (bpf *Module) AttachMatchingUprobes(name, match string, fd, pid int) error {
-	symbols, err := matchUserSymbols(name, match)
+	path, _ := resolveProcessPath(name, pid)
+	symbols, err := matchUserSymbols(path, match)
 	if err != nil {
 		return fmt.Errorf("unable to match symbols: %s", err)
 	}
@@ -451,16 +479,14 @@ func (bpf *Module) AttachMatchingUprobes(name, match string, fd, pid int) error
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
 // A pid can be given to attach to, or -1 to attach to all processes
 //
-// Presently attempts to trace processes running in a different namespace
-// to the tracer will fail due to limitations around namespace-switching
-// in multi-threaded programs (such as Go programs)
+// For a pid, the binary is looked up in the mount namespace of the process,
+// e.g. in its container, through /proc/<pid>/root
 func (bpf *Module) AttachUretprobe(name, symbol string, fd, pid int) error {
 	path, addr, err := resolveSymbolPath(name, symbol, 0x0, pid)
 	if err != nil {
 		return err
 	}
-	evName := fmt.Sprintf("r_%s_0x%x", uprobeRegexp.ReplaceAllString(path, "_"), addr)
-	return bpf.attachUProbe(evName, BPF_PROBE_RETURN, path, addr, fd, pid)
+	return bpf.attachUProbe(uprobeEventName("r", path, addr), BPF_PROBE_RETURN, path, addr, fd, pid)
 }
 
 // AttachMatchingUretprobes attaches a uretprobe fd to all symbols in the library or binary
@@ -469,11 +495,11 @@ func (bpf *Module) AttachUretprobe(name, symbol string, fd, pid int) error {
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
 // A pid can be given, or -1 to attach to all processes
 //
-// Presently attempts to trace processes running in a different namespace
-// to the tracer will fail due to limitations around namespace-switching
-// in multi-threaded programs (such as Go programs)
+// For a pid, the binary is looked up in the mount namespace of the process,
+// e.g. in its container, through /proc/<pid>/root
 func (bpf *Module) AttachMatchingUretprobes(name, match string, fd, pid int) error {
-	symbols, err := matchUserSymbols(name, match)
+	path, _ := resolveProcessPath(name, pid)
+	symbols, err := matchUserSymbols(path, match)
 	if err != nil {
 		return fmt.Errorf("unable to match symbols: %s", err)
 	}
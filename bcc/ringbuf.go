@@ -0,0 +1,39 @@
+package bcc
+
+import (
+	"fmt"
+
+	"github.com/vietanhduong/gobpf/pkg/ringbuf"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bcc_common.h>
+#include <linux/bpf.h>
+*/
+import "C"
+
+// RingBuf reads the records of a ring buffer table, declared with
+// BPF_RINGBUF_OUTPUT: Read returns the samples the BPF programs output,
+// in the order they were reserved across all CPUs, skipping discarded
+// records. See ringbuf.Reader.
+type RingBuf struct {
+	*ringbuf.Reader
+	table *Table
+}
+
+// CreateRingBuf maps the ring buffer table for its records to be read. The
+// RingBuf must be closed before the module.
+func CreateRingBuf(table *Table) (*RingBuf, error) {
+	mod := table.module.p
+	if C.bpf_table_type_id(mod, table.id) != C.BPF_MAP_TYPE_RINGBUF {
+		return nil, fmt.Errorf("table %s is not a ring buffer", table.Name())
+	}
+	size := int(C.bpf_table_max_entries_id(mod, table.id))
+	r, err := ringbuf.NewReader(int(table.fd), size)
+	if err != nil {
+		return nil, fmt.Errorf("unable to map ring buffer %s: %v", table.Name(), err)
+	}
+	return &RingBuf{Reader: r, table: table}, nil
+}
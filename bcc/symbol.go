@@ -15,8 +15,12 @@
 package bcc
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"unsafe"
 )
@@ -124,11 +128,53 @@ type bccSymbolOption struct {
 	useSymbolType     uint32
 }
 
+// resolveProcessPath returns the path of the binary 'name' of the process
+// pid as seen from the tracer, through /proc/<pid>/root: the mount
+// namespace of the process, e.g. of its container, is then never entered,
+// which a multi-threaded Go program can't do. name is a path, or a library
+// mapped by the process, with or without the lib prefix. ok is false if
+// name isn't resolved, for it to be looked up as for all processes.
+func resolveProcessPath(name string, pid int) (path string, ok bool) {
+	if pid <= 0 || strings.HasPrefix(name, "/proc/") {
+		return name, false
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			return filepath.Join(fmt.Sprintf("/proc/%d/cwd", pid), name), true
+		}
+		return filepath.Join(root, name), true
+	}
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return name, false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		base := filepath.Base(fields[5])
+		if base == name || strings.HasPrefix(base, "lib"+name+".so") {
+			return filepath.Join(root, fields[5]), true
+		}
+	}
+	return name, false
+}
+
 // resolveSymbolPath returns the file and offset to locate symname in module
 func resolveSymbolPath(module string, symname string, addr uint64, pid int) (string, uint64, error) {
 	if pid == -1 {
 		pid = 0
 	}
+	if path, ok := resolveProcessPath(module, pid); ok {
+		// the path leads to the binary from the namespace of the tracer
+		module, pid = path, 0
+	}
 
 	modname, offset, err := bccResolveSymname(module, symname, addr, pid)
 	if err != nil {
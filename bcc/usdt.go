@@ -0,0 +1,131 @@
+package bcc
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <bcc/bcc_usdt.h>
+
+// typedef void (*bcc_usdt_uprobe_cb)(const char *binpath, const char *fn_name,
+//                                    uint64_t addr, int pid);
+extern void foreach_usdt_uprobe_callback(char*, char*, uint64_t, int);
+*/
+import "C"
+
+// usdtLocation is a location of a USDT probe, in the binary at path.
+type usdtLocation struct {
+	path string
+	addr uint64
+}
+
+// usdtLocations collects the locations bcc_usdt_foreach_uprobe calls back
+// with, which has no cookie to pass them along.
+var usdtLocations struct {
+	lock      sync.Mutex
+	locations []usdtLocation
+}
+
+//export foreach_usdt_uprobe_callback
+func foreach_usdt_uprobe_callback(binpath, fnName *C.char, addr C.uint64_t, pid C.int) {
+	usdtLocations.locations = append(usdtLocations.locations, usdtLocation{C.GoString(binpath), uint64(addr)})
+}
+
+// newUSDTContext opens the USDT probes of the binary, in the process pid
+// if it's positive, and enables the probe provider:name for the BPF
+// function fnName, incrementing its semaphores in the process.
+func newUSDTContext(binary, provider, name, fnName string, pid int) (unsafe.Pointer, error) {
+	path, _ := resolveProcessPath(binary, pid)
+	binaryCS := C.CString(path)
+	defer C.free(unsafe.Pointer(binaryCS))
+
+	var ctx unsafe.Pointer
+	if pid > 0 {
+		ctx = C.bcc_usdt_new_frompid(C.int(pid), binaryCS)
+	} else {
+		ctx = C.bcc_usdt_new_frompath(binaryCS)
+	}
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to read USDT probes of %s", binary)
+	}
+
+	providerCS := C.CString(provider)
+	nameCS := C.CString(name)
+	fnNameCS := C.CString(fnName)
+	res := C.bcc_usdt_enable_fully_specified_probe(ctx, providerCS, nameCS, fnNameCS)
+	C.free(unsafe.Pointer(providerCS))
+	C.free(unsafe.Pointer(nameCS))
+	C.free(unsafe.Pointer(fnNameCS))
+	if res < 0 {
+		C.bcc_usdt_close(ctx)
+		return nil, fmt.Errorf("unable to enable USDT probe %s:%s of %s", provider, name, binary)
+	}
+	return ctx, nil
+}
+
+func closeUSDTContext(ctx unsafe.Pointer) {
+	C.bcc_usdt_close(ctx)
+}
+
+// USDTArgs returns the code reading the arguments of the USDT probe
+// provider:name of the binary, to be prepended to the code of the module
+// whose function fnName is attached to it with AttachUSDT. The function
+// reads the arguments with bpf_usdt_readarg(index, ctx, &arg), index
+// starting at 1.
+//
+// The binary can be given as in AttachUprobe, and the pid as in
+// AttachUSDT.
+func USDTArgs(binary, provider, name, fnName string, pid int) (string, error) {
+	ctx, err := newUSDTContext(binary, provider, name, fnName, pid)
+	if err != nil {
+		return "", err
+	}
+	defer C.bcc_usdt_close(ctx)
+
+	ctxs := []unsafe.Pointer{ctx}
+	code := C.bcc_usdt_genargs(&ctxs[0], 1)
+	if code == nil {
+		return "", fmt.Errorf("unable to generate arguments of USDT probe %s:%s of %s", provider, name, binary)
+	}
+	// the code is owned by libbcc
+	return C.GoString(code), nil
+}
+
+// AttachUSDT attaches a uprobe fd to all the locations of the USDT probe
+// provider:name of the binary 'name', given as in AttachUprobe. A pid can
+// be given to attach to, or -1 to attach to all processes.
+//
+// The semaphore of the probe, if any, is incremented in the process pid
+// until the module is closed, which requires a pid for such probes.
+func (bpf *Module) AttachUSDT(binary, provider, name string, fd, pid int) error {
+	ctx, err := newUSDTContext(binary, provider, name, fmt.Sprintf("usdt_%d", fd), pid)
+	if err != nil {
+		return err
+	}
+
+	usdtLocations.lock.Lock()
+	usdtLocations.locations = nil
+	C.bcc_usdt_foreach_uprobe(ctx, (C.bcc_usdt_uprobe_cb)(unsafe.Pointer(C.foreach_usdt_uprobe_callback)))
+	locations := usdtLocations.locations
+	usdtLocations.locations = nil
+	usdtLocations.lock.Unlock()
+
+	if len(locations) == 0 {
+		C.bcc_usdt_close(ctx)
+		return fmt.Errorf("USDT probe %s:%s not found in %s", provider, name, binary)
+	}
+	for _, loc := range locations {
+		if err := bpf.attachUProbe(uprobeEventName("p", loc.path, loc.addr), BPF_PROBE_ENTRY, loc.path, loc.addr, fd, pid); err != nil {
+			C.bcc_usdt_close(ctx)
+			return err
+		}
+	}
+	// the context holds the semaphores until it's closed
+	bpf.usdts = append(bpf.usdts, ctx)
+	return nil
+}
@@ -0,0 +1,249 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+#include <linux/unistd.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+extern int bpf_link_create(int prog_fd, int target_fd, enum bpf_attach_type type, __u32 flags);
+extern int get_pinned_obj_fd(const char *path);
+
+static int bpf_link_update(int link_fd, int new_prog_fd, int old_prog_fd)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.link_update.link_fd = link_fd;
+	attr.link_update.new_prog_fd = new_prog_fd;
+	if (old_prog_fd >= 0) {
+		attr.link_update.flags = BPF_F_REPLACE;
+		attr.link_update.old_prog_fd = old_prog_fd;
+	}
+
+	return syscall(__NR_bpf, BPF_LINK_UPDATE, &attr, sizeof(attr));
+}
+
+static int bpf_link_detach(int link_fd)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.link_detach.link_fd = link_fd;
+
+	return syscall(__NR_bpf, BPF_LINK_DETACH, &attr, sizeof(attr));
+}
+*/
+import "C"
+
+// Link is a bpf_link, an attachment of a program owned by a file
+// descriptor rather than by the object the program is attached to. The
+// program stays attached as long as the link is open or pinned: a link
+// pinned to the bpf fs outlives the process, and can be opened again with
+// LoadPinnedLink, e.g. after a daemon restart.
+type Link struct {
+	fd      int
+	pinPath string
+	// kprobe event the link's perf event was created for, removed when the
+	// link is closed, unless it's pinned
+	kprobeEvent string
+}
+
+// LoadPinnedLink opens the link pinned at pinPath.
+func LoadPinnedLink(pinPath string) (*Link, error) {
+	pinPathC := C.CString(pinPath)
+	defer C.free(unsafe.Pointer(pinPathC))
+	fd, err := C.get_pinned_obj_fd(pinPathC)
+	if fd < 0 {
+		return nil, fmt.Errorf("error opening pinned link %q: %v", pinPath, err)
+	}
+	return &Link{fd: int(fd), pinPath: pinPath}, nil
+}
+
+func newLink(progFd, targetFd int, attachType uint32, flags uint32) (*Link, error) {
+	fd, err := C.bpf_link_create(C.int(progFd), C.int(targetFd), attachType, C.__u32(flags))
+	if fd < 0 {
+		return nil, err
+	}
+	return &Link{fd: int(fd)}, nil
+}
+
+func (l *Link) Fd() int {
+	return l.fd
+}
+
+// PinPath returns the path the link is pinned at, if any.
+func (l *Link) PinPath() string {
+	return l.pinPath
+}
+
+// Pin pins the link to pinPath, on the bpf fs, which keeps the program
+// attached once the link is closed.
+func (l *Link) Pin(pinPath string) error {
+	if !validPinPath(pinPath) {
+		return fmt.Errorf("not a valid pin path: %s", pinPath)
+	}
+	if err := pinObject(l.fd, pinPath); err != nil {
+		return err
+	}
+	l.pinPath = pinPath
+	return nil
+}
+
+// Unpin removes the pin of the link. The program is detached when the link
+// is closed.
+func (l *Link) Unpin() error {
+	if l.pinPath == "" {
+		return fmt.Errorf("link is not pinned")
+	}
+	if err := syscall.Unlink(l.pinPath); err != nil {
+		return fmt.Errorf("error unpinning link %q: %v", l.pinPath, err)
+	}
+	l.pinPath = ""
+	return nil
+}
+
+// Update atomically replaces the program of the link with the program
+// progFd.
+func (l *Link) Update(progFd int) error {
+	if ret, err := C.bpf_link_update(C.int(l.fd), C.int(progFd), -1); ret < 0 {
+		return fmt.Errorf("error updating link: %v", err)
+	}
+	return nil
+}
+
+// UpdateReplace is Update, failing if the program of the link is no longer
+// oldProgFd.
+func (l *Link) UpdateReplace(progFd, oldProgFd int) error {
+	if ret, err := C.bpf_link_update(C.int(l.fd), C.int(progFd), C.int(oldProgFd)); ret < 0 {
+		return fmt.Errorf("error updating link: %v", err)
+	}
+	return nil
+}
+
+// Detach detaches the program of the link, even if the link is pinned or
+// open elsewhere. The link stays open, defunct, until it's closed.
+func (l *Link) Detach() error {
+	if ret, err := C.bpf_link_detach(C.int(l.fd)); ret < 0 {
+		return fmt.Errorf("error detaching link: %v", err)
+	}
+	return nil
+}
+
+// Close closes the link, which detaches its program unless the link is
+// pinned.
+func (l *Link) Close() error {
+	if err := syscall.Close(l.fd); err != nil {
+		return fmt.Errorf("error closing link fd: %v", err)
+	}
+	if l.kprobeEvent != "" && l.pinPath == "" {
+		if err := disableKprobe(l.kprobeEvent); err != nil {
+			return fmt.Errorf("error clearing probe: %v", err)
+		}
+	}
+	return nil
+}
+
+// AttachXDPLink attaches the xdp section secName to the device with a
+// link. flags select the mode as for AttachXDPWithFlags.
+func (b *Module) AttachXDPLink(devName string, secName string, flags uint32) (*Link, error) {
+	xdp, ok := b.xdpPrograms[secName]
+	if !ok {
+		return nil, fmt.Errorf("no such XDP hook %q", secName)
+	}
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return nil, err
+	}
+	link, err := newLink(xdp.fd, ifindex, C.BPF_XDP, flags)
+	if err != nil {
+		return nil, fmt.Errorf(xdpFormat(true), devName, err)
+	}
+	return link, nil
+}
+
+// AttachCgroupLink attaches the program to the cgroup with a link. Links
+// behave like programs attached with AllowMulti.
+func AttachCgroupLink(cgroupProg *CgroupProgram, cgroupPath string, attachType AttachType) (*Link, error) {
+	f, err := os.Open(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cgroup %q: %v", cgroupPath, err)
+	}
+	defer f.Close()
+
+	link, err := newLink(cgroupProg.fd, int(f.Fd()), uint32(attachType), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach prog to cgroup %q: %v", cgroupPath, err)
+	}
+	return link, nil
+}
+
+// AttachTracingLink attaches the fentry, fexit or fmod_ret program secName
+// to the kernel function it was loaded for with a link.
+func (b *Module) AttachTracingLink(secName string) (*Link, error) {
+	prog, ok := b.tracingPrograms[secName]
+	if !ok {
+		return nil, fmt.Errorf("no such tracing program %q", secName)
+	}
+	var attachType uint32
+	switch {
+	case strings.HasPrefix(secName, "fentry/"):
+		attachType = C.BPF_TRACE_FENTRY
+	case strings.HasPrefix(secName, "fexit/"):
+		attachType = C.BPF_TRACE_FEXIT
+	case strings.HasPrefix(secName, "fmod_ret/"):
+		attachType = C.BPF_MODIFY_RETURN
+	}
+	link, err := newLink(prog.fd, 0, attachType, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error attaching tracing program %q: %v", secName, err)
+	}
+	return link, nil
+}
+
+// kprobeLinks counts the links of AttachKprobeLink, for the tracefs events
+// of several links on the same function to be named apart.
+var kprobeLinks uint64
+
+// AttachKprobeLink attaches the kprobe or kretprobe secName with a link to
+// the perf event of the probe. See EnableKprobe for maxactive. Unlike the
+// probes enabled by EnableKprobe, probes created in tracefs aren't removed
+// when the module is closed but when the link is, unless it's pinned.
+func (b *Module) AttachKprobeLink(secName string, maxactive int) (*Link, error) {
+	probe, ok := b.probes[secName]
+	if !ok {
+		return nil, fmt.Errorf("no such kprobe %q", secName)
+	}
+	// a tracefs event, if any, is named apart from the event of
+	// EnableKprobe, from those of the other links of the process, and from
+	// the events of the links of previous processes that may still be pinned
+	suffix := fmt.Sprintf("_link_%d_%d", os.Getpid(), atomic.AddUint64(&kprobeLinks, 1))
+	efd, eventName, err := openKprobe(secName, maxactive, suffix)
+	if err != nil {
+		return nil, err
+	}
+	link, err := newLink(probe.fd, efd, C.BPF_PERF_EVENT, 0)
+	// the link holds a reference to the perf event
+	syscall.Close(efd)
+	if err != nil {
+		if eventName != "" {
+			disableKprobe(eventName)
+		}
+		return nil, fmt.Errorf("error attaching kprobe %q: %v", secName, err)
+	}
+	link.kprobeEvent = eventName
+	return link, nil
+}
@@ -0,0 +1,677 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BTF type kinds, see include/uapi/linux/btf.h
+const (
+	btfKindUnknown = iota
+	btfKindInt
+	btfKindPtr
+	btfKindArray
+	btfKindStruct
+	btfKindUnion
+	btfKindEnum
+	btfKindFwd
+	btfKindTypedef
+	btfKindVolatile
+	btfKindConst
+	btfKindRestrict
+	btfKindFunc
+	btfKindFuncProto
+	btfKindVar
+	btfKindDatasec
+	btfKindFloat
+	btfKindDeclTag
+	btfKindTypeTag
+	btfKindEnum64
+)
+
+const (
+	btfMagic           = 0xeB9F
+	btfHeaderLen       = 24
+	btfExtHeaderLen    = 24
+	btfTypeLen         = 12
+	btfFuncInfoLen     = 8
+	btfLineInfoLen     = 16
+	btfCoreReloLen     = 16
+	btfIntSigned       = 1 << 0
+	btfMaxModifiers    = 32
+	btfVarGlobalExtern = 2
+)
+
+// btfType is the decoded form of a single BTF type record. Only the fields
+// relevant to the record's kind are set.
+type btfType struct {
+	id       uint32
+	name     string
+	kind     uint8
+	vlen     uint16
+	kindFlag bool
+	// size of INT, STRUCT, UNION, ENUM, DATASEC and FLOAT types, or the
+	// referenced type ID for PTR, TYPEDEF, modifiers, FUNC and VAR
+	sizeType uint32
+
+	encoding     uint32 // INT
+	array        btfArray
+	members      []btfMember
+	enums        []btfEnum
+	params       []btfParam
+	linkage      uint32 // VAR and FUNC
+	secinfos     []btfVarSecinfo
+	componentIdx int32 // DECL_TAG
+
+	// offset of the record within the type section, used to patch the
+	// raw BTF in place
+	off int
+}
+
+type btfArray struct {
+	typ       uint32
+	indexType uint32
+	nelems    uint32
+}
+
+type btfMember struct {
+	name         string
+	typ          uint32
+	bitOffset    uint32
+	bitfieldSize uint32
+}
+
+type btfEnum struct {
+	name  string
+	value int64
+}
+
+type btfParam struct {
+	name string
+	typ  uint32
+}
+
+type btfVarSecinfo struct {
+	typ    uint32
+	offset uint32
+	size   uint32
+}
+
+// btfSpec holds the type information parsed from a .BTF section.
+type btfSpec struct {
+	byteOrder binary.ByteOrder
+	// raw is the complete BTF blob (header, types and strings) as passed
+	// to the kernel by BPF_BTF_LOAD
+	raw     []byte
+	typeOff int
+	strings []byte
+	types   []*btfType // indexed by type ID, types[0] is void
+	// base is set for split BTF (e.g. kernel modules) whose type IDs and
+	// string offsets continue those of the base BTF
+	base *btfSpec
+	// coreCandidates indexes types by their essential name, built on the
+	// first CO-RE candidate lookup
+	coreCandidates map[string][]uint32
+}
+
+func (t *btfType) isComposite() bool {
+	return t.kind == btfKindStruct || t.kind == btfKindUnion
+}
+
+func (t *btfType) isModifier() bool {
+	switch t.kind {
+	case btfKindTypedef, btfKindVolatile, btfKindConst, btfKindRestrict, btfKindTypeTag:
+		return true
+	}
+	return false
+}
+
+func btfKindName(kind uint8) string {
+	switch kind {
+	case btfKindInt:
+		return "int"
+	case btfKindPtr:
+		return "ptr"
+	case btfKindArray:
+		return "array"
+	case btfKindStruct:
+		return "struct"
+	case btfKindUnion:
+		return "union"
+	case btfKindEnum:
+		return "enum"
+	case btfKindFwd:
+		return "fwd"
+	case btfKindTypedef:
+		return "typedef"
+	case btfKindVolatile:
+		return "volatile"
+	case btfKindConst:
+		return "const"
+	case btfKindRestrict:
+		return "restrict"
+	case btfKindFunc:
+		return "func"
+	case btfKindFuncProto:
+		return "func_proto"
+	case btfKindVar:
+		return "var"
+	case btfKindDatasec:
+		return "datasec"
+	case btfKindFloat:
+		return "float"
+	case btfKindDeclTag:
+		return "decl_tag"
+	case btfKindTypeTag:
+		return "type_tag"
+	case btfKindEnum64:
+		return "enum64"
+	}
+	return fmt.Sprintf("kind(%d)", kind)
+}
+
+// parseBTF decodes a .BTF section. The returned spec keeps a private copy
+// of the data so that it can be fixed up before it is loaded.
+func parseBTF(data []byte, bo binary.ByteOrder) (*btfSpec, error) {
+	return parseSplitBTF(data, bo, nil)
+}
+
+// parseSplitBTF decodes BTF whose type IDs and strings are relative to the
+// ones of base, as found in /sys/kernel/btf/<module>. base may be nil.
+func parseSplitBTF(data []byte, bo binary.ByteOrder, base *btfSpec) (*btfSpec, error) {
+	if len(data) < btfHeaderLen {
+		return nil, errors.New("BTF header too short")
+	}
+	if bo.Uint16(data[0:2]) != btfMagic {
+		return nil, fmt.Errorf("invalid BTF magic %#x", bo.Uint16(data[0:2]))
+	}
+	hdrLen := bo.Uint32(data[4:8])
+	typeOff := bo.Uint32(data[8:12])
+	typeLen := bo.Uint32(data[12:16])
+	strOff := bo.Uint32(data[16:20])
+	strLen := bo.Uint32(data[20:24])
+
+	if hdrLen < btfHeaderLen || uint64(hdrLen) > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid BTF header length %d", hdrLen)
+	}
+	types, ok := btfSubslice(data, uint64(hdrLen)+uint64(typeOff), uint64(typeLen))
+	if !ok {
+		return nil, errors.New("BTF type section out of bounds")
+	}
+	strs, ok := btfSubslice(data, uint64(hdrLen)+uint64(strOff), uint64(strLen))
+	if !ok {
+		return nil, errors.New("BTF string section out of bounds")
+	}
+	if base == nil && (len(strs) == 0 || strs[0] != 0) {
+		return nil, errors.New("BTF string section must start with a NUL byte")
+	}
+
+	raw := make([]byte, len(data))
+	copy(raw, data)
+
+	s := &btfSpec{
+		byteOrder: bo,
+		raw:       raw,
+		typeOff:   int(hdrLen + typeOff),
+		strings:   strs,
+		base:      base,
+	}
+	if base == nil {
+		s.types = []*btfType{{kind: btfKindUnknown}}
+	} else {
+		s.types = append([]*btfType(nil), base.types...)
+	}
+
+	if err := s.parseTypes(types); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func btfSubslice(data []byte, off, length uint64) ([]byte, bool) {
+	if off+length > uint64(len(data)) {
+		return nil, false
+	}
+	return data[off : off+length], true
+}
+
+func (s *btfSpec) parseTypes(data []byte) error {
+	bo := s.byteOrder
+	off := 0
+	for off < len(data) {
+		if off+btfTypeLen > len(data) {
+			return fmt.Errorf("BTF type at offset %d truncated", off)
+		}
+		nameOff := bo.Uint32(data[off:])
+		info := bo.Uint32(data[off+4:])
+		t := &btfType{
+			id:       uint32(len(s.types)),
+			vlen:     uint16(info & 0xffff),
+			kind:     uint8((info >> 24) & 0x1f),
+			kindFlag: info&(1<<31) != 0,
+			sizeType: bo.Uint32(data[off+8:]),
+			off:      off,
+		}
+		name, err := s.name(nameOff)
+		if err != nil {
+			return fmt.Errorf("BTF type %d: %v", t.id, err)
+		}
+		t.name = name
+
+		rest := data[off+btfTypeLen:]
+		var extra int
+		switch t.kind {
+		case btfKindInt:
+			extra = 4
+			if len(rest) < extra {
+				break
+			}
+			t.encoding = bo.Uint32(rest)
+		case btfKindPtr, btfKindFwd, btfKindTypedef, btfKindVolatile, btfKindConst,
+			btfKindRestrict, btfKindFloat, btfKindTypeTag:
+		case btfKindFunc:
+			t.linkage = uint32(t.vlen)
+		case btfKindArray:
+			extra = 12
+			if len(rest) < extra {
+				break
+			}
+			t.array = btfArray{
+				typ:       bo.Uint32(rest),
+				indexType: bo.Uint32(rest[4:]),
+				nelems:    bo.Uint32(rest[8:]),
+			}
+		case btfKindStruct, btfKindUnion:
+			extra = 12 * int(t.vlen)
+			if len(rest) < extra {
+				break
+			}
+			t.members = make([]btfMember, t.vlen)
+			for i := range t.members {
+				m := rest[i*12:]
+				name, err := s.name(bo.Uint32(m))
+				if err != nil {
+					return fmt.Errorf("BTF type %d member %d: %v", t.id, i, err)
+				}
+				offset := bo.Uint32(m[8:])
+				t.members[i] = btfMember{name: name, typ: bo.Uint32(m[4:]), bitOffset: offset}
+				if t.kindFlag {
+					t.members[i].bitOffset = offset & 0xffffff
+					t.members[i].bitfieldSize = offset >> 24
+				}
+			}
+		case btfKindEnum:
+			extra = 8 * int(t.vlen)
+			if len(rest) < extra {
+				break
+			}
+			t.enums = make([]btfEnum, t.vlen)
+			for i := range t.enums {
+				e := rest[i*8:]
+				name, err := s.name(bo.Uint32(e))
+				if err != nil {
+					return fmt.Errorf("BTF type %d enumerator %d: %v", t.id, i, err)
+				}
+				value := int64(bo.Uint32(e[4:]))
+				if !t.kindFlag {
+					value = int64(int32(value))
+				}
+				t.enums[i] = btfEnum{name: name, value: value}
+			}
+		case btfKindEnum64:
+			extra = 12 * int(t.vlen)
+			if len(rest) < extra {
+				break
+			}
+			t.enums = make([]btfEnum, t.vlen)
+			for i := range t.enums {
+				e := rest[i*12:]
+				name, err := s.name(bo.Uint32(e))
+				if err != nil {
+					return fmt.Errorf("BTF type %d enumerator %d: %v", t.id, i, err)
+				}
+				value := uint64(bo.Uint32(e[8:]))<<32 | uint64(bo.Uint32(e[4:]))
+				t.enums[i] = btfEnum{name: name, value: int64(value)}
+			}
+		case btfKindFuncProto:
+			extra = 8 * int(t.vlen)
+			if len(rest) < extra {
+				break
+			}
+			t.params = make([]btfParam, t.vlen)
+			for i := range t.params {
+				p := rest[i*8:]
+				name, err := s.name(bo.Uint32(p))
+				if err != nil {
+					return fmt.Errorf("BTF type %d parameter %d: %v", t.id, i, err)
+				}
+				t.params[i] = btfParam{name: name, typ: bo.Uint32(p[4:])}
+			}
+		case btfKindVar:
+			extra = 4
+			if len(rest) < extra {
+				break
+			}
+			t.linkage = bo.Uint32(rest)
+		case btfKindDatasec:
+			extra = 12 * int(t.vlen)
+			if len(rest) < extra {
+				break
+			}
+			t.secinfos = make([]btfVarSecinfo, t.vlen)
+			for i := range t.secinfos {
+				v := rest[i*12:]
+				t.secinfos[i] = btfVarSecinfo{
+					typ:    bo.Uint32(v),
+					offset: bo.Uint32(v[4:]),
+					size:   bo.Uint32(v[8:]),
+				}
+			}
+		case btfKindDeclTag:
+			extra = 4
+			if len(rest) < extra {
+				break
+			}
+			t.componentIdx = int32(bo.Uint32(rest))
+		default:
+			return fmt.Errorf("BTF type %d has unknown kind %d", t.id, t.kind)
+		}
+		if len(rest) < extra {
+			return fmt.Errorf("BTF type %d (%s) truncated", t.id, btfKindName(t.kind))
+		}
+
+		s.types = append(s.types, t)
+		off += btfTypeLen + extra
+	}
+	return nil
+}
+
+// name returns the string at the given offset of the string section.
+func (s *btfSpec) name(off uint32) (string, error) {
+	strs := s.strings
+	if s.base != nil {
+		baseLen := uint32(len(s.base.strings))
+		if off < baseLen {
+			return s.base.name(off)
+		}
+		off -= baseLen
+	}
+	if int(off) >= len(strs) {
+		return "", fmt.Errorf("string offset %d out of bounds", off)
+	}
+	end := bytes.IndexByte(strs[off:], 0)
+	if end < 0 {
+		return "", fmt.Errorf("string at offset %d is not NUL terminated", off)
+	}
+	return string(strs[off : int(off)+end]), nil
+}
+
+func (s *btfSpec) typeByID(id uint32) (*btfType, error) {
+	if int(id) >= len(s.types) {
+		return nil, fmt.Errorf("BTF type ID %d out of range", id)
+	}
+	return s.types[id], nil
+}
+
+// skipModifiers follows typedefs and qualifiers until it finds a
+// "concrete" type.
+func (s *btfSpec) skipModifiers(id uint32) (*btfType, error) {
+	for i := 0; i < btfMaxModifiers; i++ {
+		t, err := s.typeByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if !t.isModifier() {
+			return t, nil
+		}
+		id = t.sizeType
+	}
+	return nil, fmt.Errorf("BTF type %d: too many modifiers", id)
+}
+
+// typeSize returns the size in bytes of the given type.
+func (s *btfSpec) typeSize(id uint32) (uint32, error) {
+	nelems := uint64(1)
+	for i := 0; i < btfMaxModifiers; i++ {
+		t, err := s.typeByID(id)
+		if err != nil {
+			return 0, err
+		}
+		switch t.kind {
+		case btfKindInt, btfKindStruct, btfKindUnion, btfKindEnum, btfKindEnum64,
+			btfKindDatasec, btfKindFloat:
+			size := nelems * uint64(t.sizeType)
+			if size > 0xffffffff {
+				return 0, fmt.Errorf("BTF type %d: size overflow", id)
+			}
+			return uint32(size), nil
+		case btfKindPtr:
+			return uint32(nelems * 8), nil
+		case btfKindTypedef, btfKindVolatile, btfKindConst, btfKindRestrict,
+			btfKindTypeTag, btfKindVar:
+			id = t.sizeType
+		case btfKindArray:
+			nelems *= uint64(t.array.nelems)
+			id = t.array.typ
+		default:
+			return 0, fmt.Errorf("BTF type %d (%s) has no size", id, btfKindName(t.kind))
+		}
+	}
+	return 0, fmt.Errorf("BTF type %d: too many modifiers", id)
+}
+
+// mapKeyValueTypes returns the key and value type IDs of a legacy map as
+// annotated by BPF_ANNOTATE_KV_PAIR, i.e. by a struct ____btf_map_<name>
+// with a key and a value member.
+func (s *btfSpec) mapKeyValueTypes(mapName string) (uint32, uint32, bool) {
+	id, ok := s.findType(btfKindStruct, "____btf_map_"+mapName)
+	if !ok {
+		return 0, 0, false
+	}
+	var keyID, valueID uint32
+	for _, m := range s.types[id].members {
+		switch m.name {
+		case "key":
+			keyID = m.typ
+		case "value":
+			valueID = m.typ
+		}
+	}
+	return keyID, valueID, keyID != 0 && valueID != 0
+}
+
+// findType returns the ID of the first type with the given kind and name.
+func (s *btfSpec) findType(kind uint8, name string) (uint32, bool) {
+	for _, t := range s.types {
+		if t != nil && t.kind == kind && t.name == name {
+			return t.id, true
+		}
+	}
+	return 0, false
+}
+
+// fixupDatasecs sets the sizes of DATASEC types and the offsets of the
+// variables they contain. Compilers leave them at zero since they are only
+// known once the object is linked, but the kernel rejects such types.
+func (s *btfSpec) fixupDatasecs(secSizes map[string]uint32, varOffsets map[string]uint32) error {
+	bo := s.byteOrder
+	for _, t := range s.types {
+		if t == nil || t.kind != btfKindDatasec || t.sizeType != 0 {
+			continue
+		}
+		size, ok := secSizes[t.name]
+		if !ok {
+			// leave it to the kernel to complain about it
+			continue
+		}
+		t.sizeType = size
+		bo.PutUint32(s.raw[s.typeOff+t.off+8:], size)
+
+		for i := range t.secinfos {
+			v, err := s.typeByID(t.secinfos[i].typ)
+			if err != nil {
+				return err
+			}
+			if v.kind != btfKindVar || v.linkage == btfVarGlobalExtern {
+				continue
+			}
+			offset, ok := varOffsets[v.name]
+			if !ok {
+				return fmt.Errorf("BTF variable %q in %q has no symbol", v.name, t.name)
+			}
+			t.secinfos[i].offset = offset
+			bo.PutUint32(s.raw[s.typeOff+t.off+btfTypeLen+i*12+4:], offset)
+		}
+	}
+	return nil
+}
+
+// btfFuncInfo and btfLineInfo match struct bpf_func_info and struct
+// bpf_line_info, except that insnOff is in instructions rather than bytes.
+type btfFuncInfo struct {
+	insnOff uint32
+	typeID  uint32
+}
+
+type btfLineInfo struct {
+	insnOff     uint32
+	fileNameOff uint32
+	lineOff     uint32
+	lineCol     uint32
+}
+
+// btfCoreRelo matches struct bpf_core_relo, except that insnOff is in
+// instructions rather than bytes and the access string is resolved.
+type btfCoreRelo struct {
+	insnOff  uint32
+	typeID   uint32
+	accessor string
+	kind     uint32
+}
+
+// btfExt holds the per-section records of a .BTF.ext section.
+type btfExt struct {
+	funcInfos map[string][]btfFuncInfo
+	lineInfos map[string][]btfLineInfo
+	coreRelos map[string][]btfCoreRelo
+}
+
+func parseBTFExt(data []byte, bo binary.ByteOrder, spec *btfSpec) (*btfExt, error) {
+	if len(data) < btfExtHeaderLen {
+		return nil, errors.New("BTF.ext header too short")
+	}
+	if bo.Uint16(data[0:2]) != btfMagic {
+		return nil, fmt.Errorf("invalid BTF.ext magic %#x", bo.Uint16(data[0:2]))
+	}
+	hdrLen := bo.Uint32(data[4:8])
+	if hdrLen < btfExtHeaderLen || uint64(hdrLen) > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid BTF.ext header length %d", hdrLen)
+	}
+
+	ext := &btfExt{
+		funcInfos: make(map[string][]btfFuncInfo),
+		lineInfos: make(map[string][]btfLineInfo),
+		coreRelos: make(map[string][]btfCoreRelo),
+	}
+
+	funcInfo, ok := btfSubslice(data, uint64(hdrLen)+uint64(bo.Uint32(data[8:12])), uint64(bo.Uint32(data[12:16])))
+	if !ok {
+		return nil, errors.New("BTF.ext func_info out of bounds")
+	}
+	err := parseBTFExtInfo(funcInfo, bo, spec, btfFuncInfoLen, func(secName string, rec []byte) {
+		ext.funcInfos[secName] = append(ext.funcInfos[secName], btfFuncInfo{
+			insnOff: bo.Uint32(rec) / bpfInsnLen,
+			typeID:  bo.Uint32(rec[4:]),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BTF.ext func_info: %v", err)
+	}
+
+	lineInfo, ok := btfSubslice(data, uint64(hdrLen)+uint64(bo.Uint32(data[16:20])), uint64(bo.Uint32(data[20:24])))
+	if !ok {
+		return nil, errors.New("BTF.ext line_info out of bounds")
+	}
+	err = parseBTFExtInfo(lineInfo, bo, spec, btfLineInfoLen, func(secName string, rec []byte) {
+		ext.lineInfos[secName] = append(ext.lineInfos[secName], btfLineInfo{
+			insnOff:     bo.Uint32(rec) / bpfInsnLen,
+			fileNameOff: bo.Uint32(rec[4:]),
+			lineOff:     bo.Uint32(rec[8:]),
+			lineCol:     bo.Uint32(rec[12:]),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BTF.ext line_info: %v", err)
+	}
+
+	// older compilers emit a header without the core_relo sub-section
+	if hdrLen < btfExtHeaderLen+8 {
+		return ext, nil
+	}
+	coreRelo, ok := btfSubslice(data, uint64(hdrLen)+uint64(bo.Uint32(data[24:28])), uint64(bo.Uint32(data[28:32])))
+	if !ok {
+		return nil, errors.New("BTF.ext core_relo out of bounds")
+	}
+	var accessErr error
+	err = parseBTFExtInfo(coreRelo, bo, spec, btfCoreReloLen, func(secName string, rec []byte) {
+		accessor, err := spec.name(bo.Uint32(rec[8:]))
+		if err != nil {
+			accessErr = err
+			return
+		}
+		ext.coreRelos[secName] = append(ext.coreRelos[secName], btfCoreRelo{
+			insnOff:  bo.Uint32(rec) / bpfInsnLen,
+			typeID:   bo.Uint32(rec[4:]),
+			accessor: accessor,
+			kind:     bo.Uint32(rec[12:]),
+		})
+	})
+	if err == nil {
+		err = accessErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("BTF.ext core_relo: %v", err)
+	}
+
+	return ext, nil
+}
+
+// parseBTFExtInfo walks a func_info, line_info or core_relo sub-section:
+// a record size followed by a list of (section name, record count, records).
+func parseBTFExtInfo(data []byte, bo binary.ByteOrder, spec *btfSpec, minRecSize uint32, fn func(secName string, rec []byte)) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) < 4 {
+		return errors.New("record size truncated")
+	}
+	recSize := bo.Uint32(data)
+	if recSize < minRecSize {
+		return fmt.Errorf("record size %d too small", recSize)
+	}
+	data = data[4:]
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errors.New("section header truncated")
+		}
+		secName, err := spec.name(bo.Uint32(data))
+		if err != nil {
+			return err
+		}
+		numInfo := bo.Uint32(data[4:])
+		data = data[8:]
+		if uint64(numInfo)*uint64(recSize) > uint64(len(data)) {
+			return fmt.Errorf("records for section %q truncated", secName)
+		}
+		for i := uint32(0); i < numInfo; i++ {
+			fn(secName, data[:recSize])
+			data = data[recSize:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+#include <linux/unistd.h>
+#include <string.h>
+#include <unistd.h>
+
+extern __u64 ptr_to_u64(void *);
+
+static int bpf_load_btf(const void *btf, __u32 btf_size, char *log_buf, __u32 log_size)
+{
+	union bpf_attr attr;
+	memset(&attr, 0, sizeof(attr));
+
+	attr.btf = ptr_to_u64((void *) btf);
+	attr.btf_size = btf_size;
+	if (log_buf != NULL && log_size > 0) {
+		attr.btf_log_buf = ptr_to_u64(log_buf);
+		attr.btf_log_size = log_size;
+		attr.btf_log_level = 1;
+	}
+
+	return syscall(__NR_bpf, BPF_BTF_LOAD, &attr, sizeof(attr));
+}
+*/
+import "C"
+
+// load passes the BTF to the kernel and returns the BTF fd. On failure the
+// verifier log is returned as part of the error.
+func (s *btfSpec) load() (int, error) {
+	if s.base != nil {
+		return -1, errors.New("split BTF cannot be loaded")
+	}
+	raw := unsafe.Pointer(&s.raw[0])
+	fd, err := C.bpf_load_btf(raw, C.__u32(len(s.raw)), nil, 0)
+	if fd >= 0 {
+		return int(fd), nil
+	}
+
+	log := make([]byte, 64*1024)
+	fd, err = C.bpf_load_btf(raw, C.__u32(len(s.raw)), (*C.char)(unsafe.Pointer(&log[0])), C.__u32(len(log)))
+	if fd >= 0 {
+		return int(fd), nil
+	}
+	if n := bytes.IndexByte(log, 0); n >= 0 {
+		log = log[:n]
+	}
+	errno, _ := err.(syscall.Errno)
+	return -1, &btfLoadError{errno: errno, log: log}
+}
+
+// btfLoadError is the error of the kernel rejecting BTF, with its log.
+type btfLoadError struct {
+	errno syscall.Errno
+	log   []byte
+}
+
+func (e *btfLoadError) Error() string {
+	return fmt.Sprintf("error loading BTF (%v):\n%s", e.errno, e.log)
+}
+
+// unsupported tells whether the kernel doesn't support BTF, or some of the
+// types, as opposed to failing to load it.
+func (e *btfLoadError) unsupported() bool {
+	return e.errno == syscall.EINVAL || e.errno == syscall.EOPNOTSUPP
+}
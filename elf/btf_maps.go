@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+)
+
+const (
+	// pinning values of BTF-defined maps, as in libbpf
+	btfPinNone   = 0
+	btfPinByName = 1
+)
+
+// btfMapSpec is a map definition declared in the .maps section with the
+// __uint(), __type() and __array() macros from libbpf's bpf_helpers.h.
+type btfMapSpec struct {
+	name        string
+	offset      uint32 // of the variable within the .maps section
+	mapType     uint32
+	keySize     uint32
+	valueSize   uint32
+	maxEntries  uint32
+	mapFlags    uint32
+	pinning     uint32
+	keyTypeID   uint32
+	valueTypeID uint32
+	// inner is the definition of the inner map of ARRAY_OF_MAPS and
+	// HASH_OF_MAPS maps
+	inner *btfMapSpec
+	// valuesOffset is the offset of the values declared with __array()
+	// within the definition, which may initialise prog arrays and
+	// map-in-maps
+	valuesOffset uint32
+	hasValues    bool
+}
+
+// mapSpecs decodes the map definitions of the given DATASEC, usually
+// ".maps".
+func (s *btfSpec) mapSpecs(secName string) ([]*btfMapSpec, error) {
+	id, ok := s.findType(btfKindDatasec, secName)
+	if !ok {
+		return nil, fmt.Errorf("no BTF DATASEC for section %q", secName)
+	}
+
+	var specs []*btfMapSpec
+	for _, vsi := range s.types[id].secinfos {
+		v, err := s.typeByID(vsi.typ)
+		if err != nil {
+			return nil, err
+		}
+		if v.kind != btfKindVar {
+			return nil, fmt.Errorf("%s: unexpected %s in %q", v.name, btfKindName(v.kind), secName)
+		}
+		def, err := s.skipModifiers(v.sizeType)
+		if err != nil {
+			return nil, err
+		}
+		if def.kind != btfKindStruct {
+			return nil, fmt.Errorf("map %q: definition is a %s, not a struct", v.name, btfKindName(def.kind))
+		}
+		spec, err := s.mapSpec(v.name, def, false)
+		if err != nil {
+			return nil, fmt.Errorf("map %q: %v", v.name, err)
+		}
+		spec.offset = vsi.offset
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (s *btfSpec) mapSpec(name string, def *btfType, inner bool) (*btfMapSpec, error) {
+	spec := &btfMapSpec{name: name}
+	for _, m := range def.members {
+		var err error
+		switch m.name {
+		case "type":
+			spec.mapType, err = s.mapUint(m)
+		case "max_entries":
+			spec.maxEntries, err = s.mapUint(m)
+		case "map_flags":
+			spec.mapFlags, err = s.mapUint(m)
+		case "pinning":
+			if inner {
+				return nil, fmt.Errorf("inner map definition can't be pinned")
+			}
+			spec.pinning, err = s.mapUint(m)
+			if err == nil && spec.pinning != btfPinNone && spec.pinning != btfPinByName {
+				err = fmt.Errorf("unsupported pinning %d", spec.pinning)
+			}
+		case "key_size":
+			var size uint32
+			if size, err = s.mapUint(m); err == nil {
+				err = spec.setSize(&spec.keySize, size, "key")
+			}
+		case "value_size":
+			var size uint32
+			if size, err = s.mapUint(m); err == nil {
+				err = spec.setSize(&spec.valueSize, size, "value")
+			}
+		case "key":
+			var size uint32
+			if spec.keyTypeID, size, err = s.mapType(m); err == nil {
+				err = spec.setSize(&spec.keySize, size, "key")
+			}
+		case "value":
+			var size uint32
+			if spec.valueTypeID, size, err = s.mapType(m); err == nil {
+				err = spec.setSize(&spec.valueSize, size, "value")
+			}
+		case "values":
+			if inner {
+				return nil, fmt.Errorf("nested map-in-map definitions are not supported")
+			}
+			spec.inner, err = s.innerMapSpec(name, m)
+			spec.valuesOffset, spec.hasValues = m.bitOffset/8, true
+		case "numa_node", "map_extra":
+			// not used by the loader
+		default:
+			return nil, fmt.Errorf("unknown map attribute %q", m.name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %v", m.name, err)
+		}
+	}
+	if spec.inner != nil {
+		// the values of map-in-maps are map fds
+		if err := spec.setSize(&spec.valueSize, 4, "value"); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+func (spec *btfMapSpec) setSize(field *uint32, size uint32, what string) error {
+	if *field != 0 && *field != size {
+		return fmt.Errorf("conflicting %s size %d and %d", what, *field, size)
+	}
+	*field = size
+	return nil
+}
+
+// mapUint decodes __uint(name, val), which is defined as int (*name)[val].
+func (s *btfSpec) mapUint(m btfMember) (uint32, error) {
+	ptr, err := s.skipModifiers(m.typ)
+	if err != nil {
+		return 0, err
+	}
+	if ptr.kind != btfKindPtr {
+		return 0, fmt.Errorf("expected a pointer, got %s", btfKindName(ptr.kind))
+	}
+	arr, err := s.skipModifiers(ptr.sizeType)
+	if err != nil {
+		return 0, err
+	}
+	if arr.kind != btfKindArray {
+		return 0, fmt.Errorf("expected a pointer to an array, got a pointer to %s", btfKindName(arr.kind))
+	}
+	return arr.array.nelems, nil
+}
+
+// mapType decodes __type(name, val), which is defined as typeof(val) *name.
+// It returns the ID and size of the pointed to type.
+func (s *btfSpec) mapType(m btfMember) (uint32, uint32, error) {
+	ptr, err := s.skipModifiers(m.typ)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ptr.kind != btfKindPtr {
+		return 0, 0, fmt.Errorf("expected a pointer, got %s", btfKindName(ptr.kind))
+	}
+	size, err := s.typeSize(ptr.sizeType)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ptr.sizeType, size, nil
+}
+
+// innerMapSpec decodes __array(values, struct inner), which is defined as
+// struct inner *values[]. Arrays of function pointers, as used to
+// initialise program arrays, don't describe an inner map.
+func (s *btfSpec) innerMapSpec(outerName string, m btfMember) (*btfMapSpec, error) {
+	arr, err := s.skipModifiers(m.typ)
+	if err != nil {
+		return nil, err
+	}
+	if arr.kind != btfKindArray || arr.array.nelems != 0 {
+		return nil, fmt.Errorf("expected a flexible array")
+	}
+	ptr, err := s.skipModifiers(arr.array.typ)
+	if err != nil {
+		return nil, err
+	}
+	if ptr.kind != btfKindPtr {
+		return nil, fmt.Errorf("expected an array of pointers, got an array of %s", btfKindName(ptr.kind))
+	}
+	def, err := s.skipModifiers(ptr.sizeType)
+	if err != nil {
+		return nil, err
+	}
+	switch def.kind {
+	case btfKindFuncProto:
+		return nil, nil
+	case btfKindStruct:
+		return s.mapSpec(outerName+".inner", def, true)
+	}
+	return nil, fmt.Errorf("expected an array of struct pointers, got an array of %s pointers", btfKindName(def.kind))
+}
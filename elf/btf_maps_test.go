@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestBTFMapSpecs(t *testing.T) {
+	b := newBTFBuilder()
+	intID := b.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	u64ID := b.add("__u64", btfKindInt, 0, false, 8, 64)
+	// __uint(name, val) is int (*name)[val]
+	uintType := func(val uint32) uint32 {
+		arr := b.add("", btfKindArray, 0, false, 0, intID, intID, val)
+		return b.add("", btfKindPtr, 0, false, arr)
+	}
+	intPtrID := b.add("", btfKindPtr, 0, false, intID)
+	u64PtrID := b.add("", btfKindPtr, 0, false, u64ID)
+
+	hashDef := b.add("", btfKindStruct, 5, false, 40,
+		b.str("type"), uintType(1), 0,
+		b.str("max_entries"), uintType(1024), 64,
+		b.str("key"), intPtrID, 128,
+		b.str("value"), u64PtrID, 192,
+		b.str("pinning"), uintType(btfPinByName), 256)
+	hashVar := b.add("counts", btfKindVar, 0, false, hashDef, 1)
+
+	innerDef := b.add("inner", btfKindStruct, 3, false, 24,
+		b.str("type"), uintType(2), 0,
+		b.str("max_entries"), uintType(1), 64,
+		b.str("value_size"), uintType(8), 128)
+	innerPtr := b.add("", btfKindPtr, 0, false, innerDef)
+	valuesArr := b.add("", btfKindArray, 0, false, 0, innerPtr, intID, 0)
+	outerDef := b.add("", btfKindStruct, 4, false, 32,
+		b.str("type"), uintType(12), 0,
+		b.str("max_entries"), uintType(8), 64,
+		b.str("key_size"), uintType(4), 128,
+		b.str("values"), valuesArr, 192)
+	outerVar := b.add("outer", btfKindVar, 0, false, outerDef, 1)
+
+	b.add(".maps", btfKindDatasec, 2, false, 72,
+		hashVar, 0, 40,
+		outerVar, 40, 32)
+
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs, err := spec.mapSpecs(".maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 {
+		t.Fatalf("expected 2 maps, got %d", len(specs))
+	}
+
+	hash := specs[0]
+	if hash.name != "counts" || hash.mapType != 1 || hash.maxEntries != 1024 ||
+		hash.keySize != 4 || hash.valueSize != 8 || hash.pinning != btfPinByName {
+		t.Errorf("unexpected map spec: %+v", hash)
+	}
+	if hash.keyTypeID != intID || hash.valueTypeID != u64ID {
+		t.Errorf("unexpected key/value types %d/%d", hash.keyTypeID, hash.valueTypeID)
+	}
+
+	outer := specs[1]
+	if outer.offset != 40 || outer.keySize != 4 || outer.valueSize != 4 || outer.inner == nil ||
+		!outer.hasValues || outer.valuesOffset != 24 {
+		t.Fatalf("unexpected map-in-map spec: %+v", outer)
+	}
+	if inner := outer.inner; inner.mapType != 2 || inner.valueSize != 8 || inner.maxEntries != 1 {
+		t.Errorf("unexpected inner map spec: %+v", inner)
+	}
+
+	if _, err := spec.mapSpecs(".data"); err == nil {
+		t.Error("expected error for missing DATASEC")
+	}
+}
+
+func TestBTFMapSpecsInvalid(t *testing.T) {
+	b := newBTFBuilder()
+	intID := b.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	intPtrID := b.add("", btfKindPtr, 0, false, intID)
+	arr := b.add("", btfKindArray, 0, false, 0, intID, intID, 8)
+	sizePtr := b.add("", btfKindPtr, 0, false, arr)
+	def := b.add("", btfKindStruct, 2, false, 16,
+		b.str("key"), intPtrID, 0,
+		b.str("key_size"), sizePtr, 64)
+	v := b.add("conflict", btfKindVar, 0, false, def, 1)
+	unknownDef := b.add("", btfKindStruct, 1, false, 8,
+		b.str("bogus"), intPtrID, 0)
+	v2 := b.add("unknown", btfKindVar, 0, false, unknownDef, 1)
+	b.add(".maps", btfKindDatasec, 1, false, 16, v, 0, 16)
+	b.add(".maps.unknown", btfKindDatasec, 1, false, 8, v2, 0, 8)
+
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.mapSpecs(".maps"); err == nil {
+		t.Error("expected error for conflicting key sizes")
+	}
+	if _, err := spec.mapSpecs(".maps.unknown"); err == nil {
+		t.Error("expected error for unknown map attribute")
+	}
+}
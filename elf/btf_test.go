@@ -0,0 +1,198 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// btfBuilder assembles raw BTF for tests.
+type btfBuilder struct {
+	types   bytes.Buffer
+	strs    []byte
+	strOffs map[string]uint32
+	nextID  uint32
+}
+
+func newBTFBuilder() *btfBuilder {
+	return &btfBuilder{strs: []byte{0}, strOffs: map[string]uint32{"": 0}, nextID: 1}
+}
+
+func (b *btfBuilder) str(s string) uint32 {
+	if off, ok := b.strOffs[s]; ok {
+		return off
+	}
+	off := uint32(len(b.strs))
+	b.strs = append(append(b.strs, s...), 0)
+	b.strOffs[s] = off
+	return off
+}
+
+// add appends a type record and returns its ID.
+func (b *btfBuilder) add(name string, kind uint8, vlen int, kindFlag bool, sizeType uint32, extra ...uint32) uint32 {
+	info := uint32(kind)<<24 | uint32(vlen)
+	if kindFlag {
+		info |= 1 << 31
+	}
+	for _, v := range append([]uint32{b.str(name), info, sizeType}, extra...) {
+		binary.Write(&b.types, binary.LittleEndian, v)
+	}
+	b.nextID++
+	return b.nextID - 1
+}
+
+func (b *btfBuilder) bytes() []byte {
+	var out bytes.Buffer
+	hdr := []interface{}{
+		uint16(btfMagic), uint8(1), uint8(0), uint32(btfHeaderLen),
+		uint32(0), uint32(b.types.Len()),
+		uint32(b.types.Len()), uint32(len(b.strs)),
+	}
+	for _, v := range hdr {
+		binary.Write(&out, binary.LittleEndian, v)
+	}
+	out.Write(b.types.Bytes())
+	out.Write(b.strs)
+	return out.Bytes()
+}
+
+func TestParseBTF(t *testing.T) {
+	b := newBTFBuilder()
+	intID := b.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	constID := b.add("", btfKindConst, 0, false, intID)
+	typedefID := b.add("s32", btfKindTypedef, 0, false, constID)
+	ptrID := b.add("", btfKindPtr, 0, false, intID)
+	arrID := b.add("", btfKindArray, 0, false, 0, typedefID, intID, 16)
+	structID := b.add("foo", btfKindStruct, 3, true, 80,
+		b.str("a"), typedefID, 0,
+		b.str("b"), ptrID, 64,
+		b.str("c"), intID, 3<<24|128)
+	varID := b.add("bar", btfKindVar, 0, false, structID, 1)
+	datasecID := b.add(".data", btfKindDatasec, 1, false, 0, varID, 0, 80)
+	protoID := b.add("", btfKindFuncProto, 1, false, intID, b.str("ctx"), ptrID)
+	funcID := b.add("prog", btfKindFunc, 1, false, protoID)
+	b.add("", btfKindStruct, 0, false, 0)
+	kvID := b.add("____btf_map_events", btfKindStruct, 2, false, 8,
+		b.str("key"), intID, 0,
+		b.str("value"), intID, 32)
+
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(spec.types); got != int(kvID)+1 {
+		t.Fatalf("expected %d types, got %d", kvID+1, got)
+	}
+	foo := spec.types[structID]
+	if foo.name != "foo" || !foo.isComposite() || len(foo.members) != 3 {
+		t.Fatalf("unexpected struct: %+v", foo)
+	}
+	if m := foo.members[2]; m.bitOffset != 128 || m.bitfieldSize != 3 {
+		t.Errorf("unexpected bitfield member: %+v", m)
+	}
+	if p := spec.types[protoID].params; len(p) != 1 || p[0].name != "ctx" || p[0].typ != ptrID {
+		t.Errorf("unexpected func_proto params: %+v", p)
+	}
+	if f := spec.types[funcID]; f.name != "prog" || f.linkage != 1 {
+		t.Errorf("unexpected func: %+v", f)
+	}
+
+	concrete, err := spec.skipModifiers(typedefID)
+	if err != nil || concrete.id != intID {
+		t.Errorf("skipModifiers(%d) = %v, %v; want type %d", typedefID, concrete, err, intID)
+	}
+	for id, want := range map[uint32]uint32{intID: 4, typedefID: 4, ptrID: 8, arrID: 64, structID: 80, varID: 80} {
+		if size, err := spec.typeSize(id); err != nil || size != want {
+			t.Errorf("typeSize(%d) = %d, %v; want %d", id, size, err, want)
+		}
+	}
+
+	if key, value, ok := spec.mapKeyValueTypes("events"); !ok || key != intID || value != intID {
+		t.Errorf("mapKeyValueTypes = %d, %d, %v", key, value, ok)
+	}
+	if _, _, ok := spec.mapKeyValueTypes("missing"); ok {
+		t.Error("expected no key/value annotation for unknown map")
+	}
+
+	err = spec.fixupDatasecs(map[string]uint32{".data": 96}, map[string]uint32{"bar": 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, err := parseBTF(spec.raw, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datasec := fixed.types[datasecID]
+	if datasec.sizeType != 96 || datasec.secinfos[0].offset != 16 {
+		t.Errorf("datasec not fixed up: %+v", datasec)
+	}
+}
+
+func TestParseBTFInvalid(t *testing.T) {
+	b := newBTFBuilder()
+	b.add("int", btfKindInt, 0, false, 4, 32)
+	data := b.bytes()
+
+	if _, err := parseBTF(data[:10], binary.LittleEndian); err == nil {
+		t.Error("expected error for truncated header")
+	}
+	if _, err := parseBTF(data, binary.BigEndian); err == nil {
+		t.Error("expected error for wrong byte order")
+	}
+	// cut the INT encoding
+	truncated := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(truncated[12:], btfTypeLen)
+	binary.LittleEndian.PutUint32(truncated[16:], btfTypeLen)
+	if _, err := parseBTF(truncated, binary.LittleEndian); err == nil {
+		t.Error("expected error for truncated type")
+	}
+}
+
+func TestParseBTFExt(t *testing.T) {
+	b := newBTFBuilder()
+	secName := b.str("kprobe/foo")
+	fileName := b.str("foo.c")
+	line := b.str("return 0;")
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var funcInfo, lineInfo bytes.Buffer
+	for _, v := range []uint32{btfFuncInfoLen, secName, 1, 0, 3} {
+		binary.Write(&funcInfo, binary.LittleEndian, v)
+	}
+	for _, v := range []uint32{btfLineInfoLen, secName, 2, 0, fileName, line, 10<<10 | 2, 16, fileName, line, 11<<10 | 2} {
+		binary.Write(&lineInfo, binary.LittleEndian, v)
+	}
+	var ext bytes.Buffer
+	for _, v := range []interface{}{
+		uint16(btfMagic), uint8(1), uint8(0), uint32(btfExtHeaderLen),
+		uint32(0), uint32(funcInfo.Len()),
+		uint32(funcInfo.Len()), uint32(lineInfo.Len()),
+	} {
+		binary.Write(&ext, binary.LittleEndian, v)
+	}
+	ext.Write(funcInfo.Bytes())
+	ext.Write(lineInfo.Bytes())
+
+	info, err := parseBTFExt(ext.Bytes(), binary.LittleEndian, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi := info.funcInfos["kprobe/foo"]; len(fi) != 1 || fi[0].typeID != 3 {
+		t.Errorf("unexpected func info: %+v", fi)
+	}
+	li := info.lineInfos["kprobe/foo"]
+	if len(li) != 2 {
+		t.Fatalf("expected 2 line info records, got %d", len(li))
+	}
+	// byte offsets are converted to instruction offsets
+	if li[1].insnOff != 2 || li[1].lineCol>>10 != 11 {
+		t.Errorf("unexpected line info: %+v", li[1])
+	}
+}
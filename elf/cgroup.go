@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+#include <linux/unistd.h>
+#include <string.h>
+#include <unistd.h>
+
+extern __u64 ptr_to_u64(void *);
+
+static int bpf_prog_attach_flags(int prog_fd, int target_fd, enum bpf_attach_type type,
+				 __u32 flags, int replace_fd)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.target_fd	   = target_fd;
+	attr.attach_bpf_fd = prog_fd;
+	attr.attach_type   = type;
+	attr.attach_flags  = flags;
+	if (replace_fd >= 0)
+		attr.replace_bpf_fd = replace_fd;
+
+	return syscall(__NR_bpf, BPF_PROG_ATTACH, &attr, sizeof(attr));
+}
+
+static int bpf_prog_query(int target_fd, enum bpf_attach_type type, __u32 query_flags,
+			  __u32 *attach_flags, __u32 *prog_ids, __u32 *prog_cnt)
+{
+	union bpf_attr attr;
+	int ret;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.query.target_fd   = target_fd;
+	attr.query.attach_type = type;
+	attr.query.query_flags = query_flags;
+	attr.query.prog_ids    = ptr_to_u64(prog_ids);
+	attr.query.prog_cnt    = *prog_cnt;
+
+	ret = syscall(__NR_bpf, BPF_PROG_QUERY, &attr, sizeof(attr));
+	*attach_flags = attr.query.attach_flags;
+	*prog_cnt = attr.query.prog_cnt;
+	return ret;
+}
+*/
+import "C"
+
+// AttachFlags tell how a program attached to a cgroup interacts with the
+// programs attached to its ancestors and descendants.
+type AttachFlags uint32
+
+const (
+	// AllowOverride lets the programs attached to descendant cgroups
+	// override the program.
+	AllowOverride AttachFlags = C.BPF_F_ALLOW_OVERRIDE
+	// AllowMulti lets several programs be attached to the cgroup, which
+	// are run in order along with the programs of the ancestor cgroups.
+	AllowMulti AttachFlags = C.BPF_F_ALLOW_MULTI
+	// Replace atomically replaces a program attached with AllowMulti,
+	// see ReplaceCgroupProgram.
+	Replace AttachFlags = C.BPF_F_REPLACE
+)
+
+// CgroupPrograms lists the programs attached to a cgroup for an attach type.
+type CgroupPrograms struct {
+	// Flags are the flags the programs were attached with.
+	Flags AttachFlags
+	// IDs are the IDs of the programs, in the order they are run.
+	IDs []uint32
+}
+
+// AttachCgroupProgramWithFlags attaches the program to the cgroup with
+// the given flags, e.g. AllowMulti to attach it alongside the programs
+// already attached to the cgroup rather than replacing them.
+func AttachCgroupProgramWithFlags(cgroupProg *CgroupProgram, cgroupPath string, attachType AttachType, flags AttachFlags) error {
+	return AttachCgroupProgramFromFdWithFlags(cgroupProg.fd, cgroupPath, attachType, flags)
+}
+
+// AttachCgroupProgramFromFdWithFlags is AttachCgroupProgramWithFlags for a
+// program given by fd.
+func AttachCgroupProgramFromFdWithFlags(progFd int, cgroupPath string, attachType AttachType, flags AttachFlags) error {
+	if flags&Replace != 0 {
+		return fmt.Errorf("use ReplaceCgroupProgram to replace a program")
+	}
+	return attachCgroupProgram(progFd, -1, cgroupPath, attachType, flags)
+}
+
+// ReplaceCgroupProgram atomically replaces the program oldProgFd, attached
+// to the cgroup with AllowMulti, with cgroupProg, keeping its position in
+// the list of programs run for the cgroup.
+func ReplaceCgroupProgram(cgroupProg *CgroupProgram, oldProgFd int, cgroupPath string, attachType AttachType) error {
+	return attachCgroupProgram(cgroupProg.fd, oldProgFd, cgroupPath, attachType, AllowMulti|Replace)
+}
+
+func attachCgroupProgram(progFd, replaceFd int, cgroupPath string, attachType AttachType, flags AttachFlags) error {
+	f, err := os.Open(cgroupPath)
+	if err != nil {
+		return fmt.Errorf("error opening cgroup %q: %v", cgroupPath, err)
+	}
+	defer f.Close()
+
+	ret, err := C.bpf_prog_attach_flags(C.int(progFd), C.int(f.Fd()), uint32(attachType), C.__u32(flags), C.int(replaceFd))
+	if ret < 0 {
+		return fmt.Errorf("failed to attach prog to cgroup %q: %v", cgroupPath, err)
+	}
+	return nil
+}
+
+// QueryCgroupPrograms returns the programs attached to the cgroup for the
+// given attach type. Programs attached to the ancestors of the cgroup, which
+// are run as well, aren't included.
+func QueryCgroupPrograms(cgroupPath string, attachType AttachType) (*CgroupPrograms, error) {
+	f, err := os.Open(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cgroup %q: %v", cgroupPath, err)
+	}
+	defer f.Close()
+
+	var flags, count C.__u32
+	// the first call returns the number of programs; more may be attached
+	// before the second one, in which case it fails with ENOSPC
+	for {
+		var ids []uint32
+		var idsPtr *C.__u32
+		if count > 0 {
+			ids = make([]uint32, count)
+			idsPtr = (*C.__u32)(unsafe.Pointer(&ids[0]))
+		}
+		requested := count
+		ret, err := C.bpf_prog_query(C.int(f.Fd()), uint32(attachType), 0, &flags, idsPtr, &count)
+		if ret < 0 {
+			if err == syscall.ENOSPC {
+				continue
+			}
+			return nil, fmt.Errorf("error querying programs of cgroup %q: %v", cgroupPath, err)
+		}
+		if count > requested {
+			continue
+		}
+		return &CgroupPrograms{Flags: AttachFlags(flags), IDs: ids[:count]}, nil
+	}
+}
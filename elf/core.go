@@ -0,0 +1,776 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CO-RE relocation kinds, see enum bpf_core_relo_kind in
+// include/uapi/linux/bpf.h
+const (
+	coreFieldByteOffset = iota
+	coreFieldByteSize
+	coreFieldExists
+	coreFieldSigned
+	coreFieldLShiftU64
+	coreFieldRShiftU64
+	coreTypeIDLocal
+	coreTypeIDTarget
+	coreTypeExists
+	coreTypeSize
+	coreEnumvalExists
+	coreEnumvalValue
+	coreTypeMatches
+)
+
+// DefaultKernelBTFPath is where the kernel exposes its own BTF when built
+// with CONFIG_DEBUG_INFO_BTF.
+const DefaultKernelBTFPath = "/sys/kernel/btf/vmlinux"
+
+// corePoisonImm is the helper ID libbpf uses to mark instructions whose
+// relocation couldn't be resolved. The verifier only complains about them
+// if they are reachable.
+const corePoisonImm = 0xbad2310
+
+const (
+	// instruction classes and fields, see include/uapi/linux/bpf_common.h
+	bpfClassLD    = 0x00
+	bpfClassLDX   = 0x01
+	bpfClassST    = 0x02
+	bpfClassSTX   = 0x03
+	bpfClassALU   = 0x04
+	bpfClassJMP   = 0x05
+	bpfClassALU64 = 0x07
+	bpfSizeW      = 0x00
+	bpfSizeH      = 0x08
+	bpfSizeB      = 0x10
+	bpfSizeDW     = 0x18
+	bpfModeIMM    = 0x00
+	bpfSrcX       = 0x08
+	bpfOpCall     = 0x80
+	bpfInsnLen    = 8
+)
+
+func coreKindName(kind uint32) string {
+	switch kind {
+	case coreFieldByteOffset:
+		return "byte_off"
+	case coreFieldByteSize:
+		return "byte_sz"
+	case coreFieldExists:
+		return "field_exists"
+	case coreFieldSigned:
+		return "signed"
+	case coreFieldLShiftU64:
+		return "lshift_u64"
+	case coreFieldRShiftU64:
+		return "rshift_u64"
+	case coreTypeIDLocal:
+		return "local_type_id"
+	case coreTypeIDTarget:
+		return "target_type_id"
+	case coreTypeExists:
+		return "type_exists"
+	case coreTypeSize:
+		return "type_size"
+	case coreEnumvalExists:
+		return "enumval_exists"
+	case coreEnumvalValue:
+		return "enumval_value"
+	case coreTypeMatches:
+		return "type_matches"
+	}
+	return fmt.Sprintf("kind(%d)", kind)
+}
+
+func coreIsFieldKind(kind uint32) bool {
+	return kind <= coreFieldRShiftU64
+}
+
+func coreIsTypeKind(kind uint32) bool {
+	switch kind {
+	case coreTypeIDLocal, coreTypeIDTarget, coreTypeExists, coreTypeSize, coreTypeMatches:
+		return true
+	}
+	return false
+}
+
+func coreIsEnumvalKind(kind uint32) bool {
+	return kind == coreEnumvalExists || kind == coreEnumvalValue
+}
+
+// coreAccessor is a step of a field access: a named struct or union member,
+// or an array element.
+type coreAccessor struct {
+	// typeID is the ID of the struct, union or enum for named accessors,
+	// and the ID of the element type for array accessors
+	typeID uint32
+	idx    int
+	name   string
+}
+
+// coreSpec is a CO-RE access string resolved against a BTF: the type, the
+// member or enumerator it refers to and, for fields, the bit offset of the
+// field from the start of the root type.
+type coreSpec struct {
+	btf    *btfSpec
+	rootID uint32
+	kind   uint32
+	// accessors holds one entry per array index and per named member;
+	// anonymous struct and union members are skipped
+	accessors []coreAccessor
+	bitOffset uint32
+}
+
+// coreEssentialName strips the ___<flavor> suffix BPF programs use to
+// declare several versions of a kernel type.
+func coreEssentialName(name string) string {
+	if i := strings.LastIndex(name, "___"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func parseCoreAccessor(accessor string) ([]int, error) {
+	if accessor == "" {
+		return nil, errors.New("empty access string")
+	}
+	parts := strings.Split(accessor, ":")
+	raw := make([]int, len(parts))
+	for i, p := range parts {
+		idx, err := strconv.Atoi(p)
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("invalid access string %q", accessor)
+		}
+		raw[i] = idx
+	}
+	return raw, nil
+}
+
+// coreLocalSpec resolves the access string of a relocation against the
+// program's BTF.
+func (s *btfSpec) coreLocalSpec(relo btfCoreRelo) (*coreSpec, error) {
+	raw, err := parseCoreAccessor(relo.accessor)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.skipModifiers(relo.typeID)
+	if err != nil {
+		return nil, err
+	}
+	spec := &coreSpec{btf: s, rootID: relo.typeID, kind: relo.kind}
+
+	switch {
+	case coreIsTypeKind(relo.kind):
+		if len(raw) != 1 || raw[0] != 0 {
+			return nil, fmt.Errorf("invalid access string %q for %s relocation", relo.accessor, coreKindName(relo.kind))
+		}
+		return spec, nil
+	case coreIsEnumvalKind(relo.kind):
+		if t.kind != btfKindEnum && t.kind != btfKindEnum64 {
+			return nil, fmt.Errorf("%s relocation against %s", coreKindName(relo.kind), btfKindName(t.kind))
+		}
+		if len(raw) != 1 || raw[0] >= len(t.enums) {
+			return nil, fmt.Errorf("invalid access string %q for enum %q", relo.accessor, t.name)
+		}
+		spec.accessors = []coreAccessor{{typeID: t.id, idx: raw[0], name: t.enums[raw[0]].name}}
+		return spec, nil
+	case !coreIsFieldKind(relo.kind):
+		return nil, fmt.Errorf("unsupported relocation kind %s", coreKindName(relo.kind))
+	}
+
+	// the first index is an array index into the root type, as in
+	// &ptr[idx], and is usually 0
+	size, err := s.typeSize(t.id)
+	if err != nil {
+		return nil, err
+	}
+	spec.accessors = []coreAccessor{{typeID: t.id, idx: raw[0]}}
+	spec.bitOffset = uint32(raw[0]) * size * 8
+
+	id := t.id
+	for _, idx := range raw[1:] {
+		t, err := s.skipModifiers(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case t.isComposite():
+			if idx >= len(t.members) {
+				return nil, fmt.Errorf("member index %d out of range for %q", idx, t.name)
+			}
+			m := t.members[idx]
+			spec.bitOffset += m.bitOffset
+			if m.name != "" {
+				spec.accessors = append(spec.accessors, coreAccessor{typeID: t.id, idx: idx, name: m.name})
+			}
+			id = m.typ
+		case t.kind == btfKindArray:
+			elem, err := s.skipModifiers(t.array.typ)
+			if err != nil {
+				return nil, err
+			}
+			size, err := s.typeSize(elem.id)
+			if err != nil {
+				return nil, err
+			}
+			spec.accessors = append(spec.accessors, coreAccessor{typeID: elem.id, idx: idx})
+			spec.bitOffset += uint32(idx) * size * 8
+			id = elem.id
+		default:
+			return nil, fmt.Errorf("can't access %s type %d with index %d", btfKindName(t.kind), t.id, idx)
+		}
+	}
+	return spec, nil
+}
+
+// coreKindsCompat reports whether types of the given kinds may be
+// relocated against each other.
+func coreKindsCompat(a, b uint8) bool {
+	if a == b {
+		return true
+	}
+	isEnum := func(k uint8) bool { return k == btfKindEnum || k == btfKindEnum64 }
+	return isEnum(a) && isEnum(b)
+}
+
+// coreCandidateIDs returns the IDs of the types that have the same kind
+// and essential name as the given local type.
+func (s *btfSpec) coreCandidateIDs(local *btfType) []uint32 {
+	if s.coreCandidates == nil {
+		s.coreCandidates = make(map[string][]uint32)
+		for _, t := range s.types {
+			if t == nil || t.name == "" {
+				continue
+			}
+			name := coreEssentialName(t.name)
+			s.coreCandidates[name] = append(s.coreCandidates[name], t.id)
+		}
+	}
+	var ids []uint32
+	for _, id := range s.coreCandidates[coreEssentialName(local.name)] {
+		if coreKindsCompat(local.kind, s.types[id].kind) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// coreTypesCompat reports whether two types are compatible in the sense
+// of bpf_core_types_are_compat(): names of structs, unions and enums are
+// not compared, and pointers, arrays and function prototypes are compared
+// recursively.
+func coreTypesCompat(local *btfSpec, localID uint32, targ *btfSpec, targID uint32) (bool, error) {
+	for depth := 0; depth < btfMaxModifiers; depth++ {
+		lt, err := local.skipModifiers(localID)
+		if err != nil {
+			return false, err
+		}
+		tt, err := targ.skipModifiers(targID)
+		if err != nil {
+			return false, err
+		}
+		if !coreKindsCompat(lt.kind, tt.kind) {
+			return false, nil
+		}
+		switch lt.kind {
+		case btfKindUnknown, btfKindStruct, btfKindUnion, btfKindEnum, btfKindEnum64,
+			btfKindFwd, btfKindFloat:
+			return true, nil
+		case btfKindInt:
+			// reject bitfield-like integers, the offset is bits 16-23
+			return (lt.encoding>>16)&0xff == 0 && (tt.encoding>>16)&0xff == 0, nil
+		case btfKindPtr:
+			localID, targID = lt.sizeType, tt.sizeType
+		case btfKindArray:
+			localID, targID = lt.array.typ, tt.array.typ
+		case btfKindFuncProto:
+			if len(lt.params) != len(tt.params) {
+				return false, nil
+			}
+			for i := range lt.params {
+				ok, err := coreTypesCompat(local, lt.params[i].typ, targ, tt.params[i].typ)
+				if err != nil || !ok {
+					return false, err
+				}
+			}
+			localID, targID = lt.sizeType, tt.sizeType
+		default:
+			return false, nil
+		}
+	}
+	return false, errors.New("type too deeply nested")
+}
+
+// coreFieldsCompat reports whether a member of the local type may be
+// relocated to the target member: their kinds must agree, and array
+// element types must be compatible.
+func coreFieldsCompat(local *btfSpec, localID uint32, targ *btfSpec, targID uint32) (bool, error) {
+	for depth := 0; depth < btfMaxModifiers; depth++ {
+		lt, err := local.skipModifiers(localID)
+		if err != nil {
+			return false, err
+		}
+		tt, err := targ.skipModifiers(targID)
+		if err != nil {
+			return false, err
+		}
+		if lt.isComposite() && tt.isComposite() {
+			return true, nil
+		}
+		if !coreKindsCompat(lt.kind, tt.kind) {
+			return false, nil
+		}
+		switch lt.kind {
+		case btfKindFwd, btfKindFloat, btfKindEnum, btfKindEnum64, btfKindInt, btfKindPtr:
+			return true, nil
+		case btfKindArray:
+			localID, targID = lt.array.typ, tt.array.typ
+		default:
+			return false, nil
+		}
+	}
+	return false, errors.New("type too deeply nested")
+}
+
+// coreMatchMember looks up the member with the given name in the target
+// struct or union, descending into anonymous members. It adds the accessor
+// and the member's bit offset to spec and returns the member's type ID.
+func coreMatchMember(local *btfSpec, localAcc coreAccessor, targ *btfSpec, targID uint32, spec *coreSpec) (uint32, bool, error) {
+	localParent, err := local.typeByID(localAcc.typeID)
+	if err != nil {
+		return 0, false, err
+	}
+	localMember := localParent.members[localAcc.idx]
+
+	t, err := targ.skipModifiers(targID)
+	if err != nil {
+		return 0, false, err
+	}
+	if !t.isComposite() {
+		return 0, false, nil
+	}
+	for i, m := range t.members {
+		if m.name == "" {
+			// look for the member in anonymous structs and unions
+			n := len(spec.accessors)
+			bitOffset := spec.bitOffset
+			spec.bitOffset += m.bitOffset
+			id, ok, err := coreMatchMember(local, localAcc, targ, m.typ, spec)
+			if err != nil || ok {
+				return id, ok, err
+			}
+			spec.accessors = spec.accessors[:n]
+			spec.bitOffset = bitOffset
+			continue
+		}
+		if m.name != localMember.name {
+			continue
+		}
+		if ok, err := coreFieldsCompat(local, localMember.typ, targ, m.typ); err != nil || !ok {
+			return 0, false, err
+		}
+		spec.bitOffset += m.bitOffset
+		spec.accessors = append(spec.accessors, coreAccessor{typeID: t.id, idx: i, name: m.name})
+		return m.typ, true, nil
+	}
+	return 0, false, nil
+}
+
+// coreMatchSpec resolves the local spec against a candidate type of the
+// target BTF. It returns nil if the candidate doesn't match.
+func coreMatchSpec(local *coreSpec, targ *btfSpec, candID uint32) (*coreSpec, error) {
+	spec := &coreSpec{btf: targ, rootID: candID, kind: local.kind}
+
+	switch {
+	case coreIsTypeKind(local.kind):
+		ok, err := coreTypesCompat(local.btf, local.rootID, targ, candID)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return spec, nil
+	case coreIsEnumvalKind(local.kind):
+		t, err := targ.skipModifiers(candID)
+		if err != nil {
+			return nil, err
+		}
+		name := coreEssentialName(local.accessors[0].name)
+		for i, e := range t.enums {
+			if coreEssentialName(e.name) == name {
+				spec.accessors = []coreAccessor{{typeID: t.id, idx: i, name: e.name}}
+				return spec, nil
+			}
+		}
+		return nil, nil
+	}
+
+	targID := candID
+	for i, acc := range local.accessors {
+		t, err := targ.skipModifiers(targID)
+		if err != nil {
+			return nil, err
+		}
+		if acc.name != "" {
+			id, ok, err := coreMatchMember(local.btf, acc, targ, t.id, spec)
+			if err != nil || !ok {
+				return nil, err
+			}
+			targID = id
+			continue
+		}
+		// the root type is indexed as an array of itself
+		if i > 0 {
+			if t.kind != btfKindArray {
+				return nil, nil
+			}
+			if t.array.nelems != 0 && uint32(acc.idx) >= t.array.nelems {
+				return nil, nil
+			}
+			t, err = targ.skipModifiers(t.array.typ)
+			if err != nil {
+				return nil, err
+			}
+		}
+		size, err := targ.typeSize(t.id)
+		if err != nil {
+			return nil, err
+		}
+		spec.accessors = append(spec.accessors, coreAccessor{typeID: t.id, idx: acc.idx})
+		spec.bitOffset += uint32(acc.idx) * size * 8
+		targID = t.id
+	}
+	return spec, nil
+}
+
+// coreValue is the value of a relocation computed from one spec. size is
+// the size of the accessed field when the instruction is a memory access
+// whose width may have to be adjusted.
+type coreValue struct {
+	val      uint64
+	size     uint32
+	validate bool
+}
+
+// coreFieldValue computes the value of a field relocation, following
+// bpf_core_calc_field_relo() in libbpf.
+func coreFieldValue(spec *coreSpec, bo binary.ByteOrder) (coreValue, error) {
+	if spec.kind == coreFieldExists {
+		return coreValue{val: 1}, nil
+	}
+	s := spec.btf
+	acc := spec.accessors[len(spec.accessors)-1]
+
+	if acc.name == "" {
+		// array element or root type
+		size, err := s.typeSize(acc.typeID)
+		if err != nil {
+			return coreValue{}, err
+		}
+		switch spec.kind {
+		case coreFieldByteOffset:
+			return coreValue{val: uint64(spec.bitOffset / 8), size: size, validate: true}, nil
+		case coreFieldByteSize:
+			return coreValue{val: uint64(size), validate: true}, nil
+		}
+		return coreValue{}, fmt.Errorf("%s relocation on an array element", coreKindName(spec.kind))
+	}
+
+	parent, err := s.typeByID(acc.typeID)
+	if err != nil {
+		return coreValue{}, err
+	}
+	m := parent.members[acc.idx]
+	mt, err := s.skipModifiers(m.typ)
+	if err != nil {
+		return coreValue{}, err
+	}
+	bitOffset := spec.bitOffset
+	bitSize := m.bitfieldSize
+	bitfield := bitSize > 0
+
+	var byteOffset, byteSize uint32
+	if bitfield {
+		byteSize, err = s.typeSize(mt.id)
+		if err != nil {
+			return coreValue{}, err
+		}
+		byteOffset = bitOffset / 8 / byteSize * byteSize
+		// find the smallest load that covers the whole bitfield
+		for bitOffset+bitSize-byteOffset*8 > byteSize*8 {
+			if byteSize >= 8 {
+				return coreValue{}, errors.New("bitfield too large")
+			}
+			byteSize *= 2
+			byteOffset = bitOffset / 8 / byteSize * byteSize
+		}
+	} else {
+		byteSize, err = s.typeSize(m.typ)
+		if err != nil {
+			return coreValue{}, err
+		}
+		byteOffset = bitOffset / 8
+		bitSize = byteSize * 8
+	}
+
+	v := coreValue{validate: !bitfield}
+	switch spec.kind {
+	case coreFieldByteOffset:
+		v.val = uint64(byteOffset)
+		if !bitfield {
+			v.size = byteSize
+		}
+	case coreFieldByteSize:
+		v.val = uint64(byteSize)
+	case coreFieldSigned:
+		signed := mt.encoding&(btfIntSigned<<24) != 0 ||
+			((mt.kind == btfKindEnum || mt.kind == btfKindEnum64) && mt.kindFlag)
+		if signed {
+			v.val = 1
+		}
+		v.validate = true
+	case coreFieldLShiftU64:
+		if bo == binary.LittleEndian {
+			v.val = uint64(64 - (bitOffset + bitSize - byteOffset*8))
+		} else {
+			v.val = uint64((8-byteSize)*8 + (bitOffset - byteOffset*8))
+		}
+	case coreFieldRShiftU64:
+		v.val = uint64(64 - bitSize)
+		v.validate = true
+	}
+	return v, nil
+}
+
+// coreSpecValue computes the value of a relocation from a resolved spec.
+// spec is nil when no target type matched: relocations checking for
+// existence then evaluate to 0, and the others fail with errCoreNoMatch.
+func coreSpecValue(kind uint32, spec *coreSpec, bo binary.ByteOrder) (coreValue, error) {
+	if spec == nil {
+		switch {
+		case coreIsTypeKind(kind), kind == coreFieldExists, kind == coreEnumvalExists:
+			return coreValue{}, nil
+		}
+		return coreValue{}, errCoreNoMatch
+	}
+
+	switch kind {
+	case coreTypeIDLocal, coreTypeIDTarget:
+		return coreValue{val: uint64(spec.rootID)}, nil
+	case coreTypeExists, coreTypeMatches, coreEnumvalExists:
+		return coreValue{val: 1}, nil
+	case coreTypeSize:
+		size, err := spec.btf.typeSize(spec.rootID)
+		return coreValue{val: uint64(size)}, err
+	case coreEnumvalValue:
+		acc := spec.accessors[0]
+		t, err := spec.btf.typeByID(acc.typeID)
+		if err != nil {
+			return coreValue{}, err
+		}
+		return coreValue{val: uint64(t.enums[acc.idx].value)}, nil
+	}
+	return coreFieldValue(spec, bo)
+}
+
+var errCoreNoMatch = errors.New("no matching target type")
+
+// coreRelocate resolves a relocation against the target BTF and patches
+// the instruction it refers to.
+func coreRelocate(local, targ *btfSpec, relo btfCoreRelo, insns []byte, bo binary.ByteOrder) error {
+	localSpec, err := local.coreLocalSpec(relo)
+	if err != nil {
+		return err
+	}
+	orig, err := coreSpecValue(relo.kind, localSpec, bo)
+	if err != nil {
+		return err
+	}
+
+	var targSpec *coreSpec
+	if relo.kind == coreTypeIDLocal {
+		targSpec = localSpec
+	} else {
+		root, err := local.skipModifiers(relo.typeID)
+		if err != nil {
+			return err
+		}
+		if root.name == "" {
+			return fmt.Errorf("%s relocation against anonymous %s", coreKindName(relo.kind), btfKindName(root.kind))
+		}
+		var matched coreValue
+		for _, candID := range targ.coreCandidateIDs(root) {
+			spec, err := coreMatchSpec(localSpec, targ, candID)
+			if err != nil {
+				return err
+			}
+			if spec == nil {
+				continue
+			}
+			v, err := coreSpecValue(relo.kind, spec, bo)
+			if err != nil {
+				return err
+			}
+			if targSpec != nil && v.val != matched.val {
+				return fmt.Errorf("ambiguous candidates for %q: %d != %d", root.name, matched.val, v.val)
+			}
+			targSpec, matched = spec, v
+		}
+	}
+
+	res, err := coreSpecValue(relo.kind, targSpec, bo)
+	if err == errCoreNoMatch {
+		return corePoisonInsn(insns, int(relo.insnOff), bo)
+	}
+	if err != nil {
+		return err
+	}
+	return corePatchInsn(insns, int(relo.insnOff), orig, res, bo)
+}
+
+// corePoisonInsn replaces the instruction with a call to an invalid
+// helper, so that the program only fails to load if the instruction is
+// reachable.
+func corePoisonInsn(insns []byte, idx int, bo binary.ByteOrder) error {
+	off := idx * bpfInsnLen
+	if off+bpfInsnLen > len(insns) {
+		return fmt.Errorf("instruction %d out of range", idx)
+	}
+	n := 1
+	if insns[off] == bpfClassLD|bpfSizeDW|bpfModeIMM && off+bpfInsnLen*2 <= len(insns) {
+		// poison both halves of a 64-bit load
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		insn := insns[off+i*bpfInsnLen:]
+		insn[0] = bpfClassJMP | bpfOpCall
+		insn[1] = 0
+		bo.PutUint16(insn[2:], 0)
+		bo.PutUint32(insn[4:], corePoisonImm)
+	}
+	return nil
+}
+
+// corePatchInsn writes the relocated value into the immediate or offset of
+// the instruction, as bpf_core_patch_insn() in libbpf does.
+func corePatchInsn(insns []byte, idx int, orig, res coreValue, bo binary.ByteOrder) error {
+	off := idx * bpfInsnLen
+	if off+bpfInsnLen > len(insns) {
+		return fmt.Errorf("instruction %d out of range", idx)
+	}
+	insn := insns[off : off+bpfInsnLen]
+	code := insn[0]
+
+	switch code & 0x07 {
+	case bpfClassALU, bpfClassALU64:
+		if code&bpfSrcX != 0 {
+			return fmt.Errorf("instruction %d: unexpected ALU instruction with register source", idx)
+		}
+		imm := int32(bo.Uint32(insn[4:]))
+		if orig.validate && int64(imm) != int64(orig.val) {
+			return fmt.Errorf("instruction %d: unexpected immediate %d, expected %d", idx, imm, orig.val)
+		}
+		if res.val > math.MaxUint32 {
+			return fmt.Errorf("instruction %d: value %d doesn't fit the immediate", idx, res.val)
+		}
+		bo.PutUint32(insn[4:], uint32(res.val))
+	case bpfClassLDX, bpfClassST, bpfClassSTX:
+		insnOff := int16(bo.Uint16(insn[2:]))
+		if orig.validate && int64(insnOff) != int64(orig.val) {
+			return fmt.Errorf("instruction %d: unexpected offset %d, expected %d", idx, insnOff, orig.val)
+		}
+		if res.val > math.MaxInt16 {
+			return fmt.Errorf("instruction %d: offset %d too large", idx, res.val)
+		}
+		bo.PutUint16(insn[2:], uint16(res.val))
+		if orig.size != res.size {
+			if coreInsnSize(code) != orig.size {
+				return fmt.Errorf("instruction %d: unexpected memory access size", idx)
+			}
+			size, ok := coreSizeCode(res.size)
+			if !ok {
+				return fmt.Errorf("instruction %d: invalid memory access size %d", idx, res.size)
+			}
+			insn[0] = code&^bpfSizeDW | size
+		}
+	case bpfClassLD:
+		if code != bpfClassLD|bpfSizeDW|bpfModeIMM || off+bpfInsnLen*2 > len(insns) {
+			return fmt.Errorf("instruction %d: unexpected load instruction %#x", idx, code)
+		}
+		next := insns[off+bpfInsnLen : off+bpfInsnLen*2]
+		imm := uint64(bo.Uint32(next[4:]))<<32 | uint64(bo.Uint32(insn[4:]))
+		if orig.validate && imm != orig.val {
+			return fmt.Errorf("instruction %d: unexpected immediate %d, expected %d", idx, imm, orig.val)
+		}
+		bo.PutUint32(insn[4:], uint32(res.val))
+		bo.PutUint32(next[4:], uint32(res.val>>32))
+	default:
+		return fmt.Errorf("instruction %d: unexpected instruction %#x", idx, code)
+	}
+	return nil
+}
+
+func coreInsnSize(code uint8) uint32 {
+	switch code & bpfSizeDW {
+	case bpfSizeB:
+		return 1
+	case bpfSizeH:
+		return 2
+	case bpfSizeW:
+		return 4
+	}
+	return 8
+}
+
+func coreSizeCode(size uint32) (uint8, bool) {
+	switch size {
+	case 1:
+		return bpfSizeB, true
+	case 2:
+		return bpfSizeH, true
+	case 4:
+		return bpfSizeW, true
+	case 8:
+		return bpfSizeDW, true
+	}
+	return 0, false
+}
+
+// loadKernelBTF reads the BTF to relocate programs against: either raw BTF,
+// as found in /sys/kernel/btf/vmlinux, or an ELF file with a .BTF section,
+// such as a vmlinux image.
+func loadKernelBTF(path string) (*btfSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		file, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		sec := file.Section(".BTF")
+		if sec == nil {
+			return nil, fmt.Errorf("%s has no .BTF section", path)
+		}
+		data, err = sec.Data()
+		if err != nil {
+			return nil, err
+		}
+		return parseBTF(data, file.ByteOrder)
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	if len(data) >= 2 && binary.BigEndian.Uint16(data) == btfMagic {
+		bo = binary.BigEndian
+	}
+	return parseBTF(data, bo)
+}
@@ -0,0 +1,183 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func testInsn(code uint8, off int16, imm int32) []byte {
+	insn := make([]byte, bpfInsnLen)
+	insn[0] = code
+	binary.LittleEndian.PutUint16(insn[2:], uint16(off))
+	binary.LittleEndian.PutUint32(insn[4:], uint32(imm))
+	return insn
+}
+
+func TestCoreRelocate(t *testing.T) {
+	lb := newBTFBuilder()
+	lInt := lb.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	lFoo := lb.add("foo___v1", btfKindStruct, 3, false, 12,
+		lb.str("a"), lInt, 0,
+		lb.str("b"), lInt, 32,
+		lb.str("c"), lInt, 64)
+	lEnum := lb.add("e", btfKindEnum, 2, false, 4,
+		lb.str("X"), 0,
+		lb.str("Y"), 1)
+	lBaz := lb.add("baz", btfKindStruct, 0, false, 0)
+	local, err := parseBTF(lb.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tb := newBTFBuilder()
+	tInt := tb.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	tLong := tb.add("long", btfKindInt, 0, false, 8, btfIntSigned<<24|64)
+	// b is nested in an anonymous struct
+	anon := tb.add("", btfKindStruct, 1, false, 4,
+		tb.str("b"), tInt, 0)
+	tb.add("foo", btfKindStruct, 3, false, 16,
+		tb.str("x"), tLong, 0,
+		tb.str(""), anon, 64,
+		tb.str("a"), tInt, 96)
+	tb.add("e", btfKindEnum, 2, false, 4,
+		tb.str("Y"), 5,
+		tb.str("X"), 7)
+	targ, err := parseBTF(tb.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		ldxW     = bpfClassLDX | bpfSizeW | 0x60
+		movImm   = bpfClassALU64 | 0xb0
+		ldImm64  = bpfClassLD | bpfSizeDW | bpfModeIMM
+		callCode = bpfClassJMP | bpfOpCall
+	)
+	insns := bytes.Join([][]byte{
+		testInsn(ldxW, 4, 0),      // 0: foo.b
+		testInsn(ldxW, 0, 0),      // 1: foo.a
+		testInsn(movImm, 0, 1),    // 2: exists(foo.c)
+		testInsn(ldxW, 8, 0),      // 3: foo.c
+		testInsn(ldImm64, 0, 1),   // 4: e.Y
+		testInsn(0, 0, 0),         // 5
+		testInsn(movImm, 0, 12),   // 6: sizeof(foo)
+		testInsn(movImm, 0, 1),    // 7: exists(baz)
+		testInsn(movImm, 0, 1234), // 8: local type ID of foo
+	}, nil)
+
+	relos := []btfCoreRelo{
+		{insnOff: 0, typeID: lFoo, accessor: "0:1", kind: coreFieldByteOffset},
+		{insnOff: 1, typeID: lFoo, accessor: "0:0", kind: coreFieldByteOffset},
+		{insnOff: 2, typeID: lFoo, accessor: "0:2", kind: coreFieldExists},
+		{insnOff: 3, typeID: lFoo, accessor: "0:2", kind: coreFieldByteOffset},
+		{insnOff: 4, typeID: lEnum, accessor: "1", kind: coreEnumvalValue},
+		{insnOff: 6, typeID: lFoo, accessor: "0", kind: coreTypeSize},
+		{insnOff: 7, typeID: lBaz, accessor: "0", kind: coreTypeExists},
+		{insnOff: 8, typeID: lFoo, accessor: "0", kind: coreTypeIDLocal},
+	}
+	for _, relo := range relos {
+		if err := coreRelocate(local, targ, relo, insns, binary.LittleEndian); err != nil {
+			t.Fatalf("relocation at %d: %v", relo.insnOff, err)
+		}
+	}
+
+	insn := func(i int) (uint8, int16, int32) {
+		b := insns[i*bpfInsnLen:]
+		return b[0], int16(binary.LittleEndian.Uint16(b[2:])), int32(binary.LittleEndian.Uint32(b[4:]))
+	}
+	for _, tc := range []struct {
+		idx  int
+		code uint8
+		off  int16
+		imm  int32
+	}{
+		{0, ldxW, 8, 0},
+		{1, ldxW, 12, 0},
+		{2, movImm, 0, 0},
+		{3, callCode, 0, corePoisonImm},
+		{4, ldImm64, 0, 5},
+		{6, movImm, 0, 16},
+		{7, movImm, 0, 0},
+		{8, movImm, 0, int32(lFoo)},
+	} {
+		code, off, imm := insn(tc.idx)
+		if code != tc.code || off != tc.off || imm != tc.imm {
+			t.Errorf("instruction %d: got code=%#x off=%d imm=%d, want code=%#x off=%d imm=%d",
+				tc.idx, code, off, imm, tc.code, tc.off, tc.imm)
+		}
+	}
+
+	// the instruction doesn't match the local type information
+	bad := testInsn(ldxW, 2, 0)
+	err = coreRelocate(local, targ, btfCoreRelo{typeID: lFoo, accessor: "0:1", kind: coreFieldByteOffset}, bad, binary.LittleEndian)
+	if err == nil {
+		t.Error("expected error for unexpected instruction offset")
+	}
+}
+
+func TestCoreFieldBitfield(t *testing.T) {
+	b := newBTFBuilder()
+	uint32ID := b.add("unsigned int", btfKindInt, 0, false, 4, 32)
+	flags := b.add("flags", btfKindStruct, 2, true, 8,
+		b.str("pad"), uint32ID, 0,
+		b.str("f"), uint32ID, 5<<24|36)
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, want := range map[uint32]uint64{
+		coreFieldByteOffset: 4,
+		coreFieldByteSize:   4,
+		coreFieldSigned:     0,
+		coreFieldLShiftU64:  64 - (36 + 5 - 32),
+		coreFieldRShiftU64:  64 - 5,
+	} {
+		s, err := spec.coreLocalSpec(btfCoreRelo{typeID: flags, accessor: "0:1", kind: kind})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := coreSpecValue(kind, s, binary.LittleEndian)
+		if err != nil || v.val != want {
+			t.Errorf("%s = %d, %v; want %d", coreKindName(kind), v.val, err, want)
+		}
+	}
+}
+
+func TestParseBTFExtCoreRelo(t *testing.T) {
+	b := newBTFBuilder()
+	secName := b.str("kprobe/foo")
+	accessor := b.str("0:1")
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var relos bytes.Buffer
+	for _, v := range []uint32{btfCoreReloLen, secName, 1, 24, 7, accessor, coreFieldByteOffset} {
+		binary.Write(&relos, binary.LittleEndian, v)
+	}
+	var ext bytes.Buffer
+	for _, v := range []interface{}{
+		uint16(btfMagic), uint8(1), uint8(0), uint32(btfExtHeaderLen + 8),
+		uint32(0), uint32(0),
+		uint32(0), uint32(0),
+		uint32(0), uint32(relos.Len()),
+	} {
+		binary.Write(&ext, binary.LittleEndian, v)
+	}
+	ext.Write(relos.Bytes())
+
+	info, err := parseBTFExt(ext.Bytes(), binary.LittleEndian, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := btfCoreRelo{insnOff: 3, typeID: 7, accessor: "0:1", kind: coreFieldByteOffset}
+	if r := info.coreRelos["kprobe/foo"]; len(r) != 1 || r[0] != want {
+		t.Errorf("unexpected core relocations: %+v", r)
+	}
+}
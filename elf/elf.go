@@ -79,8 +79,27 @@ static void bpf_apply_relocation(int fd, struct bpf_insn *insn)
 	insn->imm = fd;
 }
 
+static void bpf_apply_value_relocation(int fd, struct bpf_insn *insn, __u32 off)
+{
+	// ld_imm64 spans two instructions, the second one holds the offset
+	// within the map value
+	insn[0].src_reg = BPF_PSEUDO_MAP_VALUE;
+	insn[0].imm = fd;
+	insn[1].imm = off;
+}
+
+// bpf_map_create_opts holds the optional attributes of a new map. btf_fd
+// and inner_map_fd are ignored when negative.
+typedef struct bpf_map_create_opts {
+	int   btf_fd;
+	__u32 btf_key_type_id;
+	__u32 btf_value_type_id;
+	int   inner_map_fd;
+} bpf_map_create_opts;
+
 static int bpf_create_map(enum bpf_map_type map_type, int key_size,
-	int value_size, int max_entries, int map_flags)
+	int value_size, int max_entries, int map_flags,
+	const bpf_map_create_opts *opts)
 {
 	int ret;
 	union bpf_attr attr;
@@ -91,6 +110,13 @@ static int bpf_create_map(enum bpf_map_type map_type, int key_size,
 	attr.value_size = value_size;
 	attr.max_entries = max_entries;
 	attr.map_flags = map_flags;
+	if (opts->btf_fd >= 0) {
+		attr.btf_fd = opts->btf_fd;
+		attr.btf_key_type_id = opts->btf_key_type_id;
+		attr.btf_value_type_id = opts->btf_value_type_id;
+	}
+	if (opts->inner_map_fd >= 0)
+		attr.inner_map_fd = opts->inner_map_fd;
 
 	ret = syscall(__NR_bpf, BPF_MAP_CREATE, &attr, sizeof(attr));
 	if (ret < 0 && errno == EPERM) {
@@ -134,7 +160,8 @@ int get_pinned_obj_fd(const char *path)
 	return syscall(__NR_bpf, BPF_OBJ_GET, &attr, sizeof(attr));
 }
 
-static bpf_map *bpf_load_map(bpf_map_def *map_def, const char *path)
+static bpf_map *bpf_load_map(bpf_map_def *map_def, const char *path,
+	const bpf_map_create_opts *opts)
 {
 	bpf_map *map;
 	struct stat st;
@@ -148,9 +175,6 @@ static bpf_map *bpf_load_map(bpf_map_def *map_def, const char *path)
 
 	switch (map_def->pinning) {
 	case 1: // PIN_OBJECT_NS
-		// TODO to be implemented
-		free(map);
-		return 0;
 	case 2: // PIN_GLOBAL_NS
 	case 3: // PIN_CUSTOM_NS
 		if (stat(path, &st) == 0) {
@@ -169,8 +193,22 @@ static bpf_map *bpf_load_map(bpf_map_def *map_def, const char *path)
 		map_def->key_size,
 		map_def->value_size,
 		map_def->max_entries,
-		map_def->map_flags
+		map_def->map_flags,
+		opts
 	);
+	if (map->fd < 0 && opts->btf_fd >= 0) {
+		// The kernel may not support BTF for this map type, try again
+		// without type information.
+		bpf_map_create_opts no_btf = *opts;
+		no_btf.btf_fd = -1;
+		map->fd = bpf_create_map(map_def->type,
+			map_def->key_size,
+			map_def->value_size,
+			map_def->max_entries,
+			map_def->map_flags,
+			&no_btf
+		);
+	}
 
 	if (map->fd < 0) {
 		free(map);
@@ -188,10 +226,19 @@ static bpf_map *bpf_load_map(bpf_map_def *map_def, const char *path)
 	return map;
 }
 
+typedef struct bpf_prog_load_attach {
+	int expected_attach_type;
+	__u32 attach_btf_id;
+	int attach_btf_obj_fd;
+} bpf_prog_load_attach;
+
 static int bpf_prog_load(enum bpf_prog_type prog_type,
 	const struct bpf_insn *insns, int prog_len,
 	const char *license, int kern_version,
-	char *log_buf, int log_size)
+	char *log_buf, int log_size,
+	int prog_btf_fd, const void *func_info, int func_info_cnt,
+	const void *line_info, int line_info_cnt,
+	const bpf_prog_load_attach *attach)
 {
 	int ret;
 	union bpf_attr attr;
@@ -205,6 +252,19 @@ static int bpf_prog_load(enum bpf_prog_type prog_type,
 	attr.log_size = log_size;
 	attr.log_level = 1;
 	attr.kern_version = kern_version;
+	if (prog_btf_fd >= 0) {
+		attr.prog_btf_fd = prog_btf_fd;
+		attr.func_info_rec_size = sizeof(struct bpf_func_info);
+		attr.func_info = ptr_to_u64((void *) func_info);
+		attr.func_info_cnt = func_info_cnt;
+		attr.line_info_rec_size = sizeof(struct bpf_line_info);
+		attr.line_info = ptr_to_u64((void *) line_info);
+		attr.line_info_cnt = line_info_cnt;
+	}
+	attr.expected_attach_type = attach->expected_attach_type;
+	attr.attach_btf_id = attach->attach_btf_id;
+	if (attach->attach_btf_obj_fd >= 0)
+		attr.attach_btf_obj_fd = attach->attach_btf_obj_fd;
 
 	ret = syscall(__NR_bpf, BPF_PROG_LOAD, &attr, sizeof(attr));
 	if (ret < 0 && errno == EPERM) {
@@ -246,6 +306,15 @@ static int bpf_update_element(int fd, void *key, void *value, unsigned long long
 	return syscall(__NR_bpf, BPF_MAP_UPDATE_ELEM, &attr, sizeof(attr));
 }
 
+static int bpf_map_freeze(int fd)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.map_fd = fd;
+
+	return syscall(__NR_bpf, BPF_MAP_FREEZE, &attr, sizeof(attr));
+}
 
 static int perf_event_open_map(int pid, int cpu, int group_fd, unsigned long flags, int backward)
 {
@@ -328,11 +397,40 @@ func getMapNamespace(mapDef *C.bpf_map_def) string {
 	return C.GoStringN(namespacePtr, C.int(C.strnlen(namespacePtr, C.BUF_SIZE_MAP_NS)))
 }
 
-func getMapPath(mapDef *C.bpf_map_def, mapName, pinPath string) (string, error) {
+// validObjectID reports whether id can be used as the directory of an
+// object's PIN_OBJECT_NS maps.
+func validObjectID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsRune(id, '/')
+}
+
+// defaultObjectID derives the object ID from the ELF file name, without
+// directory and extension.
+func defaultObjectID(fileName string) string {
+	base := filepath.Base(fileName)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// pinObjectID returns the ID under which PIN_OBJECT_NS maps of the module are
+// pinned, see SetObjectID.
+func (b *Module) pinObjectID() (string, error) {
+	id := b.objectID
+	if id == "" && b.fileName != "" {
+		id = defaultObjectID(b.fileName)
+	}
+	if !validObjectID(id) {
+		return "", fmt.Errorf("invalid object ID %q for PIN_OBJECT_NS, see SetObjectID", id)
+	}
+	return id, nil
+}
+
+func getMapPath(mapDef *C.bpf_map_def, mapName, pinPath, objectID string) (string, error) {
 	var mapPath string
 	switch mapDef.pinning {
 	case PIN_OBJECT_NS:
-		return "", fmt.Errorf("not implemented yet")
+		if !validObjectID(objectID) {
+			return "", fmt.Errorf("no object ID for map %q with PIN_OBJECT_NS", mapName)
+		}
+		mapPath = filepath.Join(BPFFSPath, objectID, mapName)
 	case PIN_GLOBAL_NS:
 		namespace := getMapNamespace(mapDef)
 		if namespace == "" {
@@ -351,24 +449,55 @@ func getMapPath(mapDef *C.bpf_map_def, mapName, pinPath string) (string, error)
 	return mapPath, nil
 }
 
-func createMapPath(mapDef *C.bpf_map_def, mapName string, params SectionParams) (string, error) {
-	mapPath, err := getMapPath(mapDef, mapName, params.PinPath)
+func (b *Module) createMapPath(mapDef *C.bpf_map_def, mapName string, params SectionParams) (string, error) {
+	var objectID string
+	if mapDef.pinning == PIN_OBJECT_NS {
+		var err error
+		if objectID, err = b.pinObjectID(); err != nil {
+			return "", err
+		}
+	}
+	mapPath, err := getMapPath(mapDef, mapName, params.PinPath, objectID)
 	if err != nil || mapPath == "" {
 		return "", err
 	}
 	if !validateMapPath(mapPath) {
 		return "", fmt.Errorf("invalid path %q", mapPath)
 	}
-	return createPinPath(mapPath)
+	if mapPath, err = createPinPath(mapPath); err != nil {
+		return "", err
+	}
+	def := pinnedMapInfo{
+		mapType:    uint32(mapDef._type),
+		keySize:    uint32(mapDef.key_size),
+		valueSize:  uint32(mapDef.value_size),
+		maxEntries: uint32(mapDef.max_entries),
+		flags:      uint32(mapDef.map_flags),
+	}
+	if err := checkPinnedMap(mapPath, def, params.ReplacePinnedMap); err != nil {
+		return "", err
+	}
+	return mapPath, nil
 }
 
-func elfReadMaps(file *elf.File, params map[string]SectionParams) (map[string]*Map, error) {
+func (b *Module) elfReadMaps(params map[string]SectionParams) (map[string]*Map, error) {
 	maps := make(map[string]*Map)
-	for _, section := range file.Sections {
+
+	// map-in-maps are created after the maps their inner map definition
+	// is taken from
+	var sections, outerSections []*elf.Section
+	for _, section := range b.file.Sections {
 		if !strings.HasPrefix(section.Name, "maps/") {
 			continue
 		}
+		if params[section.Name].InnerMap != "" {
+			outerSections = append(outerSections, section)
+		} else {
+			sections = append(sections, section)
+		}
+	}
 
+	for _, section := range append(sections, outerSections...) {
 		name := strings.TrimPrefix(section.Name, "maps/")
 		if oldMap, ok := maps[name]; ok {
 			return nil, fmt.Errorf("duplicate map: %q and %q", oldMap.Name, name)
@@ -391,35 +520,173 @@ func elfReadMaps(file *elf.File, params map[string]SectionParams) (map[string]*M
 			}
 		}
 
-		mapPath, err := createMapPath(mapDef, name, params[section.Name])
+		mapPath, err := b.createMapPath(mapDef, name, params[section.Name])
 		if err != nil {
 			return nil, err
 		}
 		mapPathC := C.CString(mapPath)
 		defer C.free(unsafe.Pointer(mapPathC))
 
-		cm, err := C.bpf_load_map(mapDef, mapPathC)
+		opts := b.mapCreateOpts(0, 0)
+		if b.btf != nil {
+			if keyTypeID, valueTypeID, ok := b.btf.mapKeyValueTypes(name); ok {
+				opts = b.mapCreateOpts(keyTypeID, valueTypeID)
+			}
+		}
+
+		var innerDef *C.bpf_map_def
+		if innerName := params[section.Name].InnerMap; innerName != "" {
+			// the inner map serves as template for the kernel to check
+			// the maps stored in the outer map against
+			inner, ok := maps[innerName]
+			if !ok {
+				return nil, fmt.Errorf("map %q: no inner map %q", section.Name, innerName)
+			}
+			if inner.inner != nil {
+				return nil, fmt.Errorf("map %q: nested map-in-maps are not supported", section.Name)
+			}
+			// the maps stored in the outer map aren't pinned like the
+			// template may be
+			innerDef = new(C.bpf_map_def)
+			*innerDef = inner.m.def
+			innerDef.pinning = PIN_NONE
+			opts.inner_map_fd = inner.m.fd
+		}
+
+		cm, err := C.bpf_load_map(mapDef, mapPathC, &opts)
 		if cm == nil {
 			return nil, fmt.Errorf("error while loading map %q: %v", section.Name, err)
 		}
 
 		maps[name] = &Map{
-			Name: name,
-			m:    cm,
+			Name:    name,
+			m:       cm,
+			pinPath: params[section.Name].PinPath,
+			inner:   innerDef,
 		}
 
 	}
+
+	if err := b.elfReadBTFMaps(maps, params); err != nil {
+		return nil, err
+	}
+	if err := b.elfReadDataMaps(maps, params); err != nil {
+		return nil, err
+	}
 	return maps, nil
 }
 
-func (b *Module) relocate(data []byte, rdata []byte) error {
+// mapCreateOpts returns the options to create a map with the given BTF key
+// and value types. The types are only passed along when the object's BTF
+// was loaded into the kernel.
+func (b *Module) mapCreateOpts(keyTypeID, valueTypeID uint32) C.bpf_map_create_opts {
+	opts := C.bpf_map_create_opts{
+		btf_fd:       -1,
+		inner_map_fd: -1,
+	}
+	if b.btfFd >= 0 && valueTypeID != 0 {
+		opts.btf_fd = C.int(b.btfFd)
+		opts.btf_key_type_id = C.__u32(keyTypeID)
+		opts.btf_value_type_id = C.__u32(valueTypeID)
+	}
+	return opts
+}
+
+// elfReadBTFMaps creates the maps defined in the .maps section. Like maps in
+// "maps/" sections, their parameters are looked up as "maps/<name>". Maps
+// with LIBBPF_PIN_BY_NAME pinning are pinned at BPFFSPath/<name>, or at
+// the PinPath given in their parameters.
+func (b *Module) elfReadBTFMaps(maps map[string]*Map, params map[string]SectionParams) error {
+	if b.file.Section(".maps") == nil {
+		return nil
+	}
+	if b.btf == nil {
+		return errors.New("section .maps requires BTF, but the object has no .BTF section")
+	}
+	specs, err := b.btf.mapSpecs(".maps")
+	if err != nil {
+		return fmt.Errorf("error reading BTF map definitions: %v", err)
+	}
+
+	for _, spec := range specs {
+		if oldMap, ok := maps[spec.name]; ok {
+			return fmt.Errorf("duplicate map: %q and %q", oldMap.Name, spec.name)
+		}
+		sectionName := "maps/" + spec.name
+		p := params[sectionName]
+
+		var mapDef C.bpf_map_def
+		mapDef._type = C.uint(spec.mapType)
+		mapDef.key_size = C.uint(spec.keySize)
+		mapDef.value_size = C.uint(spec.valueSize)
+		mapDef.max_entries = C.uint(spec.maxEntries)
+		mapDef.map_flags = C.uint(spec.mapFlags)
+		if p.MapMaxEntries != 0 {
+			mapDef.max_entries = C.uint(p.MapMaxEntries)
+		}
+		if spec.pinning == btfPinByName {
+			mapDef.pinning = PIN_CUSTOM_NS
+			if p.PinPath == "" {
+				p.PinPath = spec.name
+			}
+		}
+
+		mapPath, err := b.createMapPath(&mapDef, spec.name, p)
+		if err != nil {
+			return err
+		}
+		mapPathC := C.CString(mapPath)
+		defer C.free(unsafe.Pointer(mapPathC))
+
+		opts := b.mapCreateOpts(spec.keyTypeID, spec.valueTypeID)
+		var innerDef *C.bpf_map_def
+		if spec.inner != nil {
+			// the inner map is only a template for the kernel to check
+			// the maps stored in the outer map against
+			inner := spec.inner
+			innerOpts := b.mapCreateOpts(inner.keyTypeID, inner.valueTypeID)
+			innerFd, err := C.bpf_create_map(uint32(inner.mapType), C.int(inner.keySize), C.int(inner.valueSize),
+				C.int(inner.maxEntries), C.int(inner.mapFlags), &innerOpts)
+			if innerFd < 0 {
+				return fmt.Errorf("error creating inner map of %q: %v", sectionName, err)
+			}
+			opts.inner_map_fd = innerFd
+			innerDef = &C.bpf_map_def{
+				_type:       C.uint(inner.mapType),
+				key_size:    C.uint(inner.keySize),
+				value_size:  C.uint(inner.valueSize),
+				max_entries: C.uint(inner.maxEntries),
+				map_flags:   C.uint(inner.mapFlags),
+			}
+		}
+
+		cm, err := C.bpf_load_map(&mapDef, mapPathC, &opts)
+		if opts.inner_map_fd >= 0 {
+			syscall.Close(int(opts.inner_map_fd))
+		}
+		if cm == nil {
+			return fmt.Errorf("error while loading map %q: %v", sectionName, err)
+		}
+
+		maps[spec.name] = &Map{
+			Name:    spec.name,
+			m:       cm,
+			pinPath: p.PinPath,
+			inner:   innerDef,
+		}
+	}
+	return nil
+}
+
+func (b *Module) relocate(data []byte, rdata []byte) (map[int]elfCallTarget, error) {
 	var symbol elf.Symbol
 	var offset uint64
 
 	symbols, err := b.file.Symbols()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	calls := make(map[int]elfCallTarget)
 
 	br := bytes.NewReader(data)
 
@@ -430,9 +697,9 @@ func (b *Module) relocate(data []byte, rdata []byte) error {
 			err := binary.Read(br, b.file.ByteOrder, &rel)
 			if err != nil {
 				if err == io.EOF {
-					return nil
+					return calls, nil
 				}
-				return err
+				return nil, err
 			}
 
 			symNo := rel.Info >> 32
@@ -444,9 +711,9 @@ func (b *Module) relocate(data []byte, rdata []byte) error {
 			err := binary.Read(br, b.file.ByteOrder, &rel)
 			if err != nil {
 				if err == io.EOF {
-					return nil
+					return calls, nil
 				}
-				return err
+				return nil, err
 			}
 
 			symNo := rel.Info >> 8
@@ -454,29 +721,72 @@ func (b *Module) relocate(data []byte, rdata []byte) error {
 
 			offset = uint64(rel.Off)
 		default:
-			return errors.New("architecture not supported")
+			return nil, errors.New("architecture not supported")
 		}
 
+		if offset+C.sizeof_struct_bpf_insn > uint64(len(rdata)) {
+			return nil, fmt.Errorf("relocation offset %d out of bounds", offset)
+		}
 		rinsn := (*C.struct_bpf_insn)(unsafe.Pointer(&rdata[offset]))
-		if rinsn.code != (C.BPF_LD | C.BPF_IMM | C.BPF_DW) {
-			symbolSec := b.file.Sections[symbol.Section]
+		insnIdx := int(offset / C.sizeof_struct_bpf_insn)
+		symbolSec := b.file.Sections[symbol.Section]
+		isFuncSym := symbolSec.Flags&elf.SHF_EXECINSTR != 0
+
+		if rinsn.code == (C.BPF_JMP|C.BPF_CALL) && isFuncSym {
+			// BPF-to-BPF call, resolved when the program is linked
+			target := int64(symbol.Value)/C.sizeof_struct_bpf_insn + int64(rinsn.imm) + 1
+			calls[insnIdx] = elfCallTarget{symbol.Section, int(target)}
+			continue
+		}
 
-			return fmt.Errorf("invalid relocation: insn code=%#x, symbol name=%s\nsymbol section: Name=%s, Type=%s, Flags=%s",
+		if rinsn.code != (C.BPF_LD | C.BPF_IMM | C.BPF_DW) {
+			return nil, fmt.Errorf("invalid relocation: insn code=%#x, symbol name=%s\nsymbol section: Name=%s, Type=%s, Flags=%s",
 				*(*C.uchar)(unsafe.Pointer(&rinsn.code)), symbol.Name,
 				symbolSec.Name, symbolSec.Type.String(), symbolSec.Flags.String(),
 			)
 		}
 
-		symbolSec := b.file.Sections[symbol.Section]
-		if !strings.HasPrefix(symbolSec.Name, "maps/") {
-			return fmt.Errorf("map location not supported: map %q is in section %q instead of \"maps/%s\"",
+		if isFuncSym {
+			// reference to a function, e.g. a bpf_loop() callback
+			target := (int64(symbol.Value) + int64(rinsn.imm)) / C.sizeof_struct_bpf_insn
+			calls[insnIdx] = elfCallTarget{symbol.Section, int(target)}
+			setInsnSrcReg(rdata[offset:], bpfPseudoFunc, b.file.ByteOrder)
+			continue
+		}
+
+		if isDataSection(symbolSec) {
+			m := b.Map(symbolSec.Name)
+			if m == nil || offset+2*C.sizeof_struct_bpf_insn > uint64(len(rdata)) {
+				return nil, fmt.Errorf("relocation error, symbol %q not found in section %q",
+					symbol.Name, symbolSec.Name)
+			}
+			// relocations of static variables are against the section,
+			// with the variable's offset in the immediate
+			off := uint32(rinsn.imm)
+			if elf.ST_TYPE(symbol.Info) != elf.STT_SECTION {
+				off += uint32(symbol.Value)
+			}
+			C.bpf_apply_value_relocation(m.m.fd, rinsn, C.__u32(off))
+			continue
+		}
+
+		var name string
+		switch {
+		case strings.HasPrefix(symbolSec.Name, "maps/"):
+			name = strings.TrimPrefix(symbolSec.Name, "maps/")
+		case symbolSec.Name == ".maps":
+			name, err = btfMapSymbol(symbols, symbol, int32(rinsn.imm))
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("map location not supported: map %q is in section %q instead of \"maps/%s\" or \".maps\"",
 				symbol.Name, symbolSec.Name, symbol.Name)
 		}
-		name := strings.TrimPrefix(symbolSec.Name, "maps/")
 
 		m := b.Map(name)
 		if m == nil {
-			return fmt.Errorf("relocation error, symbol %q not found in section %q",
+			return nil, fmt.Errorf("relocation error, symbol %q not found in section %q",
 				symbol.Name, symbolSec.Name)
 		}
 
@@ -484,6 +794,334 @@ func (b *Module) relocate(data []byte, rdata []byte) error {
 	}
 }
 
+// elfReadDataMaps turns the .data, .rodata and .bss sections, which hold
+// global variables, into array maps with a single element. The maps are
+// named after the sections. Constants of .rodata sections are rewritten
+// as given in their parameters, and the maps are frozen afterwards so that
+// the verifier can rely on their values.
+func (b *Module) elfReadDataMaps(maps map[string]*Map, params map[string]SectionParams) error {
+	var symbols []elf.Symbol
+	for i, section := range b.file.Sections {
+		if !isDataSection(section) {
+			continue
+		}
+		name := section.Name
+		if oldMap, ok := maps[name]; ok {
+			return fmt.Errorf("duplicate map: %q and %q", oldMap.Name, name)
+		}
+
+		// .bss has no data, the kernel zeroes the array
+		data := make([]byte, section.Size)
+		if section.Type != elf.SHT_NOBITS {
+			d, err := section.Data()
+			if err != nil {
+				return err
+			}
+			copy(data, d)
+		}
+
+		readonly := isRodataSection(name)
+		if consts := params[name].Constants; len(consts) > 0 {
+			if !readonly {
+				return fmt.Errorf("section %q: constants can only be rewritten in .rodata sections", name)
+			}
+			if symbols == nil {
+				var err error
+				if symbols, err = b.file.Symbols(); err != nil {
+					return err
+				}
+			}
+			if err := rewriteConstants(data, symbols, elf.SectionIndex(i), consts, b.file.ByteOrder); err != nil {
+				return fmt.Errorf("section %q: %v", name, err)
+			}
+		}
+
+		var mapDef C.bpf_map_def
+		mapDef._type = C.BPF_MAP_TYPE_ARRAY
+		mapDef.key_size = 4
+		mapDef.value_size = C.uint(len(data))
+		mapDef.max_entries = 1
+		if readonly {
+			mapDef.map_flags = C.BPF_F_RDONLY_PROG
+		}
+
+		opts := b.mapCreateOpts(0, 0)
+		if b.btf != nil {
+			if id, ok := b.btf.findType(btfKindDatasec, name); ok {
+				opts = b.mapCreateOpts(0, id)
+			}
+		}
+		cm, err := C.bpf_load_map(&mapDef, nil, &opts)
+		if cm == nil {
+			return fmt.Errorf("error while loading map %q: %v", name, err)
+		}
+		m := &Map{
+			Name: name,
+			m:    cm,
+		}
+		maps[name] = m
+
+		if len(data) == 0 {
+			continue
+		}
+		var key uint32
+		ret, err := C.bpf_update_element(cm.fd, unsafe.Pointer(&key), unsafe.Pointer(&data[0]), C.BPF_ANY)
+		if ret != 0 {
+			return fmt.Errorf("error initializing map %q: %v", name, err)
+		}
+		if readonly {
+			if ret, err := C.bpf_map_freeze(cm.fd); ret != 0 {
+				return fmt.Errorf("error freezing map %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isDataSection(section *elf.Section) bool {
+	if section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 {
+		return false
+	}
+	for _, prefix := range []string{".data", ".rodata", ".bss"} {
+		if section.Name == prefix || strings.HasPrefix(section.Name, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func isRodataSection(name string) bool {
+	return name == ".rodata" || strings.HasPrefix(name, ".rodata.")
+}
+
+// rewriteConstants overwrites the variables of a section's data with the
+// given values, looking the variables up in the ELF symbol table.
+func rewriteConstants(data []byte, symbols []elf.Symbol, section elf.SectionIndex, consts map[string]interface{}, bo binary.ByteOrder) error {
+	for name, value := range consts {
+		var sym *elf.Symbol
+		for i := range symbols {
+			if symbols[i].Section == section && symbols[i].Name == name &&
+				elf.ST_TYPE(symbols[i].Info) == elf.STT_OBJECT {
+				sym = &symbols[i]
+				break
+			}
+		}
+		if sym == nil {
+			return fmt.Errorf("constant %q not found", name)
+		}
+		if sym.Value+sym.Size > uint64(len(data)) {
+			return fmt.Errorf("constant %q out of bounds", name)
+		}
+
+		raw, ok := value.([]byte)
+		if !ok {
+			var buf bytes.Buffer
+			if err := binary.Write(&buf, bo, value); err != nil {
+				return fmt.Errorf("can't encode constant %q: %v", name, err)
+			}
+			raw = buf.Bytes()
+		}
+		if uint64(len(raw)) != sym.Size {
+			return fmt.Errorf("constant %q has size %d, got a value of size %d", name, sym.Size, len(raw))
+		}
+		copy(data[sym.Value:], raw)
+	}
+	return nil
+}
+
+// btfMapSymbol returns the name of the .maps variable a relocation refers
+// to. References to static maps are relocated against the section symbol,
+// with the offset of the variable in the instruction's immediate.
+func btfMapSymbol(symbols []elf.Symbol, symbol elf.Symbol, imm int32) (string, error) {
+	if elf.ST_TYPE(symbol.Info) != elf.STT_SECTION {
+		return symbol.Name, nil
+	}
+	off := symbol.Value + uint64(imm)
+	for _, s := range symbols {
+		if s.Section == symbol.Section && elf.ST_TYPE(s.Info) == elf.STT_OBJECT && s.Value == off {
+			return s.Name, nil
+		}
+	}
+	return "", fmt.Errorf("relocation error, no map at offset %d in section .maps", off)
+}
+
+// loadBTF parses the .BTF and .BTF.ext sections, if any, and loads the type
+// information into the kernel. Kernels without (sufficient) BTF support
+// reject the types: in that case the programs and maps are loaded without
+// them, as before, and Log gives the reason. Other errors are returned.
+func (b *Module) loadBTF() error {
+	btfSec := b.file.Section(".BTF")
+	if btfSec == nil {
+		return nil
+	}
+	data, err := btfSec.Data()
+	if err != nil {
+		return err
+	}
+	b.btf, err = parseBTF(data, b.file.ByteOrder)
+	if err != nil {
+		return fmt.Errorf("error parsing BTF: %v", err)
+	}
+
+	if extSec := b.file.Section(".BTF.ext"); extSec != nil {
+		data, err := extSec.Data()
+		if err != nil {
+			return err
+		}
+		b.btfExt, err = parseBTFExt(data, b.file.ByteOrder, b.btf)
+		if err != nil {
+			return fmt.Errorf("error parsing BTF.ext: %v", err)
+		}
+	}
+
+	secSizes, varOffsets, err := elfDatasecInfo(b.file)
+	if err != nil {
+		return err
+	}
+	if err := b.btf.fixupDatasecs(secSizes, varOffsets); err != nil {
+		return fmt.Errorf("error fixing up BTF: %v", err)
+	}
+
+	fd, err := b.btf.load()
+	if err != nil {
+		loadErr, ok := err.(*btfLoadError)
+		if !ok || !loadErr.unsupported() {
+			return err
+		}
+		// keep the log for Log to tell why the programs are loaded without
+		// func and line info
+		if len(b.log) > 0 {
+			n := copy(b.log[:len(b.log)-1], loadErr.log)
+			b.log[n] = 0
+		}
+		return nil
+	}
+	b.btfFd = fd
+	return nil
+}
+
+// SetKernelBTFPath sets the BTF used to apply CO-RE relocations, for
+// kernels that don't expose theirs in /sys/kernel/btf/vmlinux. The file
+// may contain raw BTF, e.g. from BTFHub, or be an ELF with a .BTF section.
+// It must be called before Load. The functions fentry, fexit, fmod_ret and
+// LSM programs attach to are still looked up in the running kernel's BTF.
+func (b *Module) SetKernelBTFPath(path string) {
+	b.kernelBTFPath = path
+}
+
+// kernelBTFSpec returns the BTF of the kernel, read from kernelBTFPath or
+// DefaultKernelBTFPath on first use.
+func (b *Module) kernelBTFSpec() (*btfSpec, error) {
+	if b.kernelBTF != nil {
+		return b.kernelBTF, nil
+	}
+	path := b.kernelBTFPath
+	if path == "" {
+		path = DefaultKernelBTFPath
+	}
+	spec, err := loadKernelBTF(path)
+	if err != nil {
+		return nil, err
+	}
+	b.kernelBTF = spec
+	return spec, nil
+}
+
+// applyCORE applies the CO-RE relocations of the given section to its
+// instructions.
+func (b *Module) applyCORE(secName string, insns []byte) error {
+	if b.btfExt == nil || len(b.btfExt.coreRelos[secName]) == 0 {
+		return nil
+	}
+	kernelBTF, err := b.kernelBTFSpec()
+	if err != nil {
+		return fmt.Errorf("error loading kernel BTF for CO-RE relocations: %v", err)
+	}
+	for _, relo := range b.btfExt.coreRelos[secName] {
+		if err := coreRelocate(b.btf, kernelBTF, relo, insns, b.file.ByteOrder); err != nil {
+			return fmt.Errorf("CO-RE relocation %s of type %d (%q) at instruction %d: %v",
+				coreKindName(relo.kind), relo.typeID, relo.accessor, relo.insnOff, err)
+		}
+	}
+	return nil
+}
+
+// elfDatasecInfo returns the size of each section and the offset of each
+// data symbol within its section, as needed to fix up BTF DATASEC types.
+func elfDatasecInfo(file *elf.File) (map[string]uint32, map[string]uint32, error) {
+	secSizes := make(map[string]uint32)
+	for _, section := range file.Sections {
+		secSizes[section.Name] = uint32(section.Size)
+	}
+
+	symbols, err := file.Symbols()
+	if err != nil {
+		return nil, nil, err
+	}
+	varOffsets := make(map[string]uint32)
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_OBJECT {
+			continue
+		}
+		varOffsets[symbol.Name] = uint32(symbol.Value)
+	}
+	return secSizes, varOffsets, nil
+}
+
+// progAttachInfo is the hook a program is loaded for, if its type needs one.
+type progAttachInfo struct {
+	attachType uint32
+	btfID      uint32
+	btfObjFd   int // BTF of the kernel module btfID belongs to, or -1
+}
+
+// loadProgram loads a linked program and returns the program fd. When the
+// object carries BTF, the function and line information of the program
+// are passed along so that verifier messages refer to source lines.
+func (b *Module) loadProgram(progType uint32, prog *elfProgram, attach progAttachInfo, license unsafe.Pointer, version uint32) (C.int, error) {
+	insns := prog.insns
+	btfFd := C.int(-1)
+	var funcInfo []C.struct_bpf_func_info
+	var lineInfo []C.struct_bpf_line_info
+	if b.btfFd >= 0 {
+		btfFd = C.int(b.btfFd)
+		for _, fi := range prog.funcInfos {
+			funcInfo = append(funcInfo, C.struct_bpf_func_info{
+				insn_off: C.__u32(fi.insnOff),
+				type_id:  C.__u32(fi.typeID),
+			})
+		}
+		for _, li := range prog.lineInfos {
+			lineInfo = append(lineInfo, C.struct_bpf_line_info{
+				insn_off:      C.__u32(li.insnOff),
+				file_name_off: C.__u32(li.fileNameOff),
+				line_off:      C.__u32(li.lineOff),
+				line_col:      C.__u32(li.lineCol),
+			})
+		}
+	}
+	var funcInfoPtr, lineInfoPtr unsafe.Pointer
+	if len(funcInfo) > 0 {
+		funcInfoPtr = unsafe.Pointer(&funcInfo[0])
+	}
+	if len(lineInfo) > 0 {
+		lineInfoPtr = unsafe.Pointer(&lineInfo[0])
+	}
+
+	progFd, err := C.bpf_prog_load(progType,
+		(*C.struct_bpf_insn)(unsafe.Pointer(&insns[0])), C.int(len(insns)),
+		(*C.char)(license), C.int(version),
+		(*C.char)(unsafe.Pointer(&b.log[0])), C.int(len(b.log)),
+		btfFd, funcInfoPtr, C.int(len(funcInfo)),
+		lineInfoPtr, C.int(len(lineInfo)),
+		&C.bpf_prog_load_attach{
+			expected_attach_type: C.int(attach.attachType),
+			attach_btf_id:        C.__u32(attach.btfID),
+			attach_btf_obj_fd:    C.int(attach.btfObjFd),
+		})
+	return progFd, err
+}
+
 type SectionParams struct {
 	PerfRingBufferPageCount    int
 	SkipPerfMapInitialization  bool
@@ -491,6 +1129,29 @@ type SectionParams struct {
 	MapMaxEntries              int    // Used to override bpf map entries size
 	PerfRingBufferBackward     bool
 	PerfRingBufferOverwritable bool
+	// ReplacePinnedMap replaces a pinned map that doesn't match its
+	// definition, e.g. after an upgrade changed its value size, instead of
+	// failing to load. The data of the replaced map is lost.
+	ReplacePinnedMap bool
+	// InnerMap names the map whose definition is used as inner map
+	// definition of the ARRAY_OF_MAPS or HASH_OF_MAPS map of the section.
+	// BTF-defined map-in-maps declare it with __array(values, ...) instead.
+	InnerMap string
+	// TailCalls fills a prog array map with the programs of the given
+	// names, by index, once they are loaded
+	TailCalls map[uint32]string
+	// ProgramPinning pins the programs of a section when they are loaded,
+	// or reuses the programs pinned by a previous Load instead of loading
+	// them: PIN_OBJECT_NS pins them at /sys/fs/bpf/<object ID>/<function>,
+	// PIN_GLOBAL_NS at /sys/fs/bpf/<PinNamespace>/globals/<function> and
+	// PIN_CUSTOM_NS at PinPath. The latter requires the section to hold a
+	// single program.
+	ProgramPinning int
+	PinNamespace   string // namespace of programs pinned with PIN_GLOBAL_NS
+	// Constants rewrites `const volatile` variables of a .rodata section
+	// before the section is loaded. Values must have the size of the
+	// variable and are either a []byte or encoded with encoding/binary.
+	Constants map[string]interface{}
 }
 
 // Load loads the BPF programs and BPF maps in the module. Each ELF section
@@ -530,308 +1191,437 @@ func (b *Module) Load(parameters map[string]SectionParams) error {
 		}
 	}
 
-	maps, err := elfReadMaps(b.file, parameters)
+	if err := b.loadBTF(); err != nil {
+		return err
+	}
+
+	maps, err := b.elfReadMaps(parameters)
 	if err != nil {
 		return err
 	}
 	b.maps = maps
 
-	processed := make([]bool, len(b.file.Sections))
+	inits, err := b.mapInitValues()
+	if err != nil {
+		return err
+	}
+	if err := b.initializeMapInMaps(inits); err != nil {
+		return err
+	}
+
+	if err := b.loadPrograms(lp, version, parameters); err != nil {
+		return err
+	}
+
+	if err := b.initializeTailCalls(inits, parameters); err != nil {
+		return err
+	}
+
+	return b.initializePerfMaps(parameters)
+}
+
+// sectionProgramType returns the type of the programs in the given
+// section, or false if the section doesn't hold programs.
+func sectionProgramType(secName string) (uint32, bool) {
+	switch {
+	case strings.HasPrefix(secName, "kprobe/"),
+		strings.HasPrefix(secName, "kretprobe/"),
+		strings.HasPrefix(secName, "uprobe/"),
+		strings.HasPrefix(secName, "uretprobe/"):
+		return uint32(C.BPF_PROG_TYPE_KPROBE), true
+	case strings.HasPrefix(secName, "cgroup/skb"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_SKB), true
+	// the sections of the types below cgroup/sock are matched as in
+	// cgroupAttachType, for their programs to be loaded with the expected
+	// attach type
+	case strings.HasPrefix(secName, "cgroup/sock"),
+		matchSection(secName, "cgroup/post_bind4", "cgroup/post_bind6"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_SOCK), true
+	case matchSection(secName, "cgroup/bind4", "cgroup/bind6",
+		"cgroup/connect4", "cgroup/connect6",
+		"cgroup/sendmsg4", "cgroup/sendmsg6",
+		"cgroup/recvmsg4", "cgroup/recvmsg6"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_SOCK_ADDR), true
+	case matchSection(secName, "cgroup/getsockopt", "cgroup/setsockopt"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_SOCKOPT), true
+	case matchSection(secName, "cgroup/sysctl"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_SYSCTL), true
+	case matchSection(secName, "cgroup/dev"):
+		return uint32(C.BPF_PROG_TYPE_CGROUP_DEVICE), true
+	case matchSection(secName, "sockops"):
+		return uint32(C.BPF_PROG_TYPE_SOCK_OPS), true
+	case strings.HasPrefix(secName, "socket"):
+		return uint32(C.BPF_PROG_TYPE_SOCKET_FILTER), true
+	case strings.HasPrefix(secName, "tracepoint/"):
+		return uint32(C.BPF_PROG_TYPE_TRACEPOINT), true
+	case strings.HasPrefix(secName, "raw_tracepoint/"):
+		return uint32(C.BPF_PROG_TYPE_RAW_TRACEPOINT), true
+	case strings.HasPrefix(secName, "perf_event"):
+		return uint32(C.BPF_PROG_TYPE_PERF_EVENT), true
+	case strings.HasPrefix(secName, "sched_cls/"):
+		return uint32(C.BPF_PROG_TYPE_SCHED_CLS), true
+	case strings.HasPrefix(secName, "sched_act/"):
+		return uint32(C.BPF_PROG_TYPE_SCHED_ACT), true
+	case strings.HasPrefix(secName, "xdp/"):
+		return uint32(C.BPF_PROG_TYPE_XDP), true
+	case strings.HasPrefix(secName, "fentry/"),
+		strings.HasPrefix(secName, "fexit/"),
+		strings.HasPrefix(secName, "fmod_ret/"):
+		return uint32(C.BPF_PROG_TYPE_TRACING), true
+	case strings.HasPrefix(secName, "lsm/"):
+		return uint32(C.BPF_PROG_TYPE_LSM), true
+	case strings.HasPrefix(secName, "sk_msg"):
+		return uint32(C.BPF_PROG_TYPE_SK_MSG), true
+	case strings.HasPrefix(secName, "sk_skb/"):
+		return uint32(C.BPF_PROG_TYPE_SK_SKB), true
+	}
+	return 0, false
+}
+
+// programAttachInfo returns the hook the programs of the given section are
+// loaded for.
+func (b *Module) programAttachInfo(secName string) (progAttachInfo, error) {
+	attach := progAttachInfo{btfObjFd: -1}
+	if attachType, ok := cgroupAttachType(secName); ok {
+		// required for sock_addr, sockopt and post_bind programs
+		attach.attachType = uint32(attachType)
+		return attach, nil
+	}
+	switch {
+	case strings.HasPrefix(secName, "fentry/"):
+		attach.attachType = C.BPF_TRACE_FENTRY
+	case strings.HasPrefix(secName, "fexit/"):
+		attach.attachType = C.BPF_TRACE_FEXIT
+	case strings.HasPrefix(secName, "fmod_ret/"):
+		attach.attachType = C.BPF_MODIFY_RETURN
+	case strings.HasPrefix(secName, "lsm/"):
+		// LSM hooks are attached through the bpf_lsm_<hook> functions
+		attach.attachType = C.BPF_LSM_MAC
+		var err error
+		attach.btfID, _, err = b.kernelFuncBTFID("vmlinux:bpf_lsm_" + strings.TrimPrefix(secName, "lsm/"))
+		return attach, err
+	default:
+		return attach, nil
+	}
+
+	target := secName[strings.IndexByte(secName, '/')+1:]
+	var err error
+	attach.btfID, attach.btfObjFd, err = b.kernelFuncBTFID(target)
+	return attach, err
+}
+
+// loadPrograms relocates the executable sections, splits them into
+// functions and loads every function of a program section as a program,
+// together with the functions it calls. Functions in .text are only
+// loaded as part of the programs calling them.
+func (b *Module) loadPrograms(license unsafe.Pointer, version uint32, params map[string]SectionParams) error {
+	symbols, err := b.file.Symbols()
+	if err != nil {
+		return err
+	}
+
+	relSections := make(map[elf.SectionIndex]*elf.Section)
+	for _, section := range b.file.Sections {
+		if section.Type == elf.SHT_REL {
+			relSections[elf.SectionIndex(section.Info)] = section
+		}
+	}
+
+	var funcs []*elfFunc
+	calls := make(map[elf.SectionIndex]map[int]elfCallTarget)
 	for i, section := range b.file.Sections {
-		if processed[i] {
+		if section.Type != elf.SHT_PROGBITS || section.Flags&elf.SHF_EXECINSTR == 0 {
+			continue
+		}
+		if _, ok := sectionProgramType(section.Name); !ok && section.Name != ".text" {
 			continue
 		}
-
 		data, err := section.Data()
 		if err != nil {
 			return err
 		}
-
 		if len(data) == 0 {
 			continue
 		}
+		index := elf.SectionIndex(i)
 
-		if section.Type == elf.SHT_REL {
-			rsection := b.file.Sections[section.Info]
-
-			processed[i] = true
-			processed[section.Info] = true
-
-			secName := rsection.Name
-
-			isKprobe := strings.HasPrefix(secName, "kprobe/")
-			isKretprobe := strings.HasPrefix(secName, "kretprobe/")
-			isUprobe := strings.HasPrefix(secName, "uprobe/")
-			isUretprobe := strings.HasPrefix(secName, "uretprobe/")
-			isCgroupSkb := strings.HasPrefix(secName, "cgroup/skb")
-			isCgroupSock := strings.HasPrefix(secName, "cgroup/sock")
-			isSocketFilter := strings.HasPrefix(secName, "socket")
-			isTracepoint := strings.HasPrefix(secName, "tracepoint/")
-			isSchedCls := strings.HasPrefix(secName, "sched_cls/")
-			isSchedAct := strings.HasPrefix(secName, "sched_act/")
-			isXDP := strings.HasPrefix(secName, "xdp/")
-
-			var progType uint32
-			switch {
-
-			case isKprobe:
-				fallthrough
-			case isKretprobe:
-				fallthrough
-			case isUprobe:
-				fallthrough
-			case isUretprobe:
-				progType = uint32(C.BPF_PROG_TYPE_KPROBE)
-			case isCgroupSkb:
-				progType = uint32(C.BPF_PROG_TYPE_CGROUP_SKB)
-			case isCgroupSock:
-				progType = uint32(C.BPF_PROG_TYPE_CGROUP_SOCK)
-			case isSocketFilter:
-				progType = uint32(C.BPF_PROG_TYPE_SOCKET_FILTER)
-			case isTracepoint:
-				progType = uint32(C.BPF_PROG_TYPE_TRACEPOINT)
-			case isSchedCls:
-				progType = uint32(C.BPF_PROG_TYPE_SCHED_CLS)
-			case isSchedAct:
-				progType = uint32(C.BPF_PROG_TYPE_SCHED_ACT)
-			case isXDP:
-				progType = uint32(C.BPF_PROG_TYPE_XDP)
-			}
-
-			// If Kprobe or Kretprobe for a syscall, use correct syscall prefix in section name
-			if b.compatProbe && (isKprobe || isKretprobe) {
-				str := strings.Split(secName, "/")
-				if (strings.HasPrefix(str[1], "SyS_")) || (strings.HasPrefix(str[1], "sys_")) {
-					name := strings.TrimPrefix(str[1], "SyS_")
-					name = strings.TrimPrefix(name, "sys_")
-					syscallFnName, err := GetSyscallFnName(name)
-					if err == nil {
-						secName = fmt.Sprintf("%s/%s", str[0], syscallFnName)
-					}
-				}
+		if rel, ok := relSections[index]; ok {
+			relData, err := rel.Data()
+			if err != nil {
+				return err
 			}
+			if calls[index], err = b.relocate(relData, data); err != nil {
+				return err
+			}
+		}
+		if err := b.applyCORE(section.Name, data); err != nil {
+			return fmt.Errorf("error relocating %q: %v", section.Name, err)
+		}
 
-			if isKprobe || isKretprobe || isUprobe || isUretprobe || isCgroupSkb || isCgroupSock || isSocketFilter || isTracepoint || isSchedCls || isSchedAct || isXDP {
-				rdata, err := rsection.Data()
-				if err != nil {
-					return err
-				}
-
-				if len(rdata) == 0 {
-					continue
-				}
-
-				err = b.relocate(data, rdata)
-				if err != nil {
-					return err
-				}
-
-				insns := (*C.struct_bpf_insn)(unsafe.Pointer(&rdata[0]))
+		secFuncs, err := splitFunctions(section.Name, index, data, symbols)
+		if err != nil {
+			return err
+		}
+		funcs = append(funcs, secFuncs...)
+	}
 
-				progFd, err := C.bpf_prog_load(progType,
-					insns, C.int(rsection.Size),
-					(*C.char)(lp), C.int(version),
-					(*C.char)(unsafe.Pointer(&b.log[0])), C.int(len(b.log)))
-				if progFd < 0 {
-					return fmt.Errorf("error while loading %q (%v):\n%s", secName, err, b.log)
-				}
+	if err := resolveCalls(funcs, calls, b.file.ByteOrder); err != nil {
+		return err
+	}
 
-				switch {
-				case isKprobe:
-					fallthrough
-				case isKretprobe:
-					b.probes[secName] = &Kprobe{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-						efd:   -1,
-					}
-				case isUprobe:
-					fallthrough
-				case isUretprobe:
-					b.uprobes[secName] = &Uprobe{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-						efds:  make(map[string]int),
-					}
-				case isCgroupSkb:
-					fallthrough
-				case isCgroupSock:
-					b.cgroupPrograms[secName] = &CgroupProgram{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-					}
-				case isSocketFilter:
-					b.socketFilters[secName] = &SocketFilter{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-					}
-				case isTracepoint:
-					b.tracepointPrograms[secName] = &TracepointProgram{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-						efd:   -1,
-					}
-				case isSchedCls:
-					fallthrough
-				case isSchedAct:
-					b.schedPrograms[secName] = &SchedProgram{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-					}
-				case isXDP:
-					b.xdpPrograms[secName] = &XDPProgram{
-						Name:  secName,
-						insns: insns,
-						fd:    int(progFd),
-					}
-				}
-			}
-		}
+	secPrograms := make(map[string]int)
+	for _, fn := range funcs {
+		secPrograms[fn.secName]++
 	}
 
-	for i, section := range b.file.Sections {
-		if processed[i] {
+	for _, fn := range funcs {
+		progType, ok := sectionProgramType(fn.secName)
+		if !ok {
 			continue
 		}
+		prog := linkProgram(fn, b.btfExt, b.file.ByteOrder)
 
-		secName := section.Name
-
-		isKprobe := strings.HasPrefix(secName, "kprobe/")
-		isKretprobe := strings.HasPrefix(secName, "kretprobe/")
-		isUprobe := strings.HasPrefix(secName, "uprobe/")
-		isUretprobe := strings.HasPrefix(secName, "uretprobe/")
-		isCgroupSkb := strings.HasPrefix(secName, "cgroup/skb")
-		isCgroupSock := strings.HasPrefix(secName, "cgroup/sock")
-		isSocketFilter := strings.HasPrefix(secName, "socket")
-		isTracepoint := strings.HasPrefix(secName, "tracepoint/")
-		isSchedCls := strings.HasPrefix(secName, "sched_cls/")
-		isSchedAct := strings.HasPrefix(secName, "sched_act/")
-		isXDP := strings.HasPrefix(secName, "xdp/")
-
-		var progType uint32
-		switch {
-		case isKprobe:
-			fallthrough
-		case isKretprobe:
-			fallthrough
-		case isUprobe:
-			fallthrough
-		case isUretprobe:
-			progType = uint32(C.BPF_PROG_TYPE_KPROBE)
-		case isCgroupSkb:
-			progType = uint32(C.BPF_PROG_TYPE_CGROUP_SKB)
-		case isCgroupSock:
-			progType = uint32(C.BPF_PROG_TYPE_CGROUP_SOCK)
-		case isSocketFilter:
-			progType = uint32(C.BPF_PROG_TYPE_SOCKET_FILTER)
-		case isTracepoint:
-			progType = uint32(C.BPF_PROG_TYPE_TRACEPOINT)
-		case isSchedCls:
-			progType = uint32(C.BPF_PROG_TYPE_SCHED_CLS)
-		case isSchedAct:
-			progType = uint32(C.BPF_PROG_TYPE_SCHED_ACT)
-		case isXDP:
-			progType = uint32(C.BPF_PROG_TYPE_XDP)
-		}
-
-		// If Kprobe or Kretprobe for a syscall, use correct syscall prefix in section name
-		if b.compatProbe && (isKprobe || isKretprobe) {
-			str := strings.Split(secName, "/")
-			if (strings.HasPrefix(str[1], "SyS_")) || (strings.HasPrefix(str[1], "sys_")) {
-				name := strings.TrimPrefix(str[1], "SyS_")
-				name = strings.TrimPrefix(name, "sys_")
-				syscallFnName, err := GetSyscallFnName(name)
-				if err == nil {
-					secName = fmt.Sprintf("%s/%s", str[0], syscallFnName)
+		pinPath, err := b.programPinPath(fn, params[fn.secName], secPrograms[fn.secName] == 1)
+		if err != nil {
+			return err
+		}
+		if pinPath != "" {
+			if _, err := os.Stat(pinPath); err == nil {
+				fd := GetProgFd(pinPath)
+				if fd < 0 {
+					return fmt.Errorf("error opening pinned program %q", pinPath)
+				}
+				if err := b.registerProgram(prog, fd, pinPath, true); err != nil {
+					return err
 				}
+				continue
 			}
 		}
 
-		if isKprobe || isKretprobe || isUprobe || isUretprobe || isCgroupSkb || isCgroupSock || isSocketFilter || isTracepoint || isSchedCls || isSchedAct || isXDP {
-			data, err := section.Data()
-			if err != nil {
+		attach, err := b.programAttachInfo(fn.secName)
+		if err != nil {
+			return fmt.Errorf("error loading %q: %v", fn.name, err)
+		}
+		progFd, err := b.loadProgram(progType, prog, attach, license, version)
+		if attach.btfObjFd >= 0 {
+			syscall.Close(attach.btfObjFd)
+		}
+		if progFd < 0 {
+			return fmt.Errorf("error while loading %q (%v):\n%s", fn.name, err, b.log)
+		}
+		if pinPath != "" {
+			if err := pinObject(int(progFd), pinPath); err != nil {
+				syscall.Close(int(progFd))
 				return err
 			}
+		}
+		if err := b.registerProgram(prog, int(progFd), pinPath, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			if len(data) == 0 {
-				continue
-			}
-
-			insns := (*C.struct_bpf_insn)(unsafe.Pointer(&data[0]))
+// programPinPath returns the path a program is pinned at according to the
+// ProgramPinning parameter of its section, or "" if it isn't pinned.
+func (b *Module) programPinPath(fn *elfFunc, params SectionParams, single bool) (string, error) {
+	// programs of sections without function symbols are named after
+	// their section
+	name := strings.Replace(fn.name, "/", "_", -1)
 
-			progFd, err := C.bpf_prog_load(progType,
-				insns, C.int(section.Size),
-				(*C.char)(lp), C.int(version),
-				(*C.char)(unsafe.Pointer(&b.log[0])), C.int(len(b.log)))
-			if progFd < 0 {
-				return fmt.Errorf("error while loading %q (%v):\n%s", section.Name, err, b.log)
-			}
+	var pinPath string
+	switch params.ProgramPinning {
+	case PIN_NONE:
+		return "", nil
+	case PIN_OBJECT_NS:
+		objectID, err := b.pinObjectID()
+		if err != nil {
+			return "", err
+		}
+		pinPath = filepath.Join(BPFFSPath, objectID, name)
+	case PIN_GLOBAL_NS:
+		if params.PinNamespace == "" {
+			return "", fmt.Errorf("no pin namespace given for program %q with PIN_GLOBAL_NS", fn.name)
+		}
+		pinPath = filepath.Join(BPFFSPath, params.PinNamespace, BPFDirGlobals, name)
+	case PIN_CUSTOM_NS:
+		if params.PinPath == "" {
+			return "", fmt.Errorf("no pin path given for program %q with PIN_CUSTOM_NS", fn.name)
+		}
+		if !single {
+			return "", fmt.Errorf("section %q holds several programs and can't be pinned with PIN_CUSTOM_NS", fn.secName)
+		}
+		pinPath = filepath.Join(BPFFSPath, params.PinPath)
+	default:
+		return "", fmt.Errorf("invalid pinning %d for program %q", params.ProgramPinning, fn.name)
+	}
+	if !validPinPath(pinPath) {
+		return "", fmt.Errorf("invalid path %q", pinPath)
+	}
+	return pinPath, nil
+}
 
-			switch {
-			case isKprobe:
-				fallthrough
-			case isKretprobe:
-				b.probes[secName] = &Kprobe{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-					efd:   -1,
-				}
-			case isUprobe:
-				fallthrough
-			case isUretprobe:
-				b.uprobes[secName] = &Uprobe{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-					efds:  make(map[string]int),
-				}
-			case isCgroupSkb:
-				fallthrough
-			case isCgroupSock:
-				b.cgroupPrograms[secName] = &CgroupProgram{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-				}
-			case isSocketFilter:
-				b.socketFilters[secName] = &SocketFilter{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-				}
-			case isTracepoint:
-				b.tracepointPrograms[secName] = &TracepointProgram{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-					efd:   -1,
-				}
-			case isSchedCls:
-				fallthrough
-			case isSchedAct:
-				b.schedPrograms[secName] = &SchedProgram{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-				}
-			case isXDP:
-				b.xdpPrograms[secName] = &XDPProgram{
-					Name:  secName,
-					insns: insns,
-					fd:    int(progFd),
-				}
+// registerProgram makes a loaded program available by its function name
+// and, for the first program of each section, through the accessors of
+// its type, which identify programs by section name.
+func (b *Module) registerProgram(prog *elfProgram, fd int, pinPath string, reused bool) error {
+	name := prog.entry.name
+	if _, ok := b.programs[name]; ok {
+		return fmt.Errorf("duplicate program %q", name)
+	}
+	secName := prog.entry.secName
+	p := &Program{
+		Name:        name,
+		SectionName: secName,
+		insns:       (*C.struct_bpf_insn)(unsafe.Pointer(&prog.insns[0])),
+		fd:          fd,
+		pinPath:     pinPath,
+		reused:      reused,
+	}
+	b.programs[name] = p
+
+	// If Kprobe or Kretprobe for a syscall, use correct syscall prefix in section name
+	isKprobe := strings.HasPrefix(secName, "kprobe/") || strings.HasPrefix(secName, "kretprobe/")
+	if b.compatProbe && isKprobe {
+		str := strings.Split(secName, "/")
+		if (strings.HasPrefix(str[1], "SyS_")) || (strings.HasPrefix(str[1], "sys_")) {
+			name := strings.TrimPrefix(str[1], "SyS_")
+			name = strings.TrimPrefix(name, "sys_")
+			syscallFnName, err := GetSyscallFnName(name)
+			if err == nil {
+				secName = fmt.Sprintf("%s/%s", str[0], syscallFnName)
 			}
 		}
 	}
 
-	return b.initializePerfMaps(parameters)
+	insns := p.insns
+	switch {
+	case isKprobe:
+		if _, ok := b.probes[secName]; ok {
+			return nil
+		}
+		b.probes[secName] = &Kprobe{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efd:   -1,
+		}
+	case strings.HasPrefix(secName, "uprobe/"), strings.HasPrefix(secName, "uretprobe/"):
+		if _, ok := b.uprobes[secName]; ok {
+			return nil
+		}
+		b.uprobes[secName] = &Uprobe{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efds:  make(map[string]int),
+		}
+	case strings.HasPrefix(secName, "cgroup/"), strings.HasPrefix(secName, "sockops"):
+		if _, ok := b.cgroupPrograms[secName]; ok {
+			return nil
+		}
+		b.cgroupPrograms[secName] = &CgroupProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+		}
+	case strings.HasPrefix(secName, "socket"):
+		if _, ok := b.socketFilters[secName]; ok {
+			return nil
+		}
+		b.socketFilters[secName] = &SocketFilter{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+		}
+	case strings.HasPrefix(secName, "tracepoint/"):
+		if _, ok := b.tracepointPrograms[secName]; ok {
+			return nil
+		}
+		b.tracepointPrograms[secName] = &TracepointProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efd:   -1,
+		}
+	case strings.HasPrefix(secName, "raw_tracepoint/"):
+		if _, ok := b.rawTracepoints[secName]; ok {
+			return nil
+		}
+		b.rawTracepoints[secName] = &RawTracepointProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efd:   -1,
+		}
+	case strings.HasPrefix(secName, "perf_event"):
+		if _, ok := b.perfEventPrograms[secName]; ok {
+			return nil
+		}
+		b.perfEventPrograms[secName] = &PerfEventProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+		}
+	case strings.HasPrefix(secName, "fentry/"),
+		strings.HasPrefix(secName, "fexit/"),
+		strings.HasPrefix(secName, "fmod_ret/"):
+		if _, ok := b.tracingPrograms[secName]; ok {
+			return nil
+		}
+		b.tracingPrograms[secName] = &TracingProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efd:   -1,
+		}
+	case strings.HasPrefix(secName, "lsm/"):
+		if _, ok := b.lsmPrograms[secName]; ok {
+			return nil
+		}
+		b.lsmPrograms[secName] = &LSMProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+			efd:   -1,
+		}
+	case strings.HasPrefix(secName, "sk_msg"), strings.HasPrefix(secName, "sk_skb/"):
+		attachType, ok := sockMapAttachType(secName)
+		if !ok {
+			return fmt.Errorf("section %q: unknown sk_skb program kind, expected stream_parser, stream_verdict or verdict", secName)
+		}
+		if _, ok := b.sockMapPrograms[secName]; ok {
+			return nil
+		}
+		b.sockMapPrograms[secName] = &SockMapProgram{
+			Name:       secName,
+			insns:      insns,
+			fd:         fd,
+			attachType: attachType,
+		}
+	case strings.HasPrefix(secName, "sched_cls/"), strings.HasPrefix(secName, "sched_act/"):
+		if _, ok := b.schedPrograms[secName]; ok {
+			return nil
+		}
+		b.schedPrograms[secName] = &SchedProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+		}
+	case strings.HasPrefix(secName, "xdp/"):
+		if _, ok := b.xdpPrograms[secName]; ok {
+			return nil
+		}
+		b.xdpPrograms[secName] = &XDPProgram{
+			Name:  secName,
+			insns: insns,
+			fd:    fd,
+		}
+	default:
+		return nil
+	}
+	p.typed = true
+	return nil
 }
 
 func createPerfRingBuffer(backward bool, overwriteable bool, pageCount int) ([]C.int, []*C.struct_perf_event_mmap_page, [][]byte, error) {
@@ -973,6 +1763,13 @@ type Map struct {
 	Name string
 	m    *C.bpf_map
 
+	// pinPath is the path, relative to BPFFSPath, the map was pinned at
+	// with PIN_CUSTOM_NS
+	pinPath string
+
+	// inner is the definition of the maps stored in map-in-maps
+	inner *C.bpf_map_def
+
 	// only for perf maps
 	pmuFDs    []C.int
 	headers   []*C.struct_perf_event_mmap_page
@@ -999,6 +1796,21 @@ func (m *Map) Fd() int {
 	return int(m.m.fd)
 }
 
+// newInnerMap creates a map with the inner map definition of the
+// map-in-map outer.
+func newInnerMap(outer *Map) (*Map, error) {
+	def := *outer.inner
+	opts := C.bpf_map_create_opts{
+		btf_fd:       -1,
+		inner_map_fd: -1,
+	}
+	cm, err := C.bpf_load_map(&def, nil, &opts)
+	if cm == nil {
+		return nil, fmt.Errorf("error creating inner map of %q: %v", outer.Name, err)
+	}
+	return &Map{Name: outer.Name + ".inner", m: cm}, nil
+}
+
 // GetProgFd returns the fd for a pinned bpf program at the given path
 func GetProgFd(pinPath string) int {
 	pathC := C.CString(pinPath)
@@ -17,6 +17,9 @@
 package elf
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
 	"testing"
 )
 
@@ -49,3 +52,173 @@ func TestValidateMapPath(t *testing.T) {
 		}
 	}
 }
+
+func TestRewriteConstants(t *testing.T) {
+	symbols := []elf.Symbol{
+		{Name: "pid", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Section: 3, Value: 0, Size: 4},
+		{Name: "debug", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Section: 3, Value: 4, Size: 1},
+		{Name: "other", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Section: 4, Value: 0, Size: 4},
+	}
+
+	tests := []struct {
+		consts   map[string]interface{}
+		expected []byte
+		fail     bool
+	}{
+		{
+			consts:   map[string]interface{}{"pid": uint32(0x01020304), "debug": []byte{1}},
+			expected: []byte{4, 3, 2, 1, 1, 0, 0, 0},
+		},
+		{
+			consts: map[string]interface{}{"pid": uint64(1)},
+			fail:   true,
+		},
+		{
+			consts: map[string]interface{}{"other": uint32(1)},
+			fail:   true,
+		},
+	}
+
+	for i, tt := range tests {
+		data := make([]byte, 8)
+		err := rewriteConstants(data, symbols, 3, tt.consts, binary.LittleEndian)
+		if (err != nil) != tt.fail {
+			t.Fatalf("test %d expected failure %t but got %v", i, tt.fail, err)
+		}
+		if !tt.fail && !bytes.Equal(data, tt.expected) {
+			t.Fatalf("test %d expected %v but got %v", i, tt.expected, data)
+		}
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	tests := []struct {
+		fileName string
+		expected string
+	}{
+		{fileName: "/usr/lib/bpf/probes.o", expected: "probes"},
+		{fileName: "probes.bpf.o", expected: "probes.bpf"},
+		{fileName: "probes", expected: "probes"},
+	}
+
+	for i, tt := range tests {
+		if id := defaultObjectID(tt.fileName); id != tt.expected {
+			t.Fatalf("test %d (%s) expected %q but got %q", i, tt.fileName, tt.expected, id)
+		}
+	}
+
+	for _, id := range []string{"", ".", "..", "a/b"} {
+		if validObjectID(id) {
+			t.Fatalf("object ID %q should be invalid", id)
+		}
+	}
+}
+
+func TestProgramPinPath(t *testing.T) {
+	b := &Module{fileName: "/usr/lib/bpf/probes.o"}
+	fn := &elfFunc{name: "kprobe/foo", secName: "kprobe/foo"}
+
+	tests := []struct {
+		params   SectionParams
+		single   bool
+		expected string
+		err      bool
+	}{
+		{params: SectionParams{}, expected: ""},
+		{params: SectionParams{ProgramPinning: PIN_OBJECT_NS}, expected: "/sys/fs/bpf/probes/kprobe_foo"},
+		{params: SectionParams{ProgramPinning: PIN_GLOBAL_NS, PinNamespace: "ns1"}, expected: "/sys/fs/bpf/ns1/globals/kprobe_foo"},
+		{params: SectionParams{ProgramPinning: PIN_GLOBAL_NS}, err: true},
+		{params: SectionParams{ProgramPinning: PIN_CUSTOM_NS, PinPath: "ns1/foo"}, single: true, expected: "/sys/fs/bpf/ns1/foo"},
+		{params: SectionParams{ProgramPinning: PIN_CUSTOM_NS, PinPath: "ns1/foo"}, err: true},
+		{params: SectionParams{ProgramPinning: PIN_CUSTOM_NS, PinPath: "../foo"}, single: true, err: true},
+		{params: SectionParams{ProgramPinning: 42}, err: true},
+	}
+
+	for i, tt := range tests {
+		pinPath, err := b.programPinPath(fn, tt.params, tt.single)
+		if tt.err {
+			if err == nil {
+				t.Fatalf("test %d expected an error but got %q", i, pinPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if pinPath != tt.expected {
+			t.Fatalf("test %d expected %q but got %q", i, tt.expected, pinPath)
+		}
+	}
+}
+
+func TestPinnedMapMismatch(t *testing.T) {
+	def := pinnedMapInfo{mapType: 1, keySize: 4, valueSize: 8, maxEntries: 1024}
+
+	tests := []struct {
+		info     pinnedMapInfo
+		def      pinnedMapInfo
+		expected string
+	}{
+		{info: def, def: def, expected: ""},
+		{
+			info:     pinnedMapInfo{mapType: 1, keySize: 4, valueSize: 16, maxEntries: 2048},
+			def:      def,
+			expected: "value size 16 instead of 8, max entries 2048 instead of 1024",
+		},
+		{
+			info:     pinnedMapInfo{mapType: 4, keySize: 4, valueSize: 4, maxEntries: 8},
+			def:      pinnedMapInfo{mapType: 4, keySize: 4, valueSize: 4},
+			expected: "",
+		},
+		{
+			info:     pinnedMapInfo{mapType: 2, keySize: 4, valueSize: 8, maxEntries: 1024, flags: 1},
+			def:      def,
+			expected: "type 2 instead of 1, flags 1 instead of 0",
+		},
+	}
+
+	for i, tt := range tests {
+		if mismatch := tt.info.mismatch(tt.def); mismatch != tt.expected {
+			t.Fatalf("test %d expected %q but got %q", i, tt.expected, mismatch)
+		}
+	}
+}
+
+func TestCgroupAttachType(t *testing.T) {
+	tests := []struct {
+		secName    string
+		attachType AttachType
+		ok         bool
+	}{
+		{secName: "cgroup/connect4", attachType: Connect4Type, ok: true},
+		{secName: "cgroup/connect6/proxy", attachType: Connect6Type, ok: true},
+		{secName: "cgroup/post_bind4", attachType: PostBind4Type, ok: true},
+		{secName: "cgroup/bind6", attachType: Bind6Type, ok: true},
+		{secName: "sockops", attachType: SockOpsType, ok: true},
+		{secName: "cgroup/dev", attachType: DeviceType, ok: true},
+		{secName: "cgroup/skb", ok: false},
+		{secName: "cgroup/sock", ok: false},
+		{secName: "cgroup/bind4x", ok: false},
+	}
+
+	for _, tt := range tests {
+		attachType, ok := cgroupAttachType(tt.secName)
+		if ok != tt.ok || attachType != tt.attachType {
+			t.Fatalf("%s: expected %d, %v but got %d, %v", tt.secName, tt.attachType, tt.ok, attachType, ok)
+		}
+	}
+}
+
+func TestSectionProgramTypeMatchesAttachType(t *testing.T) {
+	// the sections of programs needing an attach type at load time are only
+	// loaded when it's known
+	for name := range cgroupAttachTypes {
+		for _, secName := range []string{name, name + "/foo", name + "x"} {
+			_, hasType := sectionProgramType(secName)
+			_, hasAttachType := cgroupAttachType(secName)
+			if hasType != hasAttachType {
+				t.Errorf("%s: program type %v but attach type %v", secName, hasType, hasAttachType)
+			}
+		}
+	}
+}
@@ -6,4 +6,8 @@ import (
 
 var (
 	errNotSupported = errors.New("not supported")
+
+	// ErrPerfReaderClosed is returned by PerfReader.Read once the reader is
+	// closed.
+	ErrPerfReaderClosed = errors.New("perf reader closed")
 )
@@ -11,10 +11,37 @@
 #ifndef __LIBBPF_LIBBPF_H
 #define __LIBBPF_LIBBPF_H
 
+#include <stdbool.h>
 #include <stdint.h>
 #include <linux/netlink.h>
 
 int bpf_set_link_xdp_fd(int ifindex, int fd, __u32 flags);
+int bpf_set_link_xdp_fd_opts(int ifindex, int fd, __u32 flags, int old_fd);
+
+struct xdp_link_info {
+	__u32 prog_id;
+	__u32 drv_prog_id;
+	__u32 hw_prog_id;
+	__u32 skb_prog_id;
+	__u8 attach_mode;
+};
+
+int bpf_get_link_xdp_info(int ifindex, struct xdp_link_info *info);
+
+struct bpf_tc_filter {
+	__u32 handle;
+	__u32 priority;
+	__u32 protocol;
+	__u32 prog_id;
+	__u32 flags;
+	char kind[16];
+	char name[256];
+};
+
+int bpf_tc_qdisc_clsact(int ifindex, bool create);
+int bpf_tc_attach(int ifindex, __u32 parent, struct bpf_tc_filter *filter, int prog_fd, bool replace);
+int bpf_tc_detach(int ifindex, __u32 parent, __u32 handle, __u32 priority);
+int bpf_tc_list(int ifindex, __u32 parent, struct bpf_tc_filter *filters, int max);
 
 enum libbpf_errno {
 	__LIBBPF_ERRNO__START = 4000,
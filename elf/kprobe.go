@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/perf_event.h>
+#include <linux/unistd.h>
+#include <stdlib.h>
+#include <unistd.h>
+
+extern __u64 ptr_to_u64(void *);
+
+static int perf_event_open_kprobe(int pmu_type, __u64 config, const char *func,
+				  int pid, int cpu, int group_fd, unsigned long flags)
+{
+	struct perf_event_attr attr = {0,};
+	attr.size = sizeof(attr);
+	attr.type = pmu_type;
+	attr.config = config;
+	attr.sample_period = 1;
+	attr.wakeup_events = 1;
+	attr.config1 = ptr_to_u64((void *)func);
+
+	return syscall(__NR_perf_event_open, &attr, pid, cpu,
+		       group_fd, flags);
+}
+*/
+import "C"
+
+// tracefsPaths are the places tracefs is found at: its own mount point
+// since Linux 4.1, and debugfs, where it's automounted.
+var tracefsPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// pmuPath is where the dynamic PMUs, such as kprobe, are listed.
+const pmuPath = "/sys/bus/event_source/devices"
+
+var errNoPMU = errors.New("no such PMU")
+
+// tracefsPath returns the directory tracefs is mounted at.
+func tracefsPath() string {
+	for _, path := range tracefsPaths {
+		if _, err := os.Stat(filepath.Join(path, "events")); err == nil {
+			return path
+		}
+	}
+	return tracefsPaths[len(tracefsPaths)-1]
+}
+
+// pmuType returns the perf event type of the dynamic PMU name, or
+// errNoPMU if the kernel doesn't provide it.
+func pmuType(name string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(pmuPath, name, "type"))
+	if os.IsNotExist(err) {
+		return -1, errNoPMU
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error reading type of PMU %q: %v", name, err)
+	}
+	typ, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, fmt.Errorf("invalid type of PMU %q: %v", name, err)
+	}
+	return typ, nil
+}
+
+// pmuConfigBit returns the bit of the config of the dynamic PMU name that
+// enables the format field, e.g. retprobe, given as config:<bit>.
+func pmuConfigBit(name, field string) (uint, error) {
+	data, err := ioutil.ReadFile(filepath.Join(pmuPath, name, "format", field))
+	if err != nil {
+		return 0, fmt.Errorf("error reading format %q of PMU %q: %v", field, name, err)
+	}
+	return parsePMUConfigBit(string(data))
+}
+
+func parsePMUConfigBit(format string) (uint, error) {
+	format = strings.TrimSpace(format)
+	if !strings.HasPrefix(format, "config:") {
+		return 0, fmt.Errorf("unexpected PMU format %q", format)
+	}
+	bit, err := strconv.ParseUint(strings.TrimPrefix(format, "config:"), 10, 8)
+	if err != nil || bit >= 64 {
+		return 0, fmt.Errorf("unexpected PMU format %q", format)
+	}
+	return uint(bit), nil
+}
+
+// openKprobePMU opens the perf event of a kprobe, or kretprobe, on funcName
+// with the kprobe PMU, available since Linux 4.17. Unlike the probes
+// created in tracefs, the probe goes away with the perf event.
+func openKprobePMU(funcName string, retprobe bool) (int, error) {
+	typ, err := pmuType("kprobe")
+	if err != nil {
+		return -1, err
+	}
+	var config uint64
+	if retprobe {
+		bit, err := pmuConfigBit("kprobe", "retprobe")
+		if err != nil {
+			return -1, err
+		}
+		config = 1 << bit
+	}
+
+	funcNameC := C.CString(funcName)
+	defer C.free(unsafe.Pointer(funcNameC))
+	efd, err := C.perf_event_open_kprobe(C.int(typ), C.__u64(config), funcNameC, -1 /* pid */, 0 /* cpu */, -1 /* group_fd */, C.PERF_FLAG_FD_CLOEXEC)
+	if efd < 0 {
+		return -1, fmt.Errorf("perf_event_open error: %v", err)
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_ENABLE, 0); err != 0 {
+		syscall.Close(int(efd))
+		return -1, fmt.Errorf("error enabling perf event: %v", err)
+	}
+	return int(efd), nil
+}
+
+// openKprobe opens the perf event of the kprobe or kretprobe secName,
+// without attaching a program to it. The probe is created with the kprobe
+// PMU, unless the kernel doesn't support it, or a maxactive is given for a
+// kretprobe, which only tracefs allows: the probe is then created in
+// kprobe_events, named after the function followed by eventSuffix. The name
+// of the event is returned for it to be removed once the perf event is
+// closed, and is empty for PMU probes.
+func openKprobe(secName string, maxactive int, eventSuffix string) (int, string, error) {
+	retprobe := strings.HasPrefix(secName, "kretprobe/")
+	probeType, funcName := "p", strings.TrimPrefix(secName, "kprobe/")
+	var maxactiveStr string
+	if retprobe {
+		probeType, funcName = "r", strings.TrimPrefix(secName, "kretprobe/")
+		if maxactive > 0 {
+			maxactiveStr = fmt.Sprintf("%d", maxactive)
+		}
+	}
+
+	if maxactiveStr == "" {
+		efd, err := openKprobePMU(funcName, retprobe)
+		if err != errNoPMU {
+			return efd, "", err
+		}
+	}
+
+	eventName := probeType + funcName + eventSuffix
+	kprobeId, err := writeKprobeEvent(probeType, eventName, funcName, maxactiveStr)
+	// fallback without maxactive
+	if err == kprobeIDNotExist {
+		kprobeId, err = writeKprobeEvent(probeType, eventName, funcName, "")
+	}
+	if err != nil {
+		if maxactiveStr != "" {
+			// no tracefs: make do with the default maxactive
+			if efd, pmuErr := openKprobePMU(funcName, retprobe); pmuErr != errNoPMU {
+				return efd, "", pmuErr
+			}
+		}
+		return -1, "", err
+	}
+	efd, err := openTracepointPerfEvent(kprobeId, -1)
+	if err != nil {
+		disableKprobe(eventName)
+		return -1, "", err
+	}
+	return efd, eventName, nil
+}
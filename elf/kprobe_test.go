@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import "testing"
+
+func TestParsePMUConfigBit(t *testing.T) {
+	tests := []struct {
+		format   string
+		bit      uint
+		hasError bool
+	}{
+		{format: "config:0\n", bit: 0},
+		{format: "config:9", bit: 9},
+		{format: "config1:0-63", hasError: true},
+		{format: "config:64", hasError: true},
+		{format: "config:", hasError: true},
+	}
+
+	for _, tt := range tests {
+		bit, err := parsePMUConfigBit(tt.format)
+		if tt.hasError {
+			if err == nil {
+				t.Fatalf("%q: expected an error", tt.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.format, err)
+		}
+		if bit != tt.bit {
+			t.Fatalf("%q: expected bit %d but got %d", tt.format, tt.bit, bit)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	// src_reg values of calls and 64-bit loads referring to a function,
+	// see include/uapi/linux/bpf.h
+	bpfPseudoCall = 1
+	bpfPseudoFunc = 4
+)
+
+// elfFunc is a function of an executable section, after relocation.
+type elfFunc struct {
+	name    string
+	secName string
+	section elf.SectionIndex
+	start   int // instruction index within the section
+	insns   []byte
+	calls   []elfCall
+}
+
+// elfCall is a call, or a reference by a 64-bit load, to another function.
+type elfCall struct {
+	insn   int // instruction index within the calling function
+	target *elfFunc
+}
+
+// elfCallTarget is the instruction a call relocation points to.
+type elfCallTarget struct {
+	section elf.SectionIndex
+	insn    int
+}
+
+// elfProgram is a program ready to be loaded: the instructions of its
+// function followed by those of the functions it calls.
+type elfProgram struct {
+	entry     *elfFunc
+	insns     []byte
+	funcInfos []btfFuncInfo
+	lineInfos []btfLineInfo
+}
+
+func insnSrcReg(insn []byte, bo binary.ByteOrder) uint8 {
+	if bo == binary.BigEndian {
+		return insn[1] & 0x0f
+	}
+	return insn[1] >> 4
+}
+
+func setInsnSrcReg(insn []byte, src uint8, bo binary.ByteOrder) {
+	if bo == binary.BigEndian {
+		insn[1] = insn[1]&0xf0 | src
+	} else {
+		insn[1] = insn[1]&0x0f | src<<4
+	}
+}
+
+func isCallInsn(insn []byte) bool {
+	return insn[0] == bpfClassJMP|bpfOpCall
+}
+
+func isLdImm64Insn(insn []byte) bool {
+	return insn[0] == bpfClassLD|bpfSizeDW|bpfModeIMM
+}
+
+// splitFunctions splits the instructions of an executable section at the
+// function symbols it contains. Sections without function symbols, as
+// produced by old compilers, hold a single function named after the
+// section.
+func splitFunctions(secName string, section elf.SectionIndex, data []byte, symbols []elf.Symbol) ([]*elfFunc, error) {
+	var syms []elf.Symbol
+	for _, sym := range symbols {
+		if sym.Section == section && elf.ST_TYPE(sym.Info) == elf.STT_FUNC {
+			syms = append(syms, sym)
+		}
+	}
+	if len(syms) == 0 {
+		return []*elfFunc{{name: secName, secName: secName, section: section, insns: data}}, nil
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Value < syms[j].Value })
+
+	funcs := make([]*elfFunc, 0, len(syms))
+	for i, sym := range syms {
+		end := uint64(len(data))
+		if i+1 < len(syms) {
+			end = syms[i+1].Value
+		}
+		if sym.Size > 0 && sym.Value+sym.Size < end {
+			end = sym.Value + sym.Size
+		}
+		if sym.Value%bpfInsnLen != 0 || end%bpfInsnLen != 0 || end > uint64(len(data)) || sym.Value >= end {
+			return nil, fmt.Errorf("function %q has invalid bounds [%d, %d) in section %q", sym.Name, sym.Value, end, secName)
+		}
+		funcs = append(funcs, &elfFunc{
+			name:    sym.Name,
+			secName: secName,
+			section: section,
+			start:   int(sym.Value / bpfInsnLen),
+			insns:   data[sym.Value:end],
+		})
+	}
+	return funcs, nil
+}
+
+// resolveCalls finds the calls of each function to other functions. Calls
+// with a relocation, i.e. to functions of other sections or to global
+// functions, are looked up in relocs; other calls are relative to the
+// calling instruction.
+func resolveCalls(funcs []*elfFunc, relocs map[elf.SectionIndex]map[int]elfCallTarget, bo binary.ByteOrder) error {
+	starts := make(map[elfCallTarget]*elfFunc, len(funcs))
+	for _, fn := range funcs {
+		starts[elfCallTarget{fn.section, fn.start}] = fn
+	}
+
+	for _, fn := range funcs {
+		fn.calls = nil
+		for i := 0; i < len(fn.insns)/bpfInsnLen; i++ {
+			insn := fn.insns[i*bpfInsnLen:]
+			src := insnSrcReg(insn, bo)
+			isCall := isCallInsn(insn) && src == bpfPseudoCall
+			isFunc := isLdImm64Insn(insn) && src == bpfPseudoFunc
+			if !isCall && !isFunc {
+				continue
+			}
+
+			target, ok := relocs[fn.section][fn.start+i]
+			if !ok {
+				imm := int32(bo.Uint32(insn[4:]))
+				target = elfCallTarget{fn.section, fn.start + i + int(imm) + 1}
+			}
+			callee, ok := starts[target]
+			if !ok {
+				return fmt.Errorf("function %q: call at instruction %d doesn't target a function", fn.name, i)
+			}
+			fn.calls = append(fn.calls, elfCall{insn: i, target: callee})
+		}
+	}
+	return nil
+}
+
+// linkProgram returns the instructions of the entry function followed by
+// those of the functions it calls, directly or not, with the call offsets
+// and the BTF function and line information adjusted accordingly.
+func linkProgram(entry *elfFunc, ext *btfExt, bo binary.ByteOrder) *elfProgram {
+	prog := &elfProgram{entry: entry}
+	pos := make(map[*elfFunc]int)
+	queue := []*elfFunc{entry}
+	pos[entry] = 0
+	for i := 0; i < len(queue); i++ {
+		fn := queue[i]
+		start := len(prog.insns) / bpfInsnLen
+		pos[fn] = start
+		prog.insns = append(prog.insns, fn.insns...)
+
+		if ext != nil {
+			end := uint32(fn.start + len(fn.insns)/bpfInsnLen)
+			for _, fi := range ext.funcInfos[fn.secName] {
+				if fi.insnOff >= uint32(fn.start) && fi.insnOff < end {
+					fi.insnOff = fi.insnOff - uint32(fn.start) + uint32(start)
+					prog.funcInfos = append(prog.funcInfos, fi)
+				}
+			}
+			for _, li := range ext.lineInfos[fn.secName] {
+				if li.insnOff >= uint32(fn.start) && li.insnOff < end {
+					li.insnOff = li.insnOff - uint32(fn.start) + uint32(start)
+					prog.lineInfos = append(prog.lineInfos, li)
+				}
+			}
+		}
+
+		for _, call := range fn.calls {
+			if _, ok := pos[call.target]; !ok {
+				pos[call.target] = -1
+				queue = append(queue, call.target)
+			}
+		}
+	}
+
+	for _, fn := range queue {
+		for _, call := range fn.calls {
+			idx := pos[fn] + call.insn
+			insn := prog.insns[idx*bpfInsnLen:]
+			bo.PutUint32(insn[4:], uint32(int32(pos[call.target]-(idx+1))))
+		}
+	}
+	return prog
+}
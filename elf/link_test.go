@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLinkProgram(t *testing.T) {
+	bo := binary.LittleEndian
+	const (
+		progSec elf.SectionIndex = 3
+		textSec elf.SectionIndex = 4
+		exit                     = bpfClassJMP | 0x90
+		mov                      = bpfClassALU64 | 0xb0
+	)
+	call := func(imm int32) []byte {
+		insn := testInsn(bpfClassJMP|bpfOpCall, 0, imm)
+		setInsnSrcReg(insn, bpfPseudoCall, bo)
+		return insn
+	}
+
+	// kprobe/foo: prog calls helper in .text (through a relocation)
+	progData := bytes.Join([][]byte{
+		testInsn(mov, 0, 0),
+		call(-1),
+		testInsn(exit, 0, 0),
+	}, nil)
+	// .text: unused, then helper which calls static_fn
+	textData := bytes.Join([][]byte{
+		testInsn(mov, 0, 1), // unused
+		testInsn(exit, 0, 0),
+		call(1), // helper -> static_fn
+		testInsn(exit, 0, 0),
+		testInsn(mov, 0, 2), // static_fn
+		testInsn(exit, 0, 0),
+	}, nil)
+	symbols := []elf.Symbol{
+		{Name: "prog", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Section: progSec, Value: 0, Size: 24},
+		{Name: "unused", Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FUNC), Section: textSec, Value: 0, Size: 16},
+		{Name: "static_fn", Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FUNC), Section: textSec, Value: 32, Size: 16},
+		{Name: "helper", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Section: textSec, Value: 16, Size: 16},
+	}
+
+	progFuncs, err := splitFunctions("kprobe/foo", progSec, progData, symbols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textFuncs, err := splitFunctions(".text", textSec, textData, symbols)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progFuncs) != 1 || len(textFuncs) != 3 || textFuncs[1].name != "helper" || textFuncs[1].start != 2 {
+		t.Fatalf("unexpected functions: %+v %+v", progFuncs, textFuncs)
+	}
+
+	relocs := map[elf.SectionIndex]map[int]elfCallTarget{
+		progSec: {1: {textSec, 2}},
+	}
+	funcs := append(progFuncs, textFuncs...)
+	if err := resolveCalls(funcs, relocs, bo); err != nil {
+		t.Fatal(err)
+	}
+
+	ext := &btfExt{
+		funcInfos: map[string][]btfFuncInfo{
+			"kprobe/foo": {{insnOff: 0, typeID: 10}},
+			".text":      {{insnOff: 0, typeID: 11}, {insnOff: 2, typeID: 12}, {insnOff: 4, typeID: 13}},
+		},
+		lineInfos: map[string][]btfLineInfo{
+			".text": {{insnOff: 5, lineOff: 42}},
+		},
+	}
+	prog := linkProgram(progFuncs[0], ext, bo)
+
+	// prog, helper, static_fn
+	if got := len(prog.insns) / bpfInsnLen; got != 7 {
+		t.Fatalf("expected 7 instructions, got %d", got)
+	}
+	imm := func(i int) int32 { return int32(bo.Uint32(prog.insns[i*bpfInsnLen+4:])) }
+	if imm(1) != 1 {
+		t.Errorf("call to helper: expected imm 1, got %d", imm(1))
+	}
+	if imm(3) != 1 {
+		t.Errorf("call to static_fn: expected imm 1, got %d", imm(3))
+	}
+	if imm(5) != 2 {
+		t.Errorf("expected static_fn body at instruction 5")
+	}
+
+	wantFuncs := []btfFuncInfo{{0, 10}, {3, 12}, {5, 13}}
+	if len(prog.funcInfos) != len(wantFuncs) {
+		t.Fatalf("unexpected func info: %+v", prog.funcInfos)
+	}
+	for i, fi := range prog.funcInfos {
+		if fi != wantFuncs[i] {
+			t.Errorf("func info %d: got %+v, want %+v", i, fi, wantFuncs[i])
+		}
+	}
+	if len(prog.lineInfos) != 1 || prog.lineInfos[0].insnOff != 6 {
+		t.Errorf("unexpected line info: %+v", prog.lineInfos)
+	}
+
+	// the section data itself is left untouched
+	if int32(bo.Uint32(progData[bpfInsnLen+4:])) != -1 {
+		t.Error("linking modified the section data")
+	}
+}
+
+func TestSplitFunctionsNoSymbols(t *testing.T) {
+	data := make([]byte, 2*bpfInsnLen)
+	funcs, err := splitFunctions("xdp/prog", 1, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(funcs) != 1 || funcs[0].name != "xdp/prog" || len(funcs[0].insns) != len(data) {
+		t.Errorf("unexpected functions: %+v", funcs)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// LSMPath lists the active Linux security modules, see
+// Documentation/admin-guide/LSM/index.rst.
+const LSMPath = "/sys/kernel/security/lsm"
+
+// CheckBPFLSM returns an error describing why BPF LSM programs can't be
+// enforced on this kernel: they are loaded and attached even if the BPF
+// LSM isn't active, but never run.
+func CheckBPFLSM() error {
+	data, err := ioutil.ReadFile(LSMPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("BPF LSM unavailable: %s doesn't exist, securityfs isn't mounted or the kernel was built without CONFIG_SECURITY", LSMPath)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading active LSMs: %v", err)
+	}
+	return checkBPFLSM(string(data))
+}
+
+func checkBPFLSM(lsms string) error {
+	lsms = strings.TrimSpace(lsms)
+	for _, lsm := range strings.Split(lsms, ",") {
+		if lsm == "bpf" {
+			return nil
+		}
+	}
+	return fmt.Errorf("BPF LSM not active: %q is missing from the active LSMs %q, "+
+		"it requires CONFIG_BPF_LSM and bpf in the lsm= kernel parameter or CONFIG_LSM", "bpf", lsms)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import "testing"
+
+func TestCheckBPFLSM(t *testing.T) {
+	for _, lsms := range []string{"lockdown,capability,bpf\n", "bpf"} {
+		if err := checkBPFLSM(lsms); err != nil {
+			t.Errorf("%q: %v", lsms, err)
+		}
+	}
+	for _, lsms := range []string{"lockdown,capability,yama,apparmor\n", "", "bpf_foo"} {
+		if err := checkBPFLSM(lsms); err == nil {
+			t.Errorf("%q: expected error", lsms)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+#include <stdlib.h>
+*/
+import "C"
+
+func isMapInMap(m *Map) bool {
+	return m.m.def._type == C.BPF_MAP_TYPE_ARRAY_OF_MAPS || m.m.def._type == C.BPF_MAP_TYPE_HASH_OF_MAPS
+}
+
+// initializeMapInMaps stores the maps BTF-defined map-in-maps are
+// initialised with, as returned by mapInitValues, in them.
+func (b *Module) initializeMapInMaps(inits map[string]map[uint32]string) error {
+	for name, values := range inits {
+		outer, ok := b.maps[name]
+		if !ok || !isMapInMap(outer) {
+			continue
+		}
+		for index, innerName := range values {
+			inner, ok := b.maps[innerName]
+			if !ok {
+				return fmt.Errorf("map %q: no map %q for value %d", name, innerName, index)
+			}
+			if err := b.SetInnerMap(outer, unsafe.Pointer(&index), inner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateInnerMap creates a map that matches the inner map definition of the
+// ARRAY_OF_MAPS or HASH_OF_MAPS map outer, to be stored in it with
+// SetInnerMap. The map isn't part of the module: the caller closes it with
+// CloseInnerMap, which it can do as soon as the map is stored since the
+// outer map holds a reference to it.
+func (b *Module) CreateInnerMap(outer *Map) (*Map, error) {
+	if !isMapInMap(outer) || outer.inner == nil {
+		return nil, fmt.Errorf("map %q is not a map-in-map", outer.Name)
+	}
+	return newInnerMap(outer)
+}
+
+// SetInnerMap stores the map inner in key of the map-in-map outer, replacing
+// the map previously stored there. Looking key up in outer then returns the
+// ID of inner, not a file descriptor.
+func (b *Module) SetInnerMap(outer *Map, key unsafe.Pointer, inner *Map) error {
+	if !isMapInMap(outer) {
+		return fmt.Errorf("map %q is not a map-in-map", outer.Name)
+	}
+	fd := uint32(inner.m.fd)
+	if err := b.UpdateElement(outer, key, unsafe.Pointer(&fd), C.BPF_ANY); err != nil {
+		return fmt.Errorf("error storing map %q in %q: %v", inner.Name, outer.Name, err)
+	}
+	return nil
+}
+
+// DeleteInnerMap removes the map stored in key of the map-in-map outer. The
+// kernel frees the inner map once no program uses it anymore and it isn't
+// open or stored elsewhere.
+func (b *Module) DeleteInnerMap(outer *Map, key unsafe.Pointer) error {
+	if !isMapInMap(outer) {
+		return fmt.Errorf("map %q is not a map-in-map", outer.Name)
+	}
+	if err := b.DeleteElement(outer, key); err != nil {
+		return fmt.Errorf("error removing inner map from %q: %v", outer.Name, err)
+	}
+	return nil
+}
+
+// CloseInnerMap closes a map created with CreateInnerMap.
+func (b *Module) CloseInnerMap(inner *Map) error {
+	if inner.m == nil {
+		return nil
+	}
+	err := syscall.Close(int(inner.m.fd))
+	C.free(unsafe.Pointer(inner.m))
+	inner.m = nil
+	if err != nil {
+		return fmt.Errorf("error closing map fd: %v", err)
+	}
+	return nil
+}
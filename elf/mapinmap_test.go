@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// buildMapsELF returns an object with a legacy map definition section
+// per map, keyed by section name.
+func buildMapsELF(t *testing.T, maps map[string][]uint32) *elf.File {
+	bo := binary.LittleEndian
+	shstrtab := []byte{0}
+	var names []string
+	for name := range maps {
+		names = append(names, name)
+	}
+
+	var data bytes.Buffer
+	headers := []elf.Section64{{}}
+	off := uint64(binary.Size(elf.Header64{}))
+	for _, name := range names {
+		// struct bpf_map_def: the fields, then the namespace
+		def := make([]byte, 6*4+256)
+		for i, v := range maps[name] {
+			bo.PutUint32(def[i*4:], v)
+		}
+		headers = append(headers, elf.Section64{
+			Name:      uint32(len(shstrtab)),
+			Type:      uint32(elf.SHT_PROGBITS),
+			Off:       off + uint64(data.Len()),
+			Size:      uint64(len(def)),
+			Addralign: 4,
+		})
+		shstrtab = append(shstrtab, name+"\x00"...)
+		data.Write(def)
+	}
+	headers = append(headers, elf.Section64{
+		Name:      uint32(len(shstrtab)),
+		Type:      uint32(elf.SHT_STRTAB),
+		Off:       off + uint64(data.Len()),
+		Size:      uint64(len(shstrtab) + len(".shstrtab") + 1),
+		Addralign: 1,
+	})
+	shstrtab = append(shstrtab, ".shstrtab\x00"...)
+	data.Write(shstrtab)
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_BPF),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     off + uint64(data.Len()),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     uint16(len(headers)),
+		Shstrndx:  uint16(len(headers) - 1),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, bo, header)
+	buf.Write(data.Bytes())
+	binary.Write(&buf, bo, headers)
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCreateInnerMapPinnedTemplate(t *testing.T) {
+	pinPath := fmt.Sprintf("gobpf-test-%d/inner", os.Getpid())
+	defer os.RemoveAll(filepath.Join(BPFFSPath, filepath.Dir(pinPath)))
+
+	b := newModule(0)
+	// type, key size, value size, max entries, flags, pinning
+	b.file = buildMapsELF(t, map[string][]uint32{
+		"maps/inner": {2, 4, 4, 1, 0, PIN_CUSTOM_NS},
+		"maps/outer": {12, 4, 4, 1, 0, PIN_NONE},
+	})
+	maps, err := b.elfReadMaps(map[string]SectionParams{
+		"maps/inner": {PinPath: pinPath},
+		"maps/outer": {InnerMap: "inner"},
+	})
+	if err != nil {
+		t.Skipf("cannot create maps: %v", err)
+	}
+	b.maps = maps
+	defer b.closeMaps(nil)
+
+	// the maps created from the template aren't pinned themselves
+	inner, err := b.CreateInnerMap(maps["outer"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.CloseInnerMap(inner)
+	var key uint32
+	if err := b.SetInnerMap(maps["outer"], unsafe.Pointer(&key), inner); err != nil {
+		t.Fatal(err)
+	}
+}
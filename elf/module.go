@@ -23,14 +23,18 @@ import (
 	"debug/elf"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"unsafe"
+
+	"github.com/vietanhduong/gobpf/pkg/cpuonline"
 )
 
 /*
@@ -54,6 +58,8 @@ import (
 #include <linux/if_link.h>
 #include <linux/rtnetlink.h>
 
+extern __u64 ptr_to_u64(void *);
+
 static int perf_event_open_tracepoint(int tracepoint_id, int pid, int cpu,
                            int group_fd, unsigned long flags)
 {
@@ -68,6 +74,49 @@ static int perf_event_open_tracepoint(int tracepoint_id, int pid, int cpu,
                       group_fd, flags);
 }
 
+static int perf_event_open_sampling(uint32_t ev_type, uint64_t ev_config,
+                           uint64_t sample_period, uint64_t sample_freq,
+                           int pid, int cpu, unsigned long flags)
+{
+	struct perf_event_attr attr = {0,};
+	attr.size = sizeof(attr);
+	attr.type = ev_type;
+	attr.config = ev_config;
+	if (sample_freq > 0) {
+		attr.freq = 1;
+		attr.sample_freq = sample_freq;
+	} else {
+		attr.sample_period = sample_period;
+	}
+
+	return syscall(__NR_perf_event_open, &attr, pid, cpu,
+                      -1, flags);
+}
+
+int bpf_raw_tracepoint_open(const char *name, int prog_fd)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.raw_tracepoint.name = ptr_to_u64((void *)name);
+	attr.raw_tracepoint.prog_fd = prog_fd;
+
+	return syscall(__NR_bpf, BPF_RAW_TRACEPOINT_OPEN, &attr, sizeof(attr));
+}
+
+int bpf_link_create(int prog_fd, int target_fd, enum bpf_attach_type type, __u32 flags)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.link_create.prog_fd = prog_fd;
+	attr.link_create.target_fd = target_fd;
+	attr.link_create.attach_type = type;
+	attr.link_create.flags = flags;
+
+	return syscall(__NR_bpf, BPF_LINK_CREATE, &attr, sizeof(attr));
+}
+
 int bpf_prog_attach(int prog_fd, int target_fd, enum bpf_attach_type type)
 {
 	union bpf_attr attr;
@@ -102,10 +151,9 @@ int bpf_detach_socket(int sock, int fd)
 	return setsockopt(sock, SOL_SOCKET, SO_DETACH_BPF, &fd, sizeof(fd));
 }
 
-int bpf_attach_xdp(const char *dev_name, int progfd, uint32_t flags)
+int bpf_attach_xdp(const char *dev_name, int progfd, uint32_t flags, int old_fd)
 {
   	int ifindex = if_nametoindex(dev_name);
-  	char err_buf[256];
   	int ret = -1;
 
   	if (ifindex == 0) {
@@ -113,9 +161,10 @@ int bpf_attach_xdp(const char *dev_name, int progfd, uint32_t flags)
     		return -1;
   	}
 
-  	ret = bpf_set_link_xdp_fd(ifindex, progfd, flags);
+  	ret = bpf_set_link_xdp_fd_opts(ifindex, progfd, flags, old_fd);
   	if (ret) {
-    		fprintf(stderr, "bpf: Attaching prog to %s: %s", dev_name, err_buf);
+    		fprintf(stderr, "bpf: Attaching prog to %s: %s\n", dev_name, strerror(-ret));
+    		errno = -ret;
     		return -1;
   	}
 
@@ -136,8 +185,31 @@ type Module struct {
 	cgroupPrograms     map[string]*CgroupProgram
 	socketFilters      map[string]*SocketFilter
 	tracepointPrograms map[string]*TracepointProgram
+	rawTracepoints     map[string]*RawTracepointProgram
+	perfEventPrograms  map[string]*PerfEventProgram
+	tracingPrograms    map[string]*TracingProgram
+	lsmPrograms        map[string]*LSMProgram
+	sockMapPrograms    map[string]*SockMapProgram
 	schedPrograms      map[string]*SchedProgram
 	xdpPrograms        map[string]*XDPProgram
+	programs           map[string]*Program
+
+	// type information from the .BTF and .BTF.ext sections
+	btf    *btfSpec
+	btfExt *btfExt
+	btfFd  int
+
+	// kernelBTF is the BTF CO-RE relocations are applied against, read
+	// from kernelBTFPath or DefaultKernelBTFPath
+	kernelBTF     *btfSpec
+	kernelBTFPath string
+	// vmlinuxBTF is the BTF of the running kernel, read from
+	// DefaultKernelBTFPath, which the BTF IDs programs attach to refer to
+	// whatever kernelBTFPath is
+	vmlinuxBTF *btfSpec
+
+	// objectID names the directory of PIN_OBJECT_NS maps in BPFFSPath
+	objectID string
 
 	compatProbe bool // try to be automatically convert function names depending on kernel versions (SyS_ and __x64_sys_)
 }
@@ -149,6 +221,9 @@ type Kprobe struct {
 	insns *C.struct_bpf_insn
 	fd    int
 	efd   int
+	// eventName is the kprobe_events entry of the probe, if it was
+	// created in tracefs
+	eventName string
 }
 
 type Uprobe struct {
@@ -156,6 +231,9 @@ type Uprobe struct {
 	insns *C.struct_bpf_insn
 	fd    int
 	efds  map[string]int
+	// semaphores of the USDT probes the uprobe is attached to, incremented
+	// in their processes
+	semaphores []usdtSemaphore
 }
 
 type AttachType int
@@ -164,11 +242,72 @@ const (
 	IngressType AttachType = iota
 	EgressType
 	SockCreateType
+
+	SockOpsType    AttachType = C.BPF_CGROUP_SOCK_OPS
+	DeviceType     AttachType = C.BPF_CGROUP_DEVICE
+	Bind4Type      AttachType = C.BPF_CGROUP_INET4_BIND
+	Bind6Type      AttachType = C.BPF_CGROUP_INET6_BIND
+	Connect4Type   AttachType = C.BPF_CGROUP_INET4_CONNECT
+	Connect6Type   AttachType = C.BPF_CGROUP_INET6_CONNECT
+	PostBind4Type  AttachType = C.BPF_CGROUP_INET4_POST_BIND
+	PostBind6Type  AttachType = C.BPF_CGROUP_INET6_POST_BIND
+	Sendmsg4Type   AttachType = C.BPF_CGROUP_UDP4_SENDMSG
+	Sendmsg6Type   AttachType = C.BPF_CGROUP_UDP6_SENDMSG
+	SysctlType     AttachType = C.BPF_CGROUP_SYSCTL
+	Recvmsg4Type   AttachType = C.BPF_CGROUP_UDP4_RECVMSG
+	Recvmsg6Type   AttachType = C.BPF_CGROUP_UDP6_RECVMSG
+	GetsockoptType AttachType = C.BPF_CGROUP_GETSOCKOPT
+	SetsockoptType AttachType = C.BPF_CGROUP_SETSOCKOPT
 )
 
+// cgroupAttachTypes are the attach types implied by the names of cgroup
+// program sections. cgroup/skb and cgroup/sock programs may be attached in
+// several ways and aren't listed.
+var cgroupAttachTypes = map[string]AttachType{
+	"sockops":           SockOpsType,
+	"cgroup/dev":        DeviceType,
+	"cgroup/bind4":      Bind4Type,
+	"cgroup/bind6":      Bind6Type,
+	"cgroup/connect4":   Connect4Type,
+	"cgroup/connect6":   Connect6Type,
+	"cgroup/post_bind4": PostBind4Type,
+	"cgroup/post_bind6": PostBind6Type,
+	"cgroup/sendmsg4":   Sendmsg4Type,
+	"cgroup/sendmsg6":   Sendmsg6Type,
+	"cgroup/recvmsg4":   Recvmsg4Type,
+	"cgroup/recvmsg6":   Recvmsg6Type,
+	"cgroup/sysctl":     SysctlType,
+	"cgroup/getsockopt": GetsockoptType,
+	"cgroup/setsockopt": SetsockoptType,
+}
+
+// cgroupAttachType returns the attach type implied by the name of a cgroup
+// program section, see matchSection.
+func cgroupAttachType(secName string) (AttachType, bool) {
+	for name, attachType := range cgroupAttachTypes {
+		if matchSection(secName, name) {
+			return attachType, true
+		}
+	}
+	return 0, false
+}
+
+// matchSection tells whether the section is named after one of the given
+// names, which may be followed by a slash and a name, e.g.
+// cgroup/connect4/proxy.
+func matchSection(secName string, names ...string) bool {
+	for _, name := range names {
+		if secName == name || strings.HasPrefix(secName, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 const defaultLogSize uint32 = 524288
 
-// CgroupProgram represents a cgroup skb/sock program
+// CgroupProgram represents a cgroup program: skb, sock, sock_addr, sockopt,
+// sysctl, device or sock_ops
 type CgroupProgram struct {
 	Name  string
 	insns *C.struct_bpf_insn
@@ -190,6 +329,40 @@ type TracepointProgram struct {
 	efd   int
 }
 
+// RawTracepointProgram represents a raw tracepoint program
+type RawTracepointProgram struct {
+	Name  string
+	insns *C.struct_bpf_insn
+	fd    int
+	efd   int
+}
+
+// PerfEventProgram represents a program run on the samples of perf events
+type PerfEventProgram struct {
+	Name  string
+	insns *C.struct_bpf_insn
+	fd    int
+	efds  []int
+}
+
+// TracingProgram represents a fentry, fexit or fmod_ret program, attached
+// to a kernel function through a BPF trampoline
+type TracingProgram struct {
+	Name  string
+	insns *C.struct_bpf_insn
+	fd    int
+	efd   int
+}
+
+// LSMProgram represents a BPF LSM program, attached to the LSM hook its
+// section is named after
+type LSMProgram struct {
+	Name  string
+	insns *C.struct_bpf_insn
+	fd    int
+	efd   int
+}
+
 // SchedProgram represents a traffic classifier program
 type SchedProgram struct {
 	Name  string
@@ -204,6 +377,24 @@ type XDPProgram struct {
 	fd    int
 }
 
+// Program represents a program of any type, identified by the name of its
+// function. Sections may hold several programs.
+type Program struct {
+	Name        string
+	SectionName string
+	insns       *C.struct_bpf_insn
+	fd          int
+
+	// typed is set when the program is also available through the
+	// accessors of its type, which then own the fd
+	typed bool
+
+	// pinPath is set for programs pinned according to their section's
+	// ProgramPinning parameter
+	pinPath string
+	reused  bool
+}
+
 func newModule(logSize uint32) *Module {
 	return &Module{
 		probes:             make(map[string]*Kprobe),
@@ -211,9 +402,16 @@ func newModule(logSize uint32) *Module {
 		cgroupPrograms:     make(map[string]*CgroupProgram),
 		socketFilters:      make(map[string]*SocketFilter),
 		tracepointPrograms: make(map[string]*TracepointProgram),
+		rawTracepoints:     make(map[string]*RawTracepointProgram),
+		perfEventPrograms:  make(map[string]*PerfEventProgram),
+		tracingPrograms:    make(map[string]*TracingProgram),
+		lsmPrograms:        make(map[string]*LSMProgram),
+		sockMapPrograms:    make(map[string]*SockMapProgram),
 		schedPrograms:      make(map[string]*SchedProgram),
 		xdpPrograms:        make(map[string]*XDPProgram),
+		programs:           make(map[string]*Program),
 		log:                make([]byte, logSize),
+		btfFd:              -1,
 	}
 }
 
@@ -244,7 +442,7 @@ func NewModuleFromReader(fileReader io.ReaderAt) *Module {
 var kprobeIDNotExist error = errors.New("kprobe id file doesn't exist")
 
 func writeKprobeEvent(probeType, eventName, funcName, maxactiveStr string) (int, error) {
-	kprobeEventsFileName := "/sys/kernel/debug/tracing/kprobe_events"
+	kprobeEventsFileName := filepath.Join(tracefsPath(), "kprobe_events")
 	f, err := os.OpenFile(kprobeEventsFileName, os.O_APPEND|os.O_WRONLY, 0o666)
 	if err != nil {
 		return -1, fmt.Errorf("cannot open kprobe_events: %v", err)
@@ -256,7 +454,7 @@ func writeKprobeEvent(probeType, eventName, funcName, maxactiveStr string) (int,
 		return -1, fmt.Errorf("cannot write %q to kprobe_events: %v", cmd, err)
 	}
 
-	kprobeIdFile := fmt.Sprintf("/sys/kernel/debug/tracing/events/kprobes/%s/id", eventName)
+	kprobeIdFile := filepath.Join(tracefsPath(), "events/kprobes", eventName, "id")
 	kprobeIdBytes, err := ioutil.ReadFile(kprobeIdFile)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -273,21 +471,28 @@ func writeKprobeEvent(probeType, eventName, funcName, maxactiveStr string) (int,
 	return kprobeId, nil
 }
 
-func writeUprobeEvent(probeType, eventName, path string, offset uint64) (int, error) {
-	uprobeEventsFileName := "/sys/kernel/debug/tracing/uprobe_events"
+// writeUprobeEvent creates the uprobe event at offset in the file at path.
+// A non-zero refCtrOffset is the offset in the file of a semaphore the
+// kernel increments in the processes the probe is hit in, since Linux 4.20.
+func writeUprobeEvent(probeType, eventName, path string, offset, refCtrOffset uint64) (int, error) {
+	uprobeEventsFileName := filepath.Join(tracefsPath(), "uprobe_events")
 	f, err := os.OpenFile(uprobeEventsFileName, os.O_APPEND|os.O_WRONLY, 0o666)
 	if err != nil {
 		return -1, fmt.Errorf("cannot open uprobe_events: %v", err)
 	}
 	defer f.Close()
 
-	cmd := fmt.Sprintf("%s:%s %s:%#x\n", probeType, eventName, path, offset)
+	cmd := fmt.Sprintf("%s:%s %s:%#x", probeType, eventName, path, offset)
+	if refCtrOffset != 0 {
+		cmd += fmt.Sprintf("(%#x)", refCtrOffset)
+	}
+	cmd += "\n"
 
 	if _, err = f.WriteString(cmd); err != nil {
 		return -1, fmt.Errorf("cannot write %q to uprobe_events: %v", cmd, err)
 	}
 
-	uprobeIdFile := fmt.Sprintf("/sys/kernel/debug/tracing/events/uprobes/%s/id", eventName)
+	uprobeIdFile := filepath.Join(tracefsPath(), "events/uprobes", eventName, "id")
 	uprobeIdBytes, err := ioutil.ReadFile(uprobeIdFile)
 	if err != nil {
 		return -1, fmt.Errorf("cannot read uprobe id: %v", err)
@@ -301,19 +506,38 @@ func writeUprobeEvent(probeType, eventName, path string, offset uint64) (int, er
 	return uprobeId, nil
 }
 
-func perfEventOpenTracepoint(id int, progFd int) (int, error) {
-	efd, err := C.perf_event_open_tracepoint(C.int(id), -1 /* pid */, 0 /* cpu */, -1 /* group_fd */, C.PERF_FLAG_FD_CLOEXEC)
+func perfEventOpenTracepoint(id int, progFd int, pid int) (int, error) {
+	efd, err := openTracepointPerfEvent(id, pid)
+	if err != nil {
+		return -1, err
+	}
+
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_SET_BPF, uintptr(progFd)); err != 0 {
+		syscall.Close(efd)
+		return -1, fmt.Errorf("error attaching bpf program to perf event: %v", err)
+	}
+	return int(efd), nil
+}
+
+// openTracepointPerfEvent opens and enables the perf event of the
+// tracepoint, or kprobe or uprobe event, id. The event is restricted to the
+// process pid if it's positive.
+func openTracepointPerfEvent(id int, pid int) (int, error) {
+	cpu := 0
+	if pid > 0 {
+		cpu = -1
+	} else {
+		pid = -1
+	}
+	efd, err := C.perf_event_open_tracepoint(C.int(id), C.int(pid), C.int(cpu), -1 /* group_fd */, C.PERF_FLAG_FD_CLOEXEC)
 	if efd < 0 {
 		return -1, fmt.Errorf("perf_event_open error: %v", err)
 	}
 
 	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_ENABLE, 0); err != 0 {
+		syscall.Close(int(efd))
 		return -1, fmt.Errorf("error enabling perf event: %v", err)
 	}
-
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_SET_BPF, uintptr(progFd)); err != 0 {
-		return -1, fmt.Errorf("error attaching bpf program to perf event: %v", err)
-	}
 	return int(efd), nil
 }
 
@@ -330,48 +554,49 @@ func (b *Module) EnableOptionCompatProbe() {
 	b.compatProbe = true
 }
 
+// SetObjectID sets the ID of the module's object, which is the directory
+// its PIN_OBJECT_NS maps are pinned in: /sys/fs/bpf/<id>/<map>. It defaults
+// to the name of the ELF file without extension, and must be set for
+// modules created from a reader. It must be called before Load and must not
+// contain a slash. Loading another module with the same object ID reuses
+// the pinned maps.
+func (b *Module) SetObjectID(id string) {
+	b.objectID = id
+}
+
 // EnableKprobe enables a kprobe/kretprobe identified by secName.
 // For kretprobes, you can configure the maximum number of instances
 // of the function that can be probed simultaneously with maxactive.
 // If maxactive is 0 it will be set to the default value: if CONFIG_PREEMPT is
 // enabled, this is max(10, 2*NR_CPUS); otherwise, it is NR_CPUS.
 // For kprobes, maxactive is ignored.
+//
+// Probes are created with the kprobe PMU, and go away with the module or
+// the process. On kernels without it, before 4.17, or when maxactive is set
+// for a kretprobe, they're created in kprobe_events of tracefs instead.
 func (b *Module) EnableKprobe(secName string, maxactive int) error {
-	var probeType, funcName string
-	isKretprobe := strings.HasPrefix(secName, "kretprobe/")
 	probe, ok := b.probes[secName]
 	if !ok {
 		return fmt.Errorf("no such kprobe %q", secName)
 	}
-	progFd := probe.fd
-	var maxactiveStr string
-	if isKretprobe {
-		probeType = "r"
-		funcName = strings.TrimPrefix(secName, "kretprobe/")
-		if maxactive > 0 {
-			maxactiveStr = fmt.Sprintf("%d", maxactive)
-		}
-	} else {
-		probeType = "p"
-		funcName = strings.TrimPrefix(secName, "kprobe/")
-	}
-	eventName := probeType + funcName
 
-	kprobeId, err := writeKprobeEvent(probeType, eventName, funcName, maxactiveStr)
-	// fallback without maxactive
-	if err == kprobeIDNotExist {
-		kprobeId, err = writeKprobeEvent(probeType, eventName, funcName, "")
-	}
+	efd, eventName, err := openKprobe(secName, maxactive, "")
 	if err != nil {
 		return err
 	}
-
-	probe.efd, err = perfEventOpenTracepoint(kprobeId, progFd)
-	return err
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_SET_BPF, uintptr(probe.fd)); err != 0 {
+		syscall.Close(efd)
+		if eventName != "" {
+			disableKprobe(eventName)
+		}
+		return fmt.Errorf("error attaching bpf program to perf event: %v", err)
+	}
+	probe.efd, probe.eventName = efd, eventName
+	return nil
 }
 
 func writeTracepointEvent(category, name string) (int, error) {
-	tracepointIdFile := fmt.Sprintf("/sys/kernel/debug/tracing/events/%s/%s/id", category, name)
+	tracepointIdFile := filepath.Join(tracefsPath(), "events", category, name, "id")
 	tracepointIdBytes, err := ioutil.ReadFile(tracepointIdFile)
 	if err != nil {
 		return -1, fmt.Errorf("cannot read tracepoint id %q: %v", tracepointIdFile, err)
@@ -404,10 +629,134 @@ func (b *Module) EnableTracepoint(secName string) error {
 		return err
 	}
 
-	prog.efd, err = perfEventOpenTracepoint(tracepointId, progFd)
+	prog.efd, err = perfEventOpenTracepoint(tracepointId, progFd, -1)
 	return err
 }
 
+// EnableRawTracepoint attaches the raw tracepoint program identified by
+// secName, raw_tracepoint/<name>, to the tracepoint <name>, e.g.
+// raw_tracepoint/sched_switch.
+func (b *Module) EnableRawTracepoint(secName string) error {
+	prog, ok := b.rawTracepoints[secName]
+	if !ok {
+		return fmt.Errorf("no such raw tracepoint program %q", secName)
+	}
+	if prog.efd != -1 {
+		return fmt.Errorf("raw tracepoint program %q is already enabled", secName)
+	}
+
+	name := C.CString(strings.TrimPrefix(secName, "raw_tracepoint/"))
+	defer C.free(unsafe.Pointer(name))
+	efd, err := C.bpf_raw_tracepoint_open(name, C.int(prog.fd))
+	if efd < 0 {
+		return fmt.Errorf("error attaching raw tracepoint %q: %v", secName, err)
+	}
+	prog.efd = int(efd)
+	return nil
+}
+
+// EnableTracing attaches the fentry, fexit or fmod_ret program identified
+// by secName to the kernel function it was loaded for: fentry/<function>,
+// or fentry/<module>:<function> for a function of a kernel module.
+func (b *Module) EnableTracing(secName string) error {
+	prog, ok := b.tracingPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such tracing program %q", secName)
+	}
+	if prog.efd != -1 {
+		return fmt.Errorf("tracing program %q is already enabled", secName)
+	}
+
+	// the target is the one given at load time
+	efd, err := C.bpf_raw_tracepoint_open(nil, C.int(prog.fd))
+	if efd < 0 {
+		return fmt.Errorf("error attaching tracing program %q: %v", secName, err)
+	}
+	prog.efd = int(efd)
+	return nil
+}
+
+// EnableLSM attaches the LSM program identified by secName, lsm/<hook>, to
+// the LSM hook <hook>, e.g. lsm/file_open. It fails if the BPF LSM isn't
+// active, in which case the program would never run.
+func (b *Module) EnableLSM(secName string) error {
+	prog, ok := b.lsmPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such LSM program %q", secName)
+	}
+	if prog.efd != -1 {
+		return fmt.Errorf("LSM program %q is already enabled", secName)
+	}
+	if err := CheckBPFLSM(); err != nil {
+		return err
+	}
+
+	efd, err := C.bpf_link_create(C.int(prog.fd), 0, C.BPF_LSM_MAC, 0)
+	if efd < 0 && err == syscall.EINVAL {
+		// kernels before 5.19 only create LSM links with
+		// BPF_RAW_TRACEPOINT_OPEN
+		efd, err = C.bpf_raw_tracepoint_open(nil, C.int(prog.fd))
+	}
+	if efd < 0 {
+		return fmt.Errorf("error attaching LSM program %q: %v", secName, err)
+	}
+	prog.efd = int(efd)
+	return nil
+}
+
+// AttachPerfEvent runs the perf event program identified by secName on the
+// samples of the perf event evType/evConfig, as defined by the perf_type_id
+// enum and the PERF_COUNT_* constants of include/uapi/linux/perf_event.h.
+// The event is sampled every samplePeriod events or, when sampleFreq is not
+// 0, sampleFreq times per second. It is opened for the process pid, or -1
+// for all processes, on the given CPU, or on every online CPU if cpu is -1.
+func (b *Module) AttachPerfEvent(secName string, evType, evConfig int, samplePeriod, sampleFreq uint64, pid, cpu int) error {
+	prog, ok := b.perfEventPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such perf event program %q", secName)
+	}
+
+	cpus := []uint{uint(cpu)}
+	if cpu == -1 {
+		var err error
+		if cpus, err = cpuonline.Get(); err != nil {
+			return fmt.Errorf("failed to determine online cpus: %v", err)
+		}
+	}
+
+	var efds []int
+	for _, cpu := range cpus {
+		efd, err := perfEventOpenSampling(evType, evConfig, samplePeriod, sampleFreq, pid, int(cpu), prog.fd)
+		if err != nil {
+			for _, efd := range efds {
+				syscall.Close(efd)
+			}
+			return fmt.Errorf("error attaching perf event program %q on cpu %d: %v", secName, cpu, err)
+		}
+		efds = append(efds, efd)
+	}
+	prog.efds = append(prog.efds, efds...)
+	return nil
+}
+
+func perfEventOpenSampling(evType, evConfig int, samplePeriod, sampleFreq uint64, pid, cpu, progFd int) (int, error) {
+	efd, err := C.perf_event_open_sampling(C.uint32_t(evType), C.uint64_t(evConfig),
+		C.uint64_t(samplePeriod), C.uint64_t(sampleFreq), C.int(pid), C.int(cpu), C.PERF_FLAG_FD_CLOEXEC)
+	if efd < 0 {
+		return -1, fmt.Errorf("perf_event_open error: %v", err)
+	}
+
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_SET_BPF, uintptr(progFd)); err != 0 {
+		syscall.Close(int(efd))
+		return -1, fmt.Errorf("error attaching bpf program to perf event: %v", err)
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(efd), C.PERF_EVENT_IOC_ENABLE, 0); err != 0 {
+		syscall.Close(int(efd))
+		return -1, fmt.Errorf("error enabling perf event: %v", err)
+	}
+	return int(efd), nil
+}
+
 // IterKprobes returns a channel that emits the kprobes that included in the
 // module.
 func (b *Module) IterKprobes() <-chan *Kprobe {
@@ -479,6 +828,42 @@ func (b *Module) IterXDPProgram() <-chan *XDPProgram {
 	return ch
 }
 
+// IterPrograms returns a channel that emits the programs included in the
+// module, whatever their type.
+func (b *Module) IterPrograms() <-chan *Program {
+	ch := make(chan *Program)
+	go func() {
+		for name := range b.programs {
+			ch <- b.programs[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// Program returns the program defined by the function with the given name.
+func (b *Module) Program(name string) *Program {
+	return b.programs[name]
+}
+
+func (p *Program) Fd() int {
+	return p.fd
+}
+
+// PinPath returns the path the program is pinned at, or "" if it isn't
+// pinned.
+func (p *Program) PinPath() string {
+	return p.pinPath
+}
+
+// Reused reports whether the program was opened from its pin path rather
+// than loaded from the ELF file. Such a program was loaded, and usually
+// attached, by a previous process: it keeps using the maps it was loaded
+// with, so the maps it shares with user space should be pinned as well.
+func (p *Program) Reused() bool {
+	return p.reused
+}
+
 func (b *Module) CgroupProgram(name string) *CgroupProgram {
 	return b.cgroupPrograms[name]
 }
@@ -487,12 +872,91 @@ func (p *CgroupProgram) Fd() int {
 	return p.fd
 }
 
+// AttachType returns the attach type implied by the program's section name,
+// e.g. Connect4Type for cgroup/connect4. It returns false for cgroup/skb and
+// cgroup/sock programs, which may be attached in several ways.
+func (p *CgroupProgram) AttachType() (AttachType, bool) {
+	return cgroupAttachType(p.Name)
+}
+
 func (tp *TracepointProgram) Fd() int {
 	return tp.fd
 }
 
+// IterRawTracepointProgram returns a channel that emits the raw tracepoint
+// programs included in the module.
+func (b *Module) IterRawTracepointProgram() <-chan *RawTracepointProgram {
+	ch := make(chan *RawTracepointProgram)
+	go func() {
+		for name := range b.rawTracepoints {
+			ch <- b.rawTracepoints[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (p *RawTracepointProgram) Fd() int {
+	return p.fd
+}
+
+// IterPerfEventProgram returns a channel that emits the perf event programs
+// included in the module.
+func (b *Module) IterPerfEventProgram() <-chan *PerfEventProgram {
+	ch := make(chan *PerfEventProgram)
+	go func() {
+		for name := range b.perfEventPrograms {
+			ch <- b.perfEventPrograms[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (p *PerfEventProgram) Fd() int {
+	return p.fd
+}
+
+// IterTracingProgram returns a channel that emits the fentry, fexit and
+// fmod_ret programs included in the module.
+func (b *Module) IterTracingProgram() <-chan *TracingProgram {
+	ch := make(chan *TracingProgram)
+	go func() {
+		for name := range b.tracingPrograms {
+			ch <- b.tracingPrograms[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (p *TracingProgram) Fd() int {
+	return p.fd
+}
+
+// IterLSMProgram returns a channel that emits the LSM programs included in
+// the module.
+func (b *Module) IterLSMProgram() <-chan *LSMProgram {
+	ch := make(chan *LSMProgram)
+	go func() {
+		for name := range b.lsmPrograms {
+			ch <- b.lsmPrograms[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (p *LSMProgram) Fd() int {
+	return p.fd
+}
+
 var safeEventRegexp = regexp.MustCompile("[^a-zA-Z0-9]")
 
+// maxEventNameLen is the maximum length of the name of a tracefs event,
+// including the terminating null byte.
+const maxEventNameLen = 64
+
 func safeEventName(event string) string {
 	return safeEventRegexp.ReplaceAllString(event, "_")
 }
@@ -500,26 +964,46 @@ func safeEventName(event string) string {
 // AttachUprobe attaches the uprobe's BPF script to the program or library
 // at the given path and offset.
 func AttachUprobe(uprobe *Uprobe, path string, offset uint64) error {
+	return attachUprobe(uprobe, path, offset, 0, -1)
+}
+
+// attachUprobe attaches the uprobe at the given path and offset, for the
+// process pid if it's positive and for all processes otherwise. See
+// writeUprobeEvent for refCtrOffset.
+func attachUprobe(uprobe *Uprobe, path string, offset, refCtrOffset uint64, pid int) error {
 	var probeType string
 	if strings.HasPrefix(uprobe.Name, "uretprobe/") {
 		probeType = "r"
 	} else {
 		probeType = "p"
 	}
-	eventName := fmt.Sprintf("%s__%s_%x_gobpf_%d",
-		probeType, safeEventName(path), offset, os.Getpid())
+	suffix := fmt.Sprintf("_%x_gobpf_%d", offset, os.Getpid())
+	if pid > 0 {
+		suffix += fmt.Sprintf("_%d", pid)
+	}
+	eventName := probeType + "__" + safeEventName(path) + suffix
+	if len(eventName) >= maxEventNameLen {
+		// e.g. the paths of binaries in containers, through /proc/<pid>/root
+		h := fnv.New32a()
+		h.Write([]byte(path))
+		eventName = fmt.Sprintf("%s__%s_%08x%s", probeType, safeEventName(filepath.Base(path)), h.Sum32(), suffix)
+		if len(eventName) >= maxEventNameLen {
+			eventName = fmt.Sprintf("%s__%08x%s", probeType, h.Sum32(), suffix)
+		}
+	}
 
 	if _, ok := uprobe.efds[eventName]; ok {
 		return errors.New("uprobe already attached")
 	}
 
-	uprobeID, err := writeUprobeEvent(probeType, eventName, path, offset)
+	uprobeID, err := writeUprobeEvent(probeType, eventName, path, offset, refCtrOffset)
 	if err != nil {
 		return err
 	}
 
-	efd, err := perfEventOpenTracepoint(uprobeID, uprobe.fd)
+	efd, err := perfEventOpenTracepoint(uprobeID, uprobe.fd, pid)
 	if err != nil {
+		disableUprobe(eventName)
 		return err
 	}
 
@@ -533,7 +1017,7 @@ func (b *Module) AttachXDP(devName string, secName string) error {
 	if !ok {
 		return fmt.Errorf("no such XDP hook %q", secName)
 	}
-	if err := attachXDP(devName, xdp.fd, 0, true); err != nil {
+	if err := attachXDP(devName, xdp.fd, 0, -1, true); err != nil {
 		return err
 	}
 	return nil
@@ -545,22 +1029,22 @@ func (b *Module) AttachXDPWithFlags(devName string, secName string, flags uint32
 	if !ok {
 		return fmt.Errorf("no such XDP hook %q", secName)
 	}
-	return attachXDP(devName, xdp.fd, flags, true)
+	return attachXDP(devName, xdp.fd, flags, -1, true)
 }
 
 func (b *Module) RemoveXDP(devName string) error {
-	if err := attachXDP(devName, -1, 0, false); err != nil {
+	if err := attachXDP(devName, -1, 0, -1, false); err != nil {
 		return err
 	}
 	return nil
 }
 
-func attachXDP(devName string, fd int, flags uint32, attach bool) error {
+func attachXDP(devName string, fd int, flags uint32, oldFd int, attach bool) error {
 	devNameCS := C.CString(devName)
-	res, err := C.bpf_attach_xdp(devNameCS, C.int(fd), C.uint32_t(flags))
+	res, err := C.bpf_attach_xdp(devNameCS, C.int(fd), C.uint32_t(flags), C.int(oldFd))
 	defer C.free(unsafe.Pointer(devNameCS))
 
-	if res != 0 || err != nil {
+	if res != 0 {
 		return fmt.Errorf(xdpFormat(attach), devName, err)
 	}
 	return nil
@@ -577,18 +1061,11 @@ func AttachCgroupProgram(cgroupProg *CgroupProgram, cgroupPath string, attachTyp
 	return AttachCgroupProgramFromFd(cgroupProg.fd, cgroupPath, attachType)
 }
 
+// AttachCgroupProgramFromFd attaches the program to the cgroup without
+// flags: it replaces the program previously attached without flags, and
+// fails if programs were attached with AllowMulti.
 func AttachCgroupProgramFromFd(progFd int, cgroupPath string, attachType AttachType) error {
-	f, err := os.Open(cgroupPath)
-	if err != nil {
-		return fmt.Errorf("error opening cgroup %q: %v", cgroupPath, err)
-	}
-	defer f.Close()
-
-	ret, err := C.bpf_prog_attach(C.int(progFd), C.int(f.Fd()), uint32(attachType))
-	if ret < 0 {
-		return fmt.Errorf("failed to attach prog to cgroup %q: %v", cgroupPath, err)
-	}
-	return nil
+	return attachCgroupProgram(progFd, -1, cgroupPath, attachType, 0)
 }
 
 func DetachCgroupProgram(cgroupProg *CgroupProgram, cgroupPath string, attachType AttachType) error {
@@ -654,7 +1131,7 @@ func (kp *Kprobe) Fd() int {
 }
 
 func disableKprobe(eventName string) error {
-	kprobeEventsFileName := "/sys/kernel/debug/tracing/kprobe_events"
+	kprobeEventsFileName := filepath.Join(tracefsPath(), "kprobe_events")
 	f, err := os.OpenFile(kprobeEventsFileName, os.O_APPEND|os.O_WRONLY, 0)
 	if err != nil {
 		return fmt.Errorf("cannot open kprobe_events: %v", err)
@@ -677,7 +1154,7 @@ func disableKprobe(eventName string) error {
 }
 
 func disableUprobe(eventName string) error {
-	uprobeEventsFileName := "/sys/kernel/debug/tracing/uprobe_events"
+	uprobeEventsFileName := filepath.Join(tracefsPath(), "uprobe_events")
 	f, err := os.OpenFile(uprobeEventsFileName, os.O_APPEND|os.O_WRONLY, 0)
 	if err != nil {
 		return fmt.Errorf("cannot open uprobe_events: %v", err)
@@ -728,7 +1205,6 @@ func (xdpp *XDPProgram) Fd() int {
 }
 
 func (b *Module) closeProbes() error {
-	var funcName string
 	for _, probe := range b.probes {
 		if probe.efd != -1 {
 			if err := syscall.Close(probe.efd); err != nil {
@@ -739,18 +1215,11 @@ func (b *Module) closeProbes() error {
 		if err := syscall.Close(probe.fd); err != nil {
 			return fmt.Errorf("error closing probe fd: %v", err)
 		}
-		name := probe.Name
-		isKretprobe := strings.HasPrefix(name, "kretprobe/")
-		var err error
-		if isKretprobe {
-			funcName = strings.TrimPrefix(name, "kretprobe/")
-			err = disableKprobe("r" + funcName)
-		} else {
-			funcName = strings.TrimPrefix(name, "kprobe/")
-			err = disableKprobe("p" + funcName)
-		}
-		if err != nil {
-			return fmt.Errorf("error clearing probe: %v", err)
+		if probe.eventName != "" {
+			if err := disableKprobe(probe.eventName); err != nil {
+				return fmt.Errorf("error clearing probe: %v", err)
+			}
+			probe.eventName = ""
 		}
 	}
 	return nil
@@ -766,6 +1235,11 @@ func (b *Module) closeUprobes() error {
 				return fmt.Errorf("error clearing probe: %v", err)
 			}
 		}
+		for _, sema := range probe.semaphores {
+			if err := sema.update(-1); err != nil {
+				return err
+			}
+		}
 
 		if err := syscall.Close(probe.fd); err != nil {
 			return fmt.Errorf("error closing uprobe fd: %v", err)
@@ -789,6 +1263,66 @@ func (b *Module) closeTracepointPrograms() error {
 	return nil
 }
 
+func (b *Module) closeRawTracepointPrograms() error {
+	for _, program := range b.rawTracepoints {
+		if program.efd != -1 {
+			if err := syscall.Close(program.efd); err != nil {
+				return fmt.Errorf("error closing raw tracepoint fd: %v", err)
+			}
+			program.efd = -1
+		}
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing raw tracepoint program fd: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *Module) closeTracingPrograms() error {
+	for _, program := range b.tracingPrograms {
+		if program.efd != -1 {
+			if err := syscall.Close(program.efd); err != nil {
+				return fmt.Errorf("error closing tracing link fd: %v", err)
+			}
+			program.efd = -1
+		}
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing tracing program fd: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *Module) closeLSMPrograms() error {
+	for _, program := range b.lsmPrograms {
+		if program.efd != -1 {
+			if err := syscall.Close(program.efd); err != nil {
+				return fmt.Errorf("error closing LSM link fd: %v", err)
+			}
+			program.efd = -1
+		}
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing LSM program fd: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *Module) closePerfEventPrograms() error {
+	for _, program := range b.perfEventPrograms {
+		for _, efd := range program.efds {
+			if err := syscall.Close(efd); err != nil {
+				return fmt.Errorf("error closing perf event fd: %v", err)
+			}
+		}
+		program.efds = nil
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing perf event program fd: %v", err)
+		}
+	}
+	return nil
+}
+
 func (b *Module) closeCgroupPrograms() error {
 	for _, program := range b.cgroupPrograms {
 		if err := syscall.Close(program.fd); err != nil {
@@ -816,12 +1350,55 @@ func (b *Module) closeXDPPrograms() error {
 	return nil
 }
 
-func unpinMap(m *Map, pinPath string) error {
-	mapPath, err := getMapPath(&m.m.def, m.Name, pinPath)
+// unpinPrograms removes the pins of the programs whose section has Unpin set
+// in its close options.
+func (b *Module) unpinPrograms(options map[string]CloseOptions) error {
+	var objectDir string
+	if objectID, err := b.pinObjectID(); err == nil {
+		objectDir = filepath.Join(BPFFSPath, objectID)
+	}
+	for _, program := range b.programs {
+		if program.pinPath == "" || !options[program.SectionName].Unpin {
+			continue
+		}
+		if err := syscall.Unlink(program.pinPath); err != nil {
+			return fmt.Errorf("error unpinning program %q: %v", program.Name, err)
+		}
+		if objectDir != "" && filepath.Dir(program.pinPath) == objectDir {
+			// remove the object's directory along with its last pin,
+			// unlike the directories of other pin paths, which aren't the
+			// module's
+			os.Remove(objectDir)
+		}
+	}
+	return nil
+}
+
+func (b *Module) closePrograms() error {
+	for _, program := range b.programs {
+		if program.typed {
+			continue
+		}
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing program fd: %v", err)
+		}
+	}
+	return nil
+}
+
+func unpinMap(m *Map, pinPath, objectID string) error {
+	mapPath, err := getMapPath(&m.m.def, m.Name, pinPath, objectID)
 	if err != nil {
 		return err
 	}
-	return syscall.Unlink(mapPath)
+	if err := syscall.Unlink(mapPath); err != nil {
+		return err
+	}
+	if m.m.def.pinning == PIN_OBJECT_NS {
+		// remove the object's directory along with its last map
+		os.Remove(filepath.Dir(mapPath))
+	}
+	return nil
 }
 
 func (b *Module) closeMaps(options map[string]CloseOptions) error {
@@ -829,20 +1406,26 @@ func (b *Module) closeMaps(options map[string]CloseOptions) error {
 		doUnpin := options[fmt.Sprintf("maps/%s", m.Name)].Unpin
 		if doUnpin {
 			mapDef := m.m.def
-			var pinPath string
+			var pinPath, objectID string
 			if mapDef.pinning == PIN_CUSTOM_NS {
 				closeOption, ok := options[fmt.Sprintf("maps/%s", m.Name)]
 				if !ok {
 					return fmt.Errorf("close option for maps/%s must have PinPath set", m.Name)
 				}
 				pinPath = closeOption.PinPath
+				if pinPath == "" {
+					pinPath = m.pinPath
+				}
 			} else if mapDef.pinning == PIN_GLOBAL_NS {
 				// mapDef.namespace is used for PIN_GLOBAL_NS maps
 				pinPath = ""
 			} else if mapDef.pinning == PIN_OBJECT_NS {
-				return fmt.Errorf("unpinning with PIN_OBJECT_NS is to be implemented")
+				var err error
+				if objectID, err = b.pinObjectID(); err != nil {
+					return err
+				}
 			}
-			if err := unpinMap(m, pinPath); err != nil {
+			if err := unpinMap(m, pinPath, objectID); err != nil {
 				return fmt.Errorf("error unpinning map %q: %v", m.Name, err)
 			}
 		}
@@ -887,12 +1470,14 @@ type CloseOptions struct {
 //
 // * Closing map file descriptors and unpinning them where applicable
 // * Detaching BPF programs from kprobes and closing their file descriptors
+// * Detaching tracepoint, perf event, tracing and LSM programs and closing their file descriptors
 // * Closing cgroup-bpf file descriptors
-// * Closing socket filter file descriptors
+// * Closing socket filter and sockmap program file descriptors
 // * Closing XDP file descriptors
+// * Closing the file descriptors of the other programs
 //
-// It doesn't detach BPF programs from cgroups or sockets because they're
-// considered resources the user controls.
+// It doesn't detach BPF programs from cgroups, sockets or sockmaps because
+// they're considered resources the user controls.
 // It also doesn't unpin pinned maps. Use CloseExt and set Unpin to do this.
 func (b *Module) Close() error {
 	return b.CloseExt(nil)
@@ -903,6 +1488,9 @@ func (b *Module) CloseExt(options map[string]CloseOptions) error {
 	if err := b.closeMaps(options); err != nil {
 		return err
 	}
+	if err := b.unpinPrograms(options); err != nil {
+		return err
+	}
 	if err := b.closeProbes(); err != nil {
 		return err
 	}
@@ -915,11 +1503,35 @@ func (b *Module) CloseExt(options map[string]CloseOptions) error {
 	if err := b.closeTracepointPrograms(); err != nil {
 		return err
 	}
+	if err := b.closeRawTracepointPrograms(); err != nil {
+		return err
+	}
+	if err := b.closePerfEventPrograms(); err != nil {
+		return err
+	}
+	if err := b.closeTracingPrograms(); err != nil {
+		return err
+	}
+	if err := b.closeLSMPrograms(); err != nil {
+		return err
+	}
 	if err := b.closeSocketFilters(); err != nil {
 		return err
 	}
+	if err := b.closeSockMapPrograms(); err != nil {
+		return err
+	}
 	if err := b.closeXDPPrograms(); err != nil {
 		return err
 	}
+	if err := b.closePrograms(); err != nil {
+		return err
+	}
+	if b.btfFd >= 0 {
+		if err := syscall.Close(b.btfFd); err != nil {
+			return fmt.Errorf("error closing BTF fd: %v", err)
+		}
+		b.btfFd = -1
+	}
 	return nil
 }
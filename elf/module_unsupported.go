@@ -14,6 +14,11 @@ type AttachType struct{}
 type CloseOptions struct{}
 type SocketFilter struct{}
 type TracepointProgram struct{}
+type RawTracepointProgram struct{}
+type PerfEventProgram struct{}
+type TracingProgram struct{}
+type LSMProgram struct{}
+type SockMapProgram struct{}
 type SchedProgram struct{}
 
 func NewModule(fileName string) *Module {
@@ -68,6 +73,58 @@ func (b *Module) EnableTracepoint(secName string) error {
 	return errNotSupported
 }
 
+func (b *Module) EnableRawTracepoint(secName string) error {
+	return errNotSupported
+}
+
+func (b *Module) EnableTracing(secName string) error {
+	return errNotSupported
+}
+
+func (b *Module) IterTracingProgram() <-chan *TracingProgram {
+	return nil
+}
+
+func (b *Module) EnableLSM(secName string) error {
+	return errNotSupported
+}
+
+func (b *Module) IterLSMProgram() <-chan *LSMProgram {
+	return nil
+}
+
+func CheckBPFLSM() error {
+	return errNotSupported
+}
+
+func (b *Module) AttachSockMapProgram(secName string, m *Map) error {
+	return errNotSupported
+}
+
+func (b *Module) DetachSockMapProgram(secName string, m *Map) error {
+	return errNotSupported
+}
+
+func (b *Module) UpdateSockMap(m *Map, key unsafe.Pointer, sockFd int) error {
+	return errNotSupported
+}
+
+func (b *Module) DeleteSockMap(m *Map, key unsafe.Pointer) error {
+	return errNotSupported
+}
+
+func (b *Module) AttachPerfEvent(secName string, evType, evConfig int, samplePeriod, sampleFreq uint64, pid, cpu int) error {
+	return errNotSupported
+}
+
+func (b *Module) IterRawTracepointProgram() <-chan *RawTracepointProgram {
+	return nil
+}
+
+func (b *Module) IterPerfEventProgram() <-chan *PerfEventProgram {
+	return nil
+}
+
 func (b *Module) IterMaps() <-chan *Map {
 	return nil
 }
@@ -107,3 +164,119 @@ func (b *Module) SocketFilter(name string) *SocketFilter {
 func (b *Module) UpdateElement(mp *Map, key, value unsafe.Pointer, flags uint64) error {
 	return errNotSupported
 }
+
+func (p *CgroupProgram) AttachType() (AttachType, bool) {
+	return AttachType{}, false
+}
+
+type AttachFlags uint32
+
+type CgroupPrograms struct {
+	Flags AttachFlags
+	IDs   []uint32
+}
+
+func AttachCgroupProgramWithFlags(cgroupProg *CgroupProgram, cgroupPath string, attachType AttachType, flags AttachFlags) error {
+	return errNotSupported
+}
+
+func AttachCgroupProgramFromFdWithFlags(progFd int, cgroupPath string, attachType AttachType, flags AttachFlags) error {
+	return errNotSupported
+}
+
+func ReplaceCgroupProgram(cgroupProg *CgroupProgram, oldProgFd int, cgroupPath string, attachType AttachType) error {
+	return errNotSupported
+}
+
+func QueryCgroupPrograms(cgroupPath string, attachType AttachType) (*CgroupPrograms, error) {
+	return nil, errNotSupported
+}
+
+type TCDirection int
+type TCAttachOptions struct{}
+type TCFilter struct{}
+
+func AddClsactQdisc(devName string) error {
+	return errNotSupported
+}
+
+func RemoveClsactQdisc(devName string) error {
+	return errNotSupported
+}
+
+func (b *Module) AttachSchedProgram(secName, devName string, direction TCDirection, options TCAttachOptions) (*TCFilter, error) {
+	return nil, errNotSupported
+}
+
+func RemoveTCFilter(devName string, direction TCDirection, handle uint32, priority uint16) error {
+	return errNotSupported
+}
+
+func ListTCFilters(devName string, direction TCDirection) ([]TCFilter, error) {
+	return nil, errNotSupported
+}
+
+type XDPMode uint8
+type XDPInfo struct{}
+
+func QueryXDP(devName string) (*XDPInfo, error) {
+	return nil, errNotSupported
+}
+
+func (b *Module) ReplaceXDP(devName string, secName string, oldFd int, flags uint32) error {
+	return errNotSupported
+}
+
+type Link struct{}
+
+func LoadPinnedLink(pinPath string) (*Link, error) {
+	return nil, errNotSupported
+}
+
+func (l *Link) Fd() int {
+	return -1
+}
+
+func (l *Link) PinPath() string {
+	return ""
+}
+
+func (l *Link) Pin(pinPath string) error {
+	return errNotSupported
+}
+
+func (l *Link) Unpin() error {
+	return errNotSupported
+}
+
+func (l *Link) Update(progFd int) error {
+	return errNotSupported
+}
+
+func (l *Link) UpdateReplace(progFd, oldProgFd int) error {
+	return errNotSupported
+}
+
+func (l *Link) Detach() error {
+	return errNotSupported
+}
+
+func (l *Link) Close() error {
+	return errNotSupported
+}
+
+func (b *Module) AttachXDPLink(devName string, secName string, flags uint32) (*Link, error) {
+	return nil, errNotSupported
+}
+
+func AttachCgroupLink(cgroupProg *CgroupProgram, cgroupPath string, attachType AttachType) (*Link, error) {
+	return nil, errNotSupported
+}
+
+func (b *Module) AttachTracingLink(secName string) (*Link, error) {
+	return nil, errNotSupported
+}
+
+func (b *Module) AttachKprobeLink(secName string, maxactive int) (*Link, error) {
+	return nil, errNotSupported
+}
@@ -5,6 +5,10 @@
 #include <memory.h>
 #include <unistd.h>
 #include <linux/rtnetlink.h>
+#include <linux/pkt_cls.h>
+#include <linux/pkt_sched.h>
+#include <linux/if_ether.h>
+#include <arpa/inet.h>
 #include <sys/socket.h>
 #include <errno.h>
 #include <time.h>
@@ -124,6 +128,11 @@ cleanup:
 }
 
 int bpf_set_link_xdp_fd(int ifindex, int fd, __u32 flags)
+{
+	return bpf_set_link_xdp_fd_opts(ifindex, fd, flags, -1);
+}
+
+int bpf_set_link_xdp_fd_opts(int ifindex, int fd, __u32 flags, int old_fd)
 {
 	int sock, seq = 0, ret;
 	struct nlattr *nla, *nla_xdp;
@@ -165,6 +174,14 @@ int bpf_set_link_xdp_fd(int ifindex, int fd, __u32 flags)
   		nla->nla_len += nla_xdp->nla_len;
 	}
 
+	if (flags & XDP_FLAGS_REPLACE) {
+		nla_xdp = (struct nlattr *)((char *)nla + nla->nla_len);
+		nla_xdp->nla_type = IFLA_XDP_EXPECTED_FD;
+		nla_xdp->nla_len = NLA_HDRLEN + sizeof(old_fd);
+		memcpy((char *)nla_xdp + NLA_HDRLEN, &old_fd, sizeof(old_fd));
+		nla->nla_len += nla_xdp->nla_len;
+	}
+
 	req.nh.nlmsg_len += NLA_ALIGN(nla->nla_len);
 
 	if (send(sock, &req, req.nh.nlmsg_len, 0) < 0) {
@@ -178,3 +195,278 @@ cleanup:
     return ret;
 }
 
+
+struct tc_req {
+	struct nlmsghdr  nh;
+	struct tcmsg     tc;
+	char             attrbuf[256];
+};
+
+static struct nlattr *tc_req_tail(struct tc_req *req)
+{
+	return (struct nlattr *)(((char *)req) + NLMSG_ALIGN(req->nh.nlmsg_len));
+}
+
+static int tc_req_add_attr(struct tc_req *req, int type, const void *data, int len)
+{
+	struct nlattr *nla = tc_req_tail(req);
+
+	if (NLMSG_ALIGN(req->nh.nlmsg_len) + NLA_ALIGN(NLA_HDRLEN + len) > sizeof(*req))
+		return -EMSGSIZE;
+
+	nla->nla_type = type;
+	nla->nla_len = NLA_HDRLEN + len;
+	if (len)
+		memcpy((char *)nla + NLA_HDRLEN, data, len);
+	req->nh.nlmsg_len = NLMSG_ALIGN(req->nh.nlmsg_len) + NLA_ALIGN(nla->nla_len);
+	return 0;
+}
+
+static struct nlattr *tc_req_begin_nested(struct tc_req *req, int type)
+{
+	struct nlattr *nla = tc_req_tail(req);
+
+	if (tc_req_add_attr(req, type | NLA_F_NESTED, NULL, 0))
+		return NULL;
+	return nla;
+}
+
+static void tc_req_end_nested(struct tc_req *req, struct nlattr *nla)
+{
+	nla->nla_len = ((char *)req + req->nh.nlmsg_len) - (char *)nla;
+}
+
+static void tc_req_init(struct tc_req *req, int type, int flags, int ifindex, __u32 parent)
+{
+	memset(req, 0, sizeof(*req));
+	req->nh.nlmsg_len = NLMSG_LENGTH(sizeof(struct tcmsg));
+	req->nh.nlmsg_flags = NLM_F_REQUEST | flags;
+	req->nh.nlmsg_type = type;
+	req->tc.tcm_family = AF_UNSPEC;
+	req->tc.tcm_ifindex = ifindex;
+	req->tc.tcm_parent = parent;
+}
+
+static int tc_talk(struct tc_req *req, __dump_nlmsg_t fn, void *cookie)
+{
+	int sock, seq = 1, ret;
+	__u32 nl_pid;
+
+	sock = libbpf_netlink_open(&nl_pid);
+	if (sock < 0)
+		return sock;
+
+	req->nh.nlmsg_seq = seq;
+	if (send(sock, req, req->nh.nlmsg_len, 0) < 0) {
+		ret = -errno;
+		goto cleanup;
+	}
+	ret = bpf_netlink_recv(sock, nl_pid, seq, fn, NULL, cookie);
+
+cleanup:
+	close(sock);
+	return ret;
+}
+
+int bpf_tc_qdisc_clsact(int ifindex, bool create)
+{
+	struct tc_req req;
+	int ret;
+
+	if (create)
+		tc_req_init(&req, RTM_NEWQDISC, NLM_F_ACK | NLM_F_CREATE | NLM_F_EXCL,
+			    ifindex, TC_H_CLSACT);
+	else
+		tc_req_init(&req, RTM_DELQDISC, NLM_F_ACK, ifindex, TC_H_CLSACT);
+	req.tc.tcm_handle = TC_H_MAKE(TC_H_CLSACT, 0);
+
+	ret = tc_req_add_attr(&req, TCA_KIND, "clsact", sizeof("clsact"));
+	if (ret)
+		return ret;
+	return tc_talk(&req, NULL, NULL);
+}
+
+static int tc_filter_parse(struct nlmsghdr *nh, struct bpf_tc_filter *filter)
+{
+	struct tcmsg *tc = NLMSG_DATA(nh);
+	struct nlattr *tb[TCA_MAX + 1], *tbb[TCA_BPF_MAX + 1];
+
+	libbpf_nla_parse(tb, TCA_MAX, (struct nlattr *)((char *)tc + NLMSG_ALIGN(sizeof(*tc))),
+			 NLMSG_PAYLOAD(nh, sizeof(*tc)), NULL);
+
+	memset(filter, 0, sizeof(*filter));
+	filter->handle = tc->tcm_handle;
+	filter->priority = TC_H_MAJ(tc->tcm_info) >> 16;
+	filter->protocol = ntohs(TC_H_MIN(tc->tcm_info));
+	if (tb[TCA_KIND])
+		strncpy(filter->kind, libbpf_nla_getattr_str(tb[TCA_KIND]), sizeof(filter->kind) - 1);
+	if (!tb[TCA_OPTIONS] || strcmp(filter->kind, "bpf"))
+		return 0;
+
+	libbpf_nla_parse_nested(tbb, TCA_BPF_MAX, tb[TCA_OPTIONS], NULL);
+	if (tbb[TCA_BPF_ID])
+		filter->prog_id = libbpf_nla_getattr_u32(tbb[TCA_BPF_ID]);
+	if (tbb[TCA_BPF_FLAGS])
+		filter->flags = libbpf_nla_getattr_u32(tbb[TCA_BPF_FLAGS]);
+	if (tbb[TCA_BPF_NAME])
+		strncpy(filter->name, libbpf_nla_getattr_str(tbb[TCA_BPF_NAME]), sizeof(filter->name) - 1);
+	return 0;
+}
+
+static int tc_filter_echo(struct nlmsghdr *nh, libbpf_dump_nlmsg_t fn, void *cookie)
+{
+	if (nh->nlmsg_type != RTM_NEWTFILTER)
+		return 0;
+	return tc_filter_parse(nh, cookie);
+}
+
+int bpf_tc_attach(int ifindex, __u32 parent, struct bpf_tc_filter *filter, int prog_fd, bool replace)
+{
+	__u32 fd = prog_fd, flags = filter->flags;
+	struct nlattr *nla;
+	struct tc_req req;
+	int ret;
+
+	tc_req_init(&req, RTM_NEWTFILTER,
+		    NLM_F_ACK | NLM_F_ECHO | NLM_F_CREATE | (replace ? NLM_F_REPLACE : NLM_F_EXCL),
+		    ifindex, parent);
+	req.tc.tcm_handle = filter->handle;
+	req.tc.tcm_info = TC_H_MAKE(filter->priority << 16, htons(ETH_P_ALL));
+
+	ret = tc_req_add_attr(&req, TCA_KIND, "bpf", sizeof("bpf"));
+	if (ret)
+		return ret;
+	nla = tc_req_begin_nested(&req, TCA_OPTIONS);
+	if (!nla)
+		return -EMSGSIZE;
+	ret = tc_req_add_attr(&req, TCA_BPF_FD, &fd, sizeof(fd));
+	if (!ret && filter->name[0])
+		ret = tc_req_add_attr(&req, TCA_BPF_NAME, filter->name, strlen(filter->name) + 1);
+	if (!ret && flags)
+		ret = tc_req_add_attr(&req, TCA_BPF_FLAGS, &flags, sizeof(flags));
+	if (ret)
+		return ret;
+	tc_req_end_nested(&req, nla);
+
+	return tc_talk(&req, tc_filter_echo, filter);
+}
+
+int bpf_tc_detach(int ifindex, __u32 parent, __u32 handle, __u32 priority)
+{
+	struct tc_req req;
+	int ret;
+
+	tc_req_init(&req, RTM_DELTFILTER, NLM_F_ACK, ifindex, parent);
+	req.tc.tcm_handle = handle;
+	req.tc.tcm_info = TC_H_MAKE(priority << 16, htons(ETH_P_ALL));
+
+	ret = tc_req_add_attr(&req, TCA_KIND, "bpf", sizeof("bpf"));
+	if (ret)
+		return ret;
+	return tc_talk(&req, NULL, NULL);
+}
+
+struct tc_filter_list {
+	struct bpf_tc_filter *filters;
+	int max;
+	int count;
+};
+
+static int tc_filter_dump(struct nlmsghdr *nh, libbpf_dump_nlmsg_t fn, void *cookie)
+{
+	struct tc_filter_list *list = cookie;
+	struct tcmsg *tc = NLMSG_DATA(nh);
+
+	/* skip the entries of the filter chains, which have no handle */
+	if (nh->nlmsg_type != RTM_NEWTFILTER || !tc->tcm_handle)
+		return 0;
+	if (list->count < list->max)
+		tc_filter_parse(nh, &list->filters[list->count]);
+	list->count++;
+	return 0;
+}
+
+int bpf_tc_list(int ifindex, __u32 parent, struct bpf_tc_filter *filters, int max)
+{
+	struct tc_filter_list list = { .filters = filters, .max = max };
+	struct tc_req req;
+	int ret;
+
+	tc_req_init(&req, RTM_GETTFILTER, NLM_F_DUMP, ifindex, parent);
+	ret = tc_talk(&req, tc_filter_dump, &list);
+	if (ret)
+		return ret;
+	return list.count;
+}
+
+struct xdp_link_query {
+	int ifindex;
+	struct xdp_link_info *info;
+	bool found;
+};
+
+static int xdp_link_dump(struct nlmsghdr *nh, libbpf_dump_nlmsg_t fn, void *cookie)
+{
+	struct xdp_link_query *query = cookie;
+	struct ifinfomsg *ifinfo = NLMSG_DATA(nh);
+	struct nlattr *tb[IFLA_MAX + 1], *tbx[IFLA_XDP_MAX + 1];
+	struct xdp_link_info *info = query->info;
+
+	if (nh->nlmsg_type != RTM_NEWLINK || ifinfo->ifi_index != query->ifindex)
+		return 0;
+	query->found = true;
+
+	libbpf_nla_parse(tb, IFLA_MAX, (struct nlattr *)((char *)ifinfo + NLMSG_ALIGN(sizeof(*ifinfo))),
+			 NLMSG_PAYLOAD(nh, sizeof(*ifinfo)), NULL);
+	if (!tb[IFLA_XDP])
+		return 0;
+
+	libbpf_nla_parse_nested(tbx, IFLA_XDP_MAX, tb[IFLA_XDP], NULL);
+	if (tbx[IFLA_XDP_ATTACHED])
+		info->attach_mode = libbpf_nla_getattr_u8(tbx[IFLA_XDP_ATTACHED]);
+	if (tbx[IFLA_XDP_PROG_ID])
+		info->prog_id = libbpf_nla_getattr_u32(tbx[IFLA_XDP_PROG_ID]);
+	if (tbx[IFLA_XDP_DRV_PROG_ID])
+		info->drv_prog_id = libbpf_nla_getattr_u32(tbx[IFLA_XDP_DRV_PROG_ID]);
+	if (tbx[IFLA_XDP_SKB_PROG_ID])
+		info->skb_prog_id = libbpf_nla_getattr_u32(tbx[IFLA_XDP_SKB_PROG_ID]);
+	if (tbx[IFLA_XDP_HW_PROG_ID])
+		info->hw_prog_id = libbpf_nla_getattr_u32(tbx[IFLA_XDP_HW_PROG_ID]);
+	return 0;
+}
+
+int bpf_get_link_xdp_info(int ifindex, struct xdp_link_info *info)
+{
+	struct xdp_link_query query = { .ifindex = ifindex, .info = info };
+	int sock, seq = 0, ret;
+	struct {
+		struct nlmsghdr  nh;
+		struct ifinfomsg ifinfo;
+	} req;
+	__u32 nl_pid;
+
+	memset(info, 0, sizeof(*info));
+
+	sock = libbpf_netlink_open(&nl_pid);
+	if (sock < 0)
+		return sock;
+
+	memset(&req, 0, sizeof(req));
+	req.nh.nlmsg_len = NLMSG_LENGTH(sizeof(struct ifinfomsg));
+	req.nh.nlmsg_flags = NLM_F_REQUEST | NLM_F_DUMP;
+	req.nh.nlmsg_type = RTM_GETLINK;
+	req.nh.nlmsg_seq = ++seq;
+	req.ifinfo.ifi_family = AF_PACKET;
+
+	if (send(sock, &req, req.nh.nlmsg_len, 0) < 0) {
+		ret = -errno;
+		goto cleanup;
+	}
+	ret = bpf_netlink_recv(sock, nl_pid, seq, xdp_link_dump, NULL, &query);
+	if (!ret && !query.found)
+		ret = -ENODEV;
+
+cleanup:
+	close(sock);
+	return ret;
+}
@@ -20,10 +20,13 @@
 package elf
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sort"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/vietanhduong/gobpf/pkg/cpuonline"
@@ -36,7 +39,6 @@ import (
 #include <stdio.h>
 #include <string.h>
 #include <linux/perf_event.h>
-#include <poll.h>
 
 // from https://github.com/cilium/cilium/blob/master/pkg/bpf/perf.go
 
@@ -176,6 +178,11 @@ type PerfMap struct {
 	lostChan     chan uint64
 	pollStop     chan struct{}
 	timestamp    func(*[]byte) uint64
+
+	// poller wakes up the goroutine of PollStart on PollStop, and done is
+	// closed once it exits
+	poller *perfPoller
+	done   chan struct{}
 }
 
 // Matching 'struct perf_event_sample in kernel sources
@@ -316,7 +323,11 @@ func (pm *PerfMap) SetTimestampFunc(timestamp func(*[]byte) uint64) {
 	pm.timestamp = timestamp
 }
 
-func (pm *PerfMap) PollStart() {
+// PollStart starts the goroutine that polls the perf event map and sends the
+// samples to receiverChan, and the number of lost samples to lostChan. If
+// the map can't be polled, the error is returned and the channels are
+// closed, as they are by PollStop.
+func (pm *PerfMap) PollStart() error {
 	incoming := OrderedBytesArray{timestamp: pm.timestamp}
 
 	m, ok := pm.program.maps[pm.name]
@@ -326,24 +337,49 @@ func (pm *PerfMap) PollStart() {
 		panic(fmt.Sprintf("cannot find map %q", pm.name))
 	}
 
+	pm.done = make(chan struct{})
+	poller, err := newPerfPoller(m.pmuFDs)
+	if err != nil {
+		// nothing will ever be received
+		close(pm.receiverChan)
+		if pm.lostChan != nil {
+			close(pm.lostChan)
+		}
+		close(pm.done)
+		return fmt.Errorf("cannot poll map %q: %v", pm.name, err)
+	}
+	pm.poller = poller
+
 	go func() {
 		cpuCount := len(m.pmuFDs)
 		pageSize := os.Getpagesize()
 		state := C.struct_read_state{}
+		events := make([]syscall.EpollEvent, cpuCount+1)
 
 		defer func() {
+			C.free(state.buf)
+			poller.close()
 			close(pm.receiverChan)
 			if pm.lostChan != nil {
 				close(pm.lostChan)
 			}
+			close(pm.done)
 		}()
 
 		for {
 			select {
 			case <-pm.pollStop:
-				break
+				return
 			default:
-				perfEventPoll(m.pmuFDs)
+			}
+			// records held back to keep the order are sent by the next
+			// harvest, without waiting for new ones
+			timeout := -1
+			if len(incoming.bytesArray) > 0 {
+				timeout = 0
+			}
+			if _, woken, err := poller.wait(events, timeout); woken || err != nil {
+				return
 			}
 
 		harvestLoop:
@@ -419,31 +455,266 @@ func (pm *PerfMap) PollStart() {
 			}
 		}
 	}()
+	return nil
 }
 
-// PollStop stops the goroutine that polls the perf event map.
-// Callers must not close receiverChan or lostChan: they will be automatically
-// closed on the sender side.
+// PollStop stops the goroutine that polls the perf event map, and waits for
+// it to exit. Callers must not close receiverChan or lostChan: they will be
+// automatically closed on the sender side.
 func (pm *PerfMap) PollStop() {
 	close(pm.pollStop)
+	if pm.poller != nil {
+		pm.poller.wake()
+	}
+	if pm.done != nil {
+		<-pm.done
+	}
 }
 
-func perfEventPoll(fds []C.int) error {
-	var pfds []C.struct_pollfd
+// perfPoller waits for the perf ring buffers of a map to be readable, with
+// epoll, until it's woken up through its eventfd.
+type perfPoller struct {
+	epollFd int
+	wakeFd  int
+	// cpus are the indexes of the ring buffers, by fd
+	cpus map[int32]int
+}
 
-	for i := range fds {
-		var pfd C.struct_pollfd
+func newPerfPoller(fds []C.int) (*perfPoller, error) {
+	epollFd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("error creating epoll instance: %v", err)
+	}
+	wakeFd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		syscall.Close(epollFd)
+		return nil, fmt.Errorf("error creating eventfd: %v", errno)
+	}
+	p := &perfPoller{epollFd: epollFd, wakeFd: int(wakeFd), cpus: make(map[int32]int)}
 
-		pfd.fd = fds[i]
-		pfd.events = C.POLLIN
+	for i, fd := range append([]C.int{C.int(wakeFd)}, fds...) {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, int(fd), &event); err != nil {
+			p.close()
+			return nil, fmt.Errorf("error adding fd %d to epoll instance: %v", fd, err)
+		}
+		if i > 0 {
+			p.cpus[int32(fd)] = i - 1
+		}
+	}
+	return p, nil
+}
 
-		pfds = append(pfds, pfd)
+// wait waits up to timeout milliseconds, or as long as it takes if it's
+// negative, for ring buffers to be readable, whose indexes are returned, or
+// for the poller to be woken up.
+func (p *perfPoller) wait(events []syscall.EpollEvent, timeout int) ([]int, bool, error) {
+	for {
+		n, err := syscall.EpollWait(p.epollFd, events, timeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("error polling: %v", err)
+		}
+		var ready []int
+		for _, event := range events[:n] {
+			if int(event.Fd) == p.wakeFd {
+				return nil, true, nil
+			}
+			ready = append(ready, p.cpus[event.Fd])
+		}
+		return ready, false, nil
 	}
-	_, err := C.poll(&pfds[0], C.nfds_t(len(fds)), 500)
+}
+
+// wake wakes up wait, for good: the eventfd is never reset.
+func (p *perfPoller) wake() {
+	var one [8]byte
+	*(*uint64)(unsafe.Pointer(&one[0])) = 1
+	syscall.Write(p.wakeFd, one[:])
+}
+
+func (p *perfPoller) close() {
+	syscall.Close(p.epollFd)
+	syscall.Close(p.wakeFd)
+}
+
+// PerfRecord is a record of a perf ring buffer: either a sample output by a
+// BPF program, or the number of samples lost because the ring buffer was
+// full.
+type PerfRecord struct {
+	// CPU is the CPU of the ring buffer.
+	CPU         int
+	LostSamples uint64
+	RawSample   []byte
+}
+
+// PerfReader reads the records of a perf event map on demand, as opposed
+// to PerfMap, which pushes the samples into channels. The records of a CPU
+// are read in order, but those of different CPUs are not ordered.
+type PerfReader struct {
+	records chan PerfRecord
+	poller  *perfPoller
+	cpus    []uint
+
+	deadlineMu sync.Mutex
+	deadline   time.Time
+	// deadlineSet interrupts Read for it to apply a new deadline
+	deadlineSet chan struct{}
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// NewPerfReader starts reading the perf event map mapName of the module.
+// The reader must be closed before the module.
+func NewPerfReader(b *Module, mapName string) (*PerfReader, error) {
+	m, ok := b.maps[mapName]
+	if !ok {
+		return nil, fmt.Errorf("no map with name %s", mapName)
+	}
+	if len(m.pmuFDs) == 0 {
+		return nil, fmt.Errorf("%q is not an initialized perf map", mapName)
+	}
+	cpus, err := cpuonline.Get()
 	if err != nil {
-		return fmt.Errorf("error polling: %v", err.(syscall.Errno))
+		return nil, fmt.Errorf("failed to determine online cpus: %v", err)
 	}
+	poller, err := newPerfPoller(m.pmuFDs)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &PerfReader{
+		records:     make(chan PerfRecord),
+		poller:      poller,
+		cpus:        cpus,
+		deadlineSet: make(chan struct{}, 1),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go r.poll(m.pageCount, m.headers)
+	return r, nil
+}
+
+// poll reads the records of the ring buffers as they are readable, until
+// the reader is closed.
+func (r *PerfReader) poll(pageCount int, headers []*C.struct_perf_event_mmap_page) {
+	pageSize := os.Getpagesize()
+	state := C.struct_read_state{}
+	events := make([]syscall.EpollEvent, len(headers)+1)
+	defer func() {
+		C.free(state.buf)
+		close(r.done)
+	}()
+
+	for {
+		ready, woken, err := r.poller.wait(events, -1)
+		if woken {
+			return
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+		for _, index := range ready {
+			for {
+				var sample *PerfEventSample
+				var lost *PerfEventLost
+				record := PerfRecord{CPU: int(r.cpus[index])}
+
+				ok := C.perf_event_read(C.int(pageCount), C.int(pageSize),
+					unsafe.Pointer(&state), unsafe.Pointer(headers[index]),
+					unsafe.Pointer(&sample), unsafe.Pointer(&lost))
+				if ok == 0 {
+					break
+				}
+				switch ok {
+				case C.PERF_RECORD_SAMPLE:
+					record.RawSample = C.GoBytes(unsafe.Pointer(&sample.data), C.int(sample.Size-4))
+				case C.PERF_RECORD_LOST:
+					record.LostSamples = lost.Lost
+				default:
+					// ignore unknown events
+					continue
+				}
+				select {
+				case r.records <- record:
+				case <-r.closing:
+					return
+				}
+			}
+		}
+	}
+}
+
+// SetDeadline sets the time after which Read fails with
+// os.ErrDeadlineExceeded when no record is available, including for a Read
+// already waiting. A zero time, the default, means no deadline.
+func (r *PerfReader) SetDeadline(t time.Time) {
+	r.deadlineMu.Lock()
+	r.deadline = t
+	r.deadlineMu.Unlock()
+	select {
+	case r.deadlineSet <- struct{}{}:
+	default:
+	}
+}
+
+// Read returns the next record, waiting for one until ctx is done or the
+// deadline set by SetDeadline passes.
+func (r *PerfReader) Read(ctx context.Context) (PerfRecord, error) {
+	for {
+		r.deadlineMu.Lock()
+		deadline := r.deadline
+		r.deadlineMu.Unlock()
+
+		record, retry, err := r.wait(ctx, deadline)
+		if !retry {
+			return record, err
+		}
+	}
+}
+
+// wait waits for a record until the deadline, or is interrupted by a new one
+// being set, to retry.
+func (r *PerfReader) wait(ctx context.Context, deadline time.Time) (PerfRecord, bool, error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case record := <-r.records:
+		return record, false, nil
+	case <-r.done:
+		if r.err != nil {
+			return PerfRecord{}, false, r.err
+		}
+		return PerfRecord{}, false, ErrPerfReaderClosed
+	case <-ctx.Done():
+		return PerfRecord{}, false, ctx.Err()
+	case <-expired:
+		return PerfRecord{}, false, os.ErrDeadlineExceeded
+	case <-r.deadlineSet:
+		return PerfRecord{}, true, nil
+	}
+}
 
+// Close stops reading the map, and waits for the goroutine polling it to
+// exit. Read then fails with ErrPerfReaderClosed.
+func (r *PerfReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closing)
+		r.poller.wake()
+		<-r.done
+		r.poller.close()
+	})
 	return nil
 }
 
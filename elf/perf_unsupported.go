@@ -2,6 +2,11 @@
 
 package elf
 
+import (
+	"context"
+	"time"
+)
+
 type PerfMap struct{}
 
 func InitPerfMap(b *Module, mapName string, receiverChan chan []byte, lostChan chan uint64) (*PerfMap, error) {
@@ -10,10 +15,50 @@ func InitPerfMap(b *Module, mapName string, receiverChan chan []byte, lostChan c
 
 func (pm *PerfMap) SetTimestampFunc(timestamp func(*[]byte) uint64) {}
 
-func (pm *PerfMap) PollStart() {}
+func (pm *PerfMap) PollStart() error {
+	return errNotSupported
+}
 
 func (pm *PerfMap) PollStop() {}
 
 func NowNanoseconds() uint64 {
 	return 0
 }
+
+type RingBuf struct{}
+
+func InitRingBuf(b *Module, mapName string) (*RingBuf, error) {
+	return nil, errNotSupported
+}
+
+func (r *RingBuf) Read() ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (r *RingBuf) SetDeadline(t time.Time) {}
+
+func (r *RingBuf) Close() error {
+	return errNotSupported
+}
+
+type PerfRecord struct {
+	CPU         int
+	LostSamples uint64
+	RawSample   []byte
+}
+
+type PerfReader struct{}
+
+func NewPerfReader(b *Module, mapName string) (*PerfReader, error) {
+	return nil, errNotSupported
+}
+
+func (r *PerfReader) Read(ctx context.Context) (PerfRecord, error) {
+	return PerfRecord{}, errNotSupported
+}
+
+func (r *PerfReader) SetDeadline(t time.Time) {}
+
+func (r *PerfReader) Close() error {
+	return errNotSupported
+}
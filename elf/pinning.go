@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"unsafe"
 
 	"github.com/vietanhduong/gobpf/pkg/bpffs"
@@ -21,6 +22,7 @@ import (
 #include <unistd.h>
 
 extern __u64 ptr_to_u64(void *);
+extern int get_pinned_obj_fd(const char *path);
 
 int bpf_pin_object(int fd, const char *pathname)
 {
@@ -32,6 +34,19 @@ int bpf_pin_object(int fd, const char *pathname)
 
 	return syscall(__NR_bpf, BPF_OBJ_PIN, &attr, sizeof(attr));
 }
+
+int bpf_obj_get_map_info(int fd, struct bpf_map_info *info)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	memset(info, 0, sizeof(*info));
+	attr.info.bpf_fd = fd;
+	attr.info.info_len = sizeof(*info);
+	attr.info.info = ptr_to_u64((void *)info);
+
+	return syscall(__NR_bpf, BPF_OBJ_GET_INFO_BY_FD, &attr, sizeof(attr));
+}
 */
 import "C"
 
@@ -48,6 +63,76 @@ func validPinPath(PinPath string) bool {
 	return filepath.Clean(PinPath) == PinPath
 }
 
+// pinnedMapInfo holds the attributes a pinned map must share with its
+// definition to be reused.
+type pinnedMapInfo struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	flags      uint32
+}
+
+// mismatch describes how the pinned map info differs from the definition
+// def, or returns "" if they are compatible. A definition without
+// max_entries, which are then set at load time, matches any size.
+func (info pinnedMapInfo) mismatch(def pinnedMapInfo) string {
+	var diffs []string
+	check := func(what string, got, want uint32) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s %d instead of %d", what, got, want))
+		}
+	}
+	check("type", info.mapType, def.mapType)
+	check("key size", info.keySize, def.keySize)
+	check("value size", info.valueSize, def.valueSize)
+	if def.maxEntries != 0 {
+		check("max entries", info.maxEntries, def.maxEntries)
+	}
+	check("flags", info.flags, def.flags)
+	return strings.Join(diffs, ", ")
+}
+
+// checkPinnedMap makes sure the map pinned at pinPath, if any, matches its
+// definition before it is reused. An incompatible map is unpinned when
+// replace is set, so that a new one gets created and pinned in its place.
+func checkPinnedMap(pinPath string, def pinnedMapInfo, replace bool) error {
+	if _, err := os.Stat(pinPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	pinPathC := C.CString(pinPath)
+	defer C.free(unsafe.Pointer(pinPathC))
+	fd, err := C.get_pinned_obj_fd(pinPathC)
+	if fd < 0 {
+		return fmt.Errorf("error opening pinned map %q: %v", pinPath, err)
+	}
+	defer syscall.Close(int(fd))
+
+	var cinfo C.struct_bpf_map_info
+	if ret, err := C.bpf_obj_get_map_info(fd, &cinfo); ret != 0 {
+		return fmt.Errorf("error getting info of pinned map %q: %v", pinPath, err)
+	}
+	info := pinnedMapInfo{
+		mapType:    uint32(cinfo._type),
+		keySize:    uint32(cinfo.key_size),
+		valueSize:  uint32(cinfo.value_size),
+		maxEntries: uint32(cinfo.max_entries),
+		flags:      uint32(cinfo.map_flags),
+	}
+	mismatch := info.mismatch(def)
+	if mismatch == "" {
+		return nil
+	}
+	if !replace {
+		return fmt.Errorf("pinned map %q doesn't match its definition: %s", pinPath, mismatch)
+	}
+	if err := syscall.Unlink(pinPath); err != nil {
+		return fmt.Errorf("error replacing pinned map %q: %v", pinPath, err)
+	}
+	return nil
+}
+
 func pinObject(fd int, pinPath string) error {
 	mounted, err := bpffs.IsMounted()
 	if err != nil {
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+
+	"github.com/vietanhduong/gobpf/pkg/ringbuf"
+)
+
+/*
+#include <linux/bpf.h>
+*/
+import "C"
+
+// RingBuf reads the records of a ring buffer map, of type
+// BPF_MAP_TYPE_RINGBUF: Read returns the samples the BPF programs output,
+// in the order they were reserved across all CPUs, skipping discarded
+// records. See ringbuf.Reader.
+type RingBuf struct {
+	*ringbuf.Reader
+}
+
+// InitRingBuf maps the ring buffer mapName of the module for its records to
+// be read. The RingBuf must be closed before the module.
+func InitRingBuf(b *Module, mapName string) (*RingBuf, error) {
+	m, ok := b.maps[mapName]
+	if !ok {
+		return nil, fmt.Errorf("no map with name %s", mapName)
+	}
+	if m.m.def._type != C.BPF_MAP_TYPE_RINGBUF {
+		return nil, fmt.Errorf("%q is not a ring buffer map", mapName)
+	}
+	r, err := ringbuf.NewReader(int(m.m.fd), int(m.m.def.max_entries))
+	if err != nil {
+		return nil, fmt.Errorf("cannot map ring buffer %q: %v", mapName, err)
+	}
+	return &RingBuf{r}, nil
+}
@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+
+extern int bpf_prog_attach(int prog_fd, int target_fd, enum bpf_attach_type type);
+extern int bpf_prog_detach(int prog_fd, int target_fd, enum bpf_attach_type type);
+*/
+import "C"
+
+// SockMapProgram represents a sk_msg or sk_skb program, attached to the
+// SOCKMAP or SOCKHASH maps whose sockets it handles
+type SockMapProgram struct {
+	Name       string
+	insns      *C.struct_bpf_insn
+	fd         int
+	attachType uint32
+}
+
+// sockMapAttachType returns how the sk_msg or sk_skb programs of the given
+// section are attached to sockmaps.
+func sockMapAttachType(secName string) (uint32, bool) {
+	switch {
+	case strings.HasPrefix(secName, "sk_msg"):
+		return C.BPF_SK_MSG_VERDICT, true
+	case secName == "sk_skb/stream_parser" || strings.HasPrefix(secName, "sk_skb/stream_parser/"):
+		return C.BPF_SK_SKB_STREAM_PARSER, true
+	case secName == "sk_skb/stream_verdict" || strings.HasPrefix(secName, "sk_skb/stream_verdict/"):
+		return C.BPF_SK_SKB_STREAM_VERDICT, true
+	case secName == "sk_skb/verdict" || strings.HasPrefix(secName, "sk_skb/verdict/"):
+		return C.BPF_SK_SKB_VERDICT, true
+	}
+	return 0, false
+}
+
+func isSockMap(m *Map) bool {
+	return m.m.def._type == C.BPF_MAP_TYPE_SOCKMAP || m.m.def._type == C.BPF_MAP_TYPE_SOCKHASH
+}
+
+// AttachSockMapProgram attaches the sk_msg or sk_skb program identified by
+// secName to the SOCKMAP or SOCKHASH map m. The section name tells how:
+// sk_msg programs are run on the messages sent on the sockets of the map,
+// sk_skb/stream_parser and sk_skb/stream_verdict programs on the data they
+// receive. The program stays attached as long as the map exists.
+func (b *Module) AttachSockMapProgram(secName string, m *Map) error {
+	prog, ok := b.sockMapPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such sockmap program %q", secName)
+	}
+	if !isSockMap(m) {
+		return fmt.Errorf("map %q is not a sockmap", m.Name)
+	}
+	ret, err := C.bpf_prog_attach(C.int(prog.fd), C.int(m.m.fd), prog.attachType)
+	if ret < 0 {
+		return fmt.Errorf("failed to attach prog %q to sockmap %q: %v", secName, m.Name, err)
+	}
+	return nil
+}
+
+// DetachSockMapProgram detaches the program identified by secName from the
+// SOCKMAP or SOCKHASH map m.
+func (b *Module) DetachSockMapProgram(secName string, m *Map) error {
+	prog, ok := b.sockMapPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such sockmap program %q", secName)
+	}
+	ret, err := C.bpf_prog_detach(C.int(prog.fd), C.int(m.m.fd), prog.attachType)
+	if ret < 0 {
+		return fmt.Errorf("failed to detach prog %q from sockmap %q: %v", secName, m.Name, err)
+	}
+	return nil
+}
+
+// UpdateSockMap stores the socket sockFd in key of the SOCKMAP or SOCKHASH
+// map m, replacing the socket stored there. The map doesn't keep a
+// reference to the fd: the socket is removed from the map when it's closed.
+func (b *Module) UpdateSockMap(m *Map, key unsafe.Pointer, sockFd int) error {
+	if !isSockMap(m) {
+		return fmt.Errorf("map %q is not a sockmap", m.Name)
+	}
+	// the value is the socket fd, as a 32 or 64 bit integer
+	value32, value64 := uint32(sockFd), uint64(sockFd)
+	value := unsafe.Pointer(&value32)
+	if m.m.def.value_size == 8 {
+		value = unsafe.Pointer(&value64)
+	}
+	if err := b.UpdateElement(m, key, value, C.BPF_ANY); err != nil {
+		return fmt.Errorf("error storing socket %d in %q: %v", sockFd, m.Name, err)
+	}
+	return nil
+}
+
+// DeleteSockMap removes the socket stored in key of the SOCKMAP or SOCKHASH
+// map m.
+func (b *Module) DeleteSockMap(m *Map, key unsafe.Pointer) error {
+	if !isSockMap(m) {
+		return fmt.Errorf("map %q is not a sockmap", m.Name)
+	}
+	if err := b.DeleteElement(m, key); err != nil {
+		return fmt.Errorf("error removing socket from %q: %v", m.Name, err)
+	}
+	return nil
+}
+
+// IterSockMapPrograms returns a channel that emits the sk_msg and sk_skb
+// programs included in the module.
+func (b *Module) IterSockMapPrograms() <-chan *SockMapProgram {
+	ch := make(chan *SockMapProgram)
+	go func() {
+		for name := range b.sockMapPrograms {
+			ch <- b.sockMapPrograms[name]
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (b *Module) SockMapProgram(name string) *SockMapProgram {
+	return b.sockMapPrograms[name]
+}
+
+func (p *SockMapProgram) Fd() int {
+	return p.fd
+}
+
+func (b *Module) closeSockMapPrograms() error {
+	for _, program := range b.sockMapPrograms {
+		if err := syscall.Close(program.fd); err != nil {
+			return fmt.Errorf("error closing sockmap program fd: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+*/
+import "C"
+
+// elfReloc is a relocation of a data section.
+type elfReloc struct {
+	offset uint64
+	symbol elf.Symbol
+}
+
+// readRelocations decodes the relocations of a REL section.
+func (b *Module) readRelocations(rel *elf.Section, symbols []elf.Symbol) ([]elfReloc, error) {
+	data, err := rel.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var relocs []elfReloc
+	br := bytes.NewReader(data)
+	for {
+		var offset, symNo uint64
+		switch b.file.Class {
+		case elf.ELFCLASS64:
+			var rel elf.Rel64
+			if err := binary.Read(br, b.file.ByteOrder, &rel); err != nil {
+				if err == io.EOF {
+					return relocs, nil
+				}
+				return nil, err
+			}
+			offset, symNo = rel.Off, rel.Info>>32
+		case elf.ELFCLASS32:
+			var rel elf.Rel32
+			if err := binary.Read(br, b.file.ByteOrder, &rel); err != nil {
+				if err == io.EOF {
+					return relocs, nil
+				}
+				return nil, err
+			}
+			offset, symNo = uint64(rel.Off), uint64(rel.Info>>8)
+		default:
+			return nil, errors.New("architecture not supported")
+		}
+		if symNo == 0 || symNo > uint64(len(symbols)) {
+			return nil, fmt.Errorf("relocation at %d: invalid symbol %d", offset, symNo)
+		}
+		relocs = append(relocs, elfReloc{offset: offset, symbol: symbols[symNo-1]})
+	}
+}
+
+// mapInitValues returns the symbols the BTF-defined maps of the .maps
+// section are initialised with, by map name and index. libbpf declares
+// such maps as
+//
+//	struct {
+//		__uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+//		__uint(max_entries, 2);
+//		__type(key, __u32);
+//		__array(values, int (void *));
+//	} jmp_table SEC(".maps") = {
+//		.values = { [1] = &tail_prog },
+//	};
+//
+// for which the compiler emits a relocation of .maps for each value.
+func (b *Module) mapInitValues() (map[string]map[uint32]string, error) {
+	var rel *elf.Section
+	for i, section := range b.file.Sections {
+		if section.Name != ".maps" {
+			continue
+		}
+		for _, s := range b.file.Sections {
+			if s.Type == elf.SHT_REL && s.Info == uint32(i) {
+				rel = s
+			}
+		}
+	}
+	if rel == nil || b.btf == nil {
+		return nil, nil
+	}
+
+	specs, err := b.btf.mapSpecs(".maps")
+	if err != nil {
+		return nil, fmt.Errorf("error reading BTF map definitions: %v", err)
+	}
+	symbols, err := b.file.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	relocs, err := b.readRelocations(rel, symbols)
+	if err != nil {
+		return nil, err
+	}
+	return btfMapInitValues(specs, relocs)
+}
+
+// btfMapInitValues maps the relocations of the .maps section to the values
+// of the map definitions they fall in.
+func btfMapInitValues(specs []*btfMapSpec, relocs []elfReloc) (map[string]map[uint32]string, error) {
+	sorted := make([]*btfMapSpec, len(specs))
+	copy(sorted, specs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+
+	inits := make(map[string]map[uint32]string)
+	for _, rel := range relocs {
+		i := sort.Search(len(sorted), func(i int) bool { return uint64(sorted[i].offset) > rel.offset })
+		if i == 0 {
+			return nil, fmt.Errorf("relocation at %d of .maps doesn't belong to a map", rel.offset)
+		}
+		spec := sorted[i-1]
+		start := uint64(spec.offset + spec.valuesOffset)
+		if !spec.hasValues || rel.offset < start || (rel.offset-start)%8 != 0 {
+			return nil, fmt.Errorf("map %q: unexpected relocation at %d", spec.name, rel.offset)
+		}
+		index := uint32((rel.offset - start) / 8)
+		if index >= spec.maxEntries {
+			return nil, fmt.Errorf("map %q: value %d beyond max entries %d", spec.name, index, spec.maxEntries)
+		}
+		if inits[spec.name] == nil {
+			inits[spec.name] = make(map[uint32]string)
+		}
+		inits[spec.name][index] = rel.symbol.Name
+	}
+	return inits, nil
+}
+
+// initializeTailCalls stores the loaded programs in the prog arrays that
+// are initialised with them, either in the BTF map definition, as returned
+// by mapInitValues, or with the TailCalls parameter of the map's section.
+func (b *Module) initializeTailCalls(inits map[string]map[uint32]string, params map[string]SectionParams) error {
+	tailCalls := make(map[string]map[uint32]string)
+	for name, values := range inits {
+		if m, ok := b.maps[name]; ok && m.m.def._type == C.BPF_MAP_TYPE_PROG_ARRAY {
+			tailCalls[name] = values
+		}
+	}
+	for secName, p := range params {
+		if len(p.TailCalls) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(secName, "maps/") {
+			return fmt.Errorf("section %q: tail calls can only be set for maps", secName)
+		}
+		name := strings.TrimPrefix(secName, "maps/")
+		if tailCalls[name] == nil {
+			tailCalls[name] = make(map[uint32]string)
+		}
+		for index, progName := range p.TailCalls {
+			tailCalls[name][index] = progName
+		}
+	}
+
+	for name, progs := range tailCalls {
+		for index, progName := range progs {
+			prog, ok := b.programs[progName]
+			if !ok {
+				return fmt.Errorf("map %q: no program %q for tail call %d", name, progName, index)
+			}
+			if err := b.UpdateTailCall(name, index, prog); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Module) progArray(mapName string) (*Map, error) {
+	m, ok := b.maps[mapName]
+	if !ok {
+		return nil, fmt.Errorf("no map %q", mapName)
+	}
+	if m.m.def._type != C.BPF_MAP_TYPE_PROG_ARRAY {
+		return nil, fmt.Errorf("map %q is not a prog array", mapName)
+	}
+	return m, nil
+}
+
+// UpdateTailCall stores prog at index of the prog array mapName. The
+// program previously stored there, if any, is replaced atomically: a tail
+// call jumps either to the old or to the new program.
+func (b *Module) UpdateTailCall(mapName string, index uint32, prog *Program) error {
+	m, err := b.progArray(mapName)
+	if err != nil {
+		return err
+	}
+	fd := uint32(prog.fd)
+	if err := b.UpdateElement(m, unsafe.Pointer(&index), unsafe.Pointer(&fd), C.BPF_ANY); err != nil {
+		return fmt.Errorf("error setting tail call %d of %q to %q: %v", index, mapName, prog.Name, err)
+	}
+	return nil
+}
+
+// DeleteTailCall removes the program at index of the prog array mapName.
+// Tail calls to the index then fall through.
+func (b *Module) DeleteTailCall(mapName string, index uint32) error {
+	m, err := b.progArray(mapName)
+	if err != nil {
+		return err
+	}
+	if err := b.DeleteElement(m, unsafe.Pointer(&index)); err != nil {
+		return fmt.Errorf("error deleting tail call %d of %q: %v", index, mapName, err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+func TestBTFMapInitValues(t *testing.T) {
+	specs := []*btfMapSpec{
+		{name: "outer", offset: 32, maxEntries: 4, valuesOffset: 24, hasValues: true},
+		{name: "jmp_table", offset: 0, maxEntries: 2, valuesOffset: 16, hasValues: true},
+		{name: "counts", offset: 128},
+	}
+	relocs := []elfReloc{
+		{offset: 24, symbol: elf.Symbol{Name: "tail_b"}},
+		{offset: 16, symbol: elf.Symbol{Name: "tail_a"}},
+		{offset: 32 + 24 + 3*8, symbol: elf.Symbol{Name: "inner"}},
+	}
+
+	inits, err := btfMapInitValues(specs, relocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := inits["jmp_table"]; len(v) != 2 || v[0] != "tail_a" || v[1] != "tail_b" {
+		t.Errorf("unexpected jmp_table values: %v", v)
+	}
+	if v := inits["outer"]; len(v) != 1 || v[3] != "inner" {
+		t.Errorf("unexpected outer values: %v", v)
+	}
+
+	for _, off := range []uint64{8, 32 + 24 + 4*8, 68, 136} {
+		if _, err := btfMapInitValues(specs, []elfReloc{{offset: off}}); err == nil {
+			t.Errorf("expected error for relocation at %d", off)
+		}
+	}
+}
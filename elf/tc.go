@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/include/uapi -I${SRCDIR}/include
+
+#include <stdbool.h>
+#include <linux/bpf.h>
+#include <linux/pkt_cls.h>
+#include <linux/pkt_sched.h>
+#include "libbpf.h"
+*/
+import "C"
+
+// TCDirection is the direction of the traffic a classifier attached to a
+// clsact qdisc handles.
+type TCDirection int
+
+const (
+	TCIngress TCDirection = iota
+	TCEgress
+)
+
+func (d TCDirection) parent() (C.__u32, error) {
+	switch d {
+	case TCIngress:
+		return C.TC_H_CLSACT&C.TC_H_MAJ_MASK | C.TC_H_MIN_INGRESS&C.TC_H_MIN_MASK, nil
+	case TCEgress:
+		return C.TC_H_CLSACT&C.TC_H_MAJ_MASK | C.TC_H_MIN_EGRESS&C.TC_H_MIN_MASK, nil
+	}
+	return 0, fmt.Errorf("invalid tc direction %d", d)
+}
+
+// TCAttachOptions tell how a sched_cls program is attached.
+type TCAttachOptions struct {
+	// Handle and Priority identify the filter. The kernel picks them when
+	// they're 0.
+	Handle   uint32
+	Priority uint16
+	// DirectAction makes the return value of the program the action taken
+	// on the packet, e.g. TC_ACT_SHOT, rather than a class id.
+	DirectAction bool
+	// Replace replaces the filter with the same handle and priority
+	// instead of failing if it exists.
+	Replace bool
+}
+
+// TCFilter is a filter attached to a clsact qdisc.
+type TCFilter struct {
+	Handle   uint32
+	Priority uint16
+	Protocol uint16
+	// Kind is the kind of classifier, bpf for BPF programs.
+	Kind string
+	// Name and ProgramID are only set for BPF classifiers: Name is the
+	// name the program was attached with, i.e. its section name for the
+	// programs attached by AttachSchedProgram.
+	Name         string
+	ProgramID    uint32
+	DirectAction bool
+}
+
+func newTCFilter(f *C.struct_bpf_tc_filter) TCFilter {
+	return TCFilter{
+		Handle:       uint32(f.handle),
+		Priority:     uint16(f.priority),
+		Protocol:     uint16(f.protocol),
+		Kind:         C.GoString(&f.kind[0]),
+		Name:         C.GoString(&f.name[0]),
+		ProgramID:    uint32(f.prog_id),
+		DirectAction: f.flags&C.TCA_BPF_FLAG_ACT_DIRECT != 0,
+	}
+}
+
+func ifIndex(devName string) (int, error) {
+	iface, err := net.InterfaceByName(devName)
+	if err != nil {
+		return 0, fmt.Errorf("error resolving device %q: %v", devName, err)
+	}
+	return iface.Index, nil
+}
+
+// AddClsactQdisc adds a clsact qdisc to the device, to which sched_cls
+// programs are attached. It's not an error for the qdisc to exist already.
+func AddClsactQdisc(devName string) error {
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return err
+	}
+	ret := C.bpf_tc_qdisc_clsact(C.int(ifindex), true)
+	if ret < 0 && syscall.Errno(-ret) != syscall.EEXIST {
+		return fmt.Errorf("failed to add clsact qdisc to device %s: %v", devName, syscall.Errno(-ret))
+	}
+	return nil
+}
+
+// RemoveClsactQdisc removes the clsact qdisc of the device, along with all
+// the filters attached to it.
+func RemoveClsactQdisc(devName string) error {
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return err
+	}
+	if ret := C.bpf_tc_qdisc_clsact(C.int(ifindex), false); ret < 0 {
+		return fmt.Errorf("failed to remove clsact qdisc from device %s: %v", devName, syscall.Errno(-ret))
+	}
+	return nil
+}
+
+// AttachSchedProgram attaches the sched_cls program identified by secName
+// to the clsact qdisc of the device, see AddClsactQdisc, in the given
+// direction. It returns the filter created, whose handle and priority
+// identify it for RemoveTCFilter.
+func (b *Module) AttachSchedProgram(secName, devName string, direction TCDirection, options TCAttachOptions) (*TCFilter, error) {
+	prog, ok := b.schedPrograms[secName]
+	if !ok {
+		return nil, fmt.Errorf("no such sched program %q", secName)
+	}
+	if !strings.HasPrefix(secName, "sched_cls/") {
+		return nil, fmt.Errorf("program %q is not a classifier", secName)
+	}
+	parent, err := direction.parent()
+	if err != nil {
+		return nil, err
+	}
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter C.struct_bpf_tc_filter
+	filter.handle = C.__u32(options.Handle)
+	filter.priority = C.__u32(options.Priority)
+	if options.DirectAction {
+		filter.flags = C.TCA_BPF_FLAG_ACT_DIRECT
+	}
+	name := []byte(secName)
+	if len(name) >= len(filter.name) {
+		name = name[:len(filter.name)-1]
+	}
+	for i, c := range name {
+		filter.name[i] = C.char(c)
+	}
+
+	if ret := C.bpf_tc_attach(C.int(ifindex), parent, &filter, C.int(prog.fd), C.bool(options.Replace)); ret < 0 {
+		return nil, fmt.Errorf("failed to attach prog %q to device %s: %v", secName, devName, syscall.Errno(-ret))
+	}
+	f := newTCFilter(&filter)
+	return &f, nil
+}
+
+// RemoveTCFilter removes the filter with the given handle and priority
+// from the clsact qdisc of the device.
+func RemoveTCFilter(devName string, direction TCDirection, handle uint32, priority uint16) error {
+	if handle == 0 || priority == 0 {
+		return fmt.Errorf("filter handle and priority must be set")
+	}
+	parent, err := direction.parent()
+	if err != nil {
+		return err
+	}
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return err
+	}
+	if ret := C.bpf_tc_detach(C.int(ifindex), parent, C.__u32(handle), C.__u32(priority)); ret < 0 {
+		return fmt.Errorf("failed to remove filter %x from device %s: %v", handle, devName, syscall.Errno(-ret))
+	}
+	return nil
+}
+
+// ListTCFilters returns the filters attached to the clsact qdisc of the
+// device in the given direction.
+func ListTCFilters(devName string, direction TCDirection) ([]TCFilter, error) {
+	parent, err := direction.parent()
+	if err != nil {
+		return nil, err
+	}
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := make([]C.struct_bpf_tc_filter, 16)
+	for {
+		ret := C.bpf_tc_list(C.int(ifindex), parent, &filters[0], C.int(len(filters)))
+		if ret < 0 {
+			return nil, fmt.Errorf("failed to list filters of device %s: %v", devName, syscall.Errno(-ret))
+		}
+		if int(ret) > len(filters) {
+			filters = make([]C.struct_bpf_tc_filter, ret)
+			continue
+		}
+		result := make([]TCFilter, ret)
+		for i := range result {
+			result[i] = newTCFilter(&filters[i])
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/bpf.h>
+#include <linux/unistd.h>
+#include <string.h>
+#include <unistd.h>
+
+extern __u64 ptr_to_u64(void *);
+
+static int bpf_btf_get_next_id(__u32 start_id, __u32 *next_id)
+{
+	union bpf_attr attr;
+	int ret;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.start_id = start_id;
+
+	ret = syscall(__NR_bpf, BPF_BTF_GET_NEXT_ID, &attr, sizeof(attr));
+	if (ret == 0)
+		*next_id = attr.next_id;
+	return ret;
+}
+
+static int bpf_btf_get_fd_by_id(__u32 id)
+{
+	union bpf_attr attr;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.btf_id = id;
+
+	return syscall(__NR_bpf, BPF_BTF_GET_FD_BY_ID, &attr, sizeof(attr));
+}
+
+static int bpf_btf_get_name(int fd, char *name, __u32 name_len)
+{
+	struct bpf_btf_info info;
+	union bpf_attr attr;
+
+	memset(&info, 0, sizeof(info));
+	info.name = ptr_to_u64(name);
+	info.name_len = name_len;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.info.bpf_fd = fd;
+	attr.info.info_len = sizeof(info);
+	attr.info.info = ptr_to_u64(&info);
+
+	return syscall(__NR_bpf, BPF_OBJ_GET_INFO_BY_FD, &attr, sizeof(attr));
+}
+*/
+import "C"
+
+// kernelFuncBTFID returns the BTF ID of the kernel function fentry, fexit
+// and fmod_ret programs attach to, given as <function> or
+// <module>:<function>, in the BTF of the running kernel. Functions not found
+// in the kernel BTF are looked up
+// in the BTF of the loaded modules, in which case the fd of the module's BTF
+// object is returned as well; it is -1 otherwise.
+func (b *Module) kernelFuncBTFID(target string) (uint32, int, error) {
+	module, fn := "", target
+	if i := strings.IndexByte(target, ':'); i >= 0 {
+		module, fn = target[:i], target[i+1:]
+	}
+
+	vmlinux, err := b.vmlinuxBTFSpec()
+	if err != nil {
+		return 0, -1, fmt.Errorf("error loading kernel BTF: %v", err)
+	}
+	if module == "" || module == "vmlinux" {
+		if id, ok := vmlinux.findType(btfKindFunc, fn); ok {
+			return id, -1, nil
+		}
+		if module == "vmlinux" {
+			return 0, -1, fmt.Errorf("no kernel function %q", fn)
+		}
+	}
+
+	modules := []string{module}
+	if module == "" {
+		if modules, err = kernelBTFModules(); err != nil {
+			return 0, -1, err
+		}
+	}
+	for _, module := range modules {
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(DefaultKernelBTFPath), module))
+		if err != nil {
+			return 0, -1, fmt.Errorf("error reading BTF of module %q: %v", module, err)
+		}
+		spec, err := parseSplitBTF(data, vmlinux.byteOrder, vmlinux)
+		if err != nil {
+			return 0, -1, fmt.Errorf("error parsing BTF of module %q: %v", module, err)
+		}
+		for _, t := range spec.types[len(vmlinux.types):] {
+			if t.kind != btfKindFunc || t.name != fn {
+				continue
+			}
+			fd, err := moduleBTFFd(module)
+			if err != nil {
+				return 0, -1, err
+			}
+			return t.id, fd, nil
+		}
+	}
+	if module != "" {
+		return 0, -1, fmt.Errorf("no function %q in module %q", fn, module)
+	}
+	return 0, -1, fmt.Errorf("no kernel function %q", fn)
+}
+
+// vmlinuxBTFSpec returns the BTF of the running kernel, read from
+// DefaultKernelBTFPath on first use. Unlike kernelBTFSpec, it ignores
+// SetKernelBTFPath: the IDs of BTF from elsewhere, e.g. BTFHub, don't match
+// those of the running kernel.
+func (b *Module) vmlinuxBTFSpec() (*btfSpec, error) {
+	if b.vmlinuxBTF == nil {
+		spec, err := loadKernelBTF(DefaultKernelBTFPath)
+		if err != nil {
+			return nil, err
+		}
+		b.vmlinuxBTF = spec
+	}
+	return b.vmlinuxBTF, nil
+}
+
+// kernelBTFModules lists the kernel modules that have BTF.
+func kernelBTFModules() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(DefaultKernelBTFPath))
+	if err != nil {
+		return nil, fmt.Errorf("error listing module BTF: %v", err)
+	}
+	var modules []string
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(DefaultKernelBTFPath) {
+			modules = append(modules, entry.Name())
+		}
+	}
+	return modules, nil
+}
+
+// moduleBTFFd opens the BTF object the kernel loaded for the given module.
+func moduleBTFFd(module string) (int, error) {
+	name := make([]byte, 64)
+	var id C.__u32
+	for {
+		if ret, err := C.bpf_btf_get_next_id(id, &id); ret != 0 {
+			if err == syscall.ENOENT {
+				return -1, fmt.Errorf("no BTF object for module %q", module)
+			}
+			return -1, fmt.Errorf("error listing BTF objects: %v", err)
+		}
+		fd, err := C.bpf_btf_get_fd_by_id(id)
+		if fd < 0 {
+			if err == syscall.ENOENT {
+				// unloaded in the meantime
+				continue
+			}
+			return -1, fmt.Errorf("error opening BTF object %d: %v", id, err)
+		}
+		for i := range name {
+			name[i] = 0
+		}
+		if ret, err := C.bpf_btf_get_name(fd, (*C.char)(unsafe.Pointer(&name[0])), C.__u32(len(name))); ret != 0 {
+			syscall.Close(int(fd))
+			return -1, fmt.Errorf("error getting info of BTF object %d: %v", id, err)
+		}
+		if C.GoString((*C.char)(unsafe.Pointer(&name[0]))) == module {
+			return int(fd), nil
+		}
+		syscall.Close(int(fd))
+	}
+}
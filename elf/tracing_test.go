@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestKernelFuncBTFID(t *testing.T) {
+	b := newBTFBuilder()
+	intID := b.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+	protoID := b.add("", btfKindFuncProto, 0, false, intID)
+	b.add("do_unlinkat", btfKindStruct, 0, false, 0)
+	funcID := b.add("do_unlinkat", btfKindFunc, 1, false, protoID)
+	spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Module{vmlinuxBTF: spec}
+
+	for _, target := range []string{"do_unlinkat", "vmlinux:do_unlinkat"} {
+		id, fd, err := m.kernelFuncBTFID(target)
+		if err != nil || id != funcID || fd != -1 {
+			t.Errorf("%s: got %d, %d, %v; want %d, -1", target, id, fd, err, funcID)
+		}
+	}
+	if _, _, err := m.kernelFuncBTFID("vmlinux:do_rmdir"); err == nil {
+		t.Error("expected error for unknown function")
+	}
+}
+
+func TestKernelFuncBTFIDIgnoresKernelBTFPath(t *testing.T) {
+	build := func(types ...string) *btfSpec {
+		b := newBTFBuilder()
+		intID := b.add("int", btfKindInt, 0, false, 4, btfIntSigned<<24|32)
+		protoID := b.add("", btfKindFuncProto, 0, false, intID)
+		for _, name := range types {
+			b.add(name, btfKindFunc, 1, false, protoID)
+		}
+		spec, err := parseBTF(b.bytes(), binary.LittleEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spec
+	}
+	// the BTF CO-RE relocations are applied against, e.g. from BTFHub, has
+	// other IDs than the running kernel's
+	running := build("do_rmdir", "do_unlinkat")
+	m := &Module{
+		kernelBTF:     build("do_unlinkat"),
+		kernelBTFPath: "/nonexistent/vmlinux.btf",
+		vmlinuxBTF:    running,
+	}
+
+	id, _, err := m.kernelFuncBTFID("vmlinux:do_unlinkat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := running.findType(btfKindFunc, "do_unlinkat"); id != want {
+		t.Errorf("got ID %d, want %d from the running kernel", id, want)
+	}
+}
@@ -0,0 +1,494 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// LDCachePath is the cache of the libraries found by the dynamic linker,
+// where libraries given by name are looked up.
+var LDCachePath = "/etc/ld.so.cache"
+
+// DebugInfoPath is where separate debug info files are looked up, by build
+// ID and by path, when a binary is stripped.
+var DebugInfoPath = "/usr/lib/debug"
+
+const (
+	ldCacheMagic    = "ld.so-1.7.0"
+	ldCacheMagicNew = "glibc-ld.so.cache1.1"
+
+	ldCacheFlagTypeMask = 0x00ff
+	ldCacheFlagELFLibc6 = 0x0003
+	ldCacheFlagArchMask = 0xff00
+
+	// type of the build ID note
+	ntGNUBuildID = 3
+)
+
+// ldCacheArchFlags are the flags of the libraries of the architecture in
+// ld.so.cache, see sysdeps/generic/ldconfig.h in glibc.
+var ldCacheArchFlags = map[string]int32{
+	"386":     0x0000,
+	"amd64":   0x0300,
+	"arm64":   0x0a00,
+	"ppc64le": 0x0500,
+	"s390x":   0x0400,
+	"riscv64": 0x1000,
+}
+
+// ldCacheEntry is a library of ld.so.cache.
+type ldCacheEntry struct {
+	flags  int32
+	soname string
+	path   string
+}
+
+// parseLDCache decodes ld.so.cache, in the format of glibc 2.32 and later,
+// optionally preceded by the old format as written by earlier versions.
+func parseLDCache(data []byte) ([]ldCacheEntry, error) {
+	if bytes.HasPrefix(data, []byte(ldCacheMagic)) {
+		// header of 16 bytes and entries of 12, followed by the new
+		// format aligned to 8 bytes
+		if len(data) < 16 {
+			return nil, errors.New("truncated ld.so.cache")
+		}
+		nlibs := binary.LittleEndian.Uint32(data[12:16])
+		start := (16 + uint64(nlibs)*12 + 7) &^ 7
+		if start >= uint64(len(data)) {
+			return nil, errors.New("no entries in the new format in ld.so.cache")
+		}
+		data = data[start:]
+	}
+	if !bytes.HasPrefix(data, []byte(ldCacheMagicNew)) {
+		return nil, errors.New("unknown ld.so.cache format")
+	}
+	const headerSize, entrySize = 48, 24
+	if len(data) < headerSize {
+		return nil, errors.New("truncated ld.so.cache")
+	}
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if data[28]&0x3 == 3 {
+		// endianness in the flags of the header: 0 for unset, 2 for little
+		// and 3 for big
+		bo = binary.BigEndian
+	}
+	nlibs := bo.Uint32(data[20:24])
+	if uint64(headerSize)+uint64(nlibs)*entrySize > uint64(len(data)) {
+		return nil, errors.New("truncated ld.so.cache")
+	}
+
+	str := func(off uint32) (string, error) {
+		if uint64(off) >= uint64(len(data)) {
+			return "", fmt.Errorf("invalid string offset %d in ld.so.cache", off)
+		}
+		end := bytes.IndexByte(data[off:], 0)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string at %d in ld.so.cache", off)
+		}
+		return string(data[off : int(off)+end]), nil
+	}
+
+	entries := make([]ldCacheEntry, 0, nlibs)
+	for i := uint32(0); i < nlibs; i++ {
+		entry := data[headerSize+i*entrySize:]
+		soname, err := str(bo.Uint32(entry[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		path, err := str(bo.Uint32(entry[8:12]))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ldCacheEntry{
+			flags:  int32(bo.Uint32(entry[0:4])),
+			soname: soname,
+			path:   path,
+		})
+	}
+	return entries, nil
+}
+
+// matchLibrary tells whether the file name of a library is the library
+// given by name, either its soname, e.g. libc.so.6, or the name without
+// the lib prefix, e.g. c.
+func matchLibrary(fileName, name string) bool {
+	return fileName == name || strings.HasPrefix(fileName, "lib"+name+".so")
+}
+
+// findLibraryInCache returns the path of the library of the architecture
+// in the ld.so.cache at cachePath.
+func findLibraryInCache(cachePath, name string) (string, error) {
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading %q: %v", cachePath, err)
+	}
+	entries, err := parseLDCache(data)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %q: %v", cachePath, err)
+	}
+	arch, knownArch := ldCacheArchFlags[runtime.GOARCH]
+	for _, entry := range entries {
+		if entry.flags&ldCacheFlagTypeMask != ldCacheFlagELFLibc6 {
+			continue
+		}
+		if knownArch && entry.flags&ldCacheFlagArchMask != arch {
+			continue
+		}
+		if matchLibrary(entry.soname, name) {
+			return entry.path, nil
+		}
+	}
+	return "", fmt.Errorf("library %q not found in %q", name, cachePath)
+}
+
+// findLibraryInMaps returns the path of the library mapped by the process
+// pid, in the mount namespace of the process.
+func findLibraryInMaps(name string, pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return "", fmt.Errorf("error reading mappings of process %d: %v", pid, err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		if matchLibrary(filepath.Base(fields[5]), name) {
+			return fields[5], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("error reading mappings of process %d: %v", pid, err)
+	}
+	return "", fmt.Errorf("library %q not mapped by process %d", name, pid)
+}
+
+// procRoot returns the root directory of the mount namespace of the process
+// pid, e.g. of its container, as seen through /proc, or / for all
+// processes. Files of the process are opened through it rather than by
+// entering its namespace, which a multi-threaded Go program can't do.
+func procRoot(pid int) string {
+	if pid <= 0 {
+		return "/"
+	}
+	return fmt.Sprintf("/proc/%d/root", pid)
+}
+
+// defaultPath is where programs are looked up in processes without PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// processPath returns the PATH of the process pid.
+func processPath(pid int) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return defaultPath
+	}
+	for _, env := range bytes.Split(data, []byte{0}) {
+		if bytes.HasPrefix(env, []byte("PATH=")) {
+			return string(env[len("PATH="):])
+		}
+	}
+	return defaultPath
+}
+
+// findProgramInPath returns the path of the program name in the directories
+// of the process pid's PATH, in its mount namespace.
+func findProgramInPath(name string, pid int) (string, error) {
+	root := procRoot(pid)
+	for _, dir := range filepath.SplitList(processPath(pid)) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if st, err := os.Stat(filepath.Join(root, path)); err == nil && st.Mode().IsRegular() && st.Mode()&0o111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("program %q not found in PATH of process %d", name, pid)
+}
+
+// resolveBinaryPath returns the path of the program or library name: a
+// path, the name of a library, with or without the lib prefix, looked up
+// among the libraries of the process pid, if positive, and in ld.so.cache,
+// or the name of a program in PATH.
+//
+// For a positive pid, name is resolved in the mount namespace of the
+// process, and the path returned leads to it through procRoot, so that a
+// library in a container can be traced from the host.
+func resolveBinaryPath(name string, pid int) (string, error) {
+	if pid <= 0 {
+		if strings.Contains(name, "/") {
+			return name, nil
+		}
+		if path, err := findLibraryInCache(LDCachePath, name); err == nil {
+			return path, nil
+		}
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+		return "", fmt.Errorf("no library or program %q found", name)
+	}
+
+	root := procRoot(pid)
+	if strings.Contains(name, "/") {
+		if strings.HasPrefix(name, "/proc/") {
+			return name, nil
+		}
+		if !filepath.IsAbs(name) {
+			return filepath.Join(fmt.Sprintf("/proc/%d/cwd", pid), name), nil
+		}
+		return filepath.Join(root, name), nil
+	}
+	if path, err := findLibraryInMaps(name, pid); err == nil {
+		return filepath.Join(root, path), nil
+	}
+	if path, err := findLibraryInCache(filepath.Join(root, LDCachePath), name); err == nil {
+		return filepath.Join(root, path), nil
+	}
+	if path, err := findProgramInPath(name, pid); err == nil {
+		return filepath.Join(root, path), nil
+	}
+	return "", fmt.Errorf("no library or program %q found for process %d", name, pid)
+}
+
+// elfBuildID returns the build ID of the binary, from its
+// .note.gnu.build-id section.
+func elfBuildID(f *elf.File) (string, bool) {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return "", false
+	}
+	data, err := s.Data()
+	if err != nil || len(data) < 16 {
+		return "", false
+	}
+	// namesz, descsz and type, followed by the name "GNU" and the ID, each
+	// padded to 4 bytes
+	nameSize := f.ByteOrder.Uint32(data[0:4])
+	descSize := f.ByteOrder.Uint32(data[4:8])
+	start := 12 + (uint64(nameSize)+3)&^3
+	if f.ByteOrder.Uint32(data[8:12]) != ntGNUBuildID || start+uint64(descSize) > uint64(len(data)) {
+		return "", false
+	}
+	return hex.EncodeToString(data[start : start+uint64(descSize)]), true
+}
+
+// debugInfoFiles returns where the separate debug info of the binary at
+// path may be found, as gdb looks it up: by build ID, then by the name
+// given in its .gnu_debuglink section. root is the root directory of the
+// binary's mount namespace, see procRoot.
+func debugInfoFiles(f *elf.File, root, path string) []string {
+	var files []string
+	if id, ok := elfBuildID(f); ok && len(id) > 2 {
+		files = append(files, filepath.Join(root, DebugInfoPath, ".build-id", id[:2], id[2:]+".debug"))
+	}
+	if s := f.Section(".gnu_debuglink"); s != nil {
+		if data, err := s.Data(); err == nil {
+			if end := bytes.IndexByte(data, 0); end > 0 {
+				name := string(data[:end])
+				dir := filepath.Dir(path)
+				files = append(files,
+					filepath.Join(dir, name),
+					filepath.Join(dir, ".debug", name),
+					filepath.Join(root, DebugInfoPath, strings.TrimPrefix(dir, root), name))
+			}
+		}
+	}
+	return files
+}
+
+// funcSymbols returns the addresses of the functions defined in the symbol
+// tables of the binary, by name.
+func funcSymbols(f *elf.File) map[string]uint64 {
+	addrs := make(map[string]uint64)
+	for _, symbols := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		syms, err := symbols()
+		if err != nil {
+			continue
+		}
+		for _, sym := range syms {
+			typ := elf.ST_TYPE(sym.Info)
+			if typ != elf.STT_FUNC && typ != elf.STT_GNU_IFUNC {
+				continue
+			}
+			if sym.Section == elf.SHN_UNDEF || sym.Value == 0 {
+				continue
+			}
+			// dynamic symbols are versioned, e.g. malloc@@GLIBC_2.2.5
+			name := sym.Name
+			if i := strings.Index(name, "@"); i > 0 {
+				name = name[:i]
+			}
+			if _, ok := addrs[name]; !ok {
+				addrs[name] = sym.Value
+			}
+		}
+	}
+	return addrs
+}
+
+// addrFileOffset converts the virtual address of a function to the offset
+// in the file uprobes are attached at, from the segment it's loaded in. It
+// works the same for executables, position independent or not, and shared
+// libraries.
+func addrFileOffset(progs []*elf.Prog, addr uint64) (uint64, bool) {
+	for _, prog := range progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, true
+		}
+	}
+	return 0, false
+}
+
+// uprobeSymbol is a function of a binary, at offset in the file.
+type uprobeSymbol struct {
+	name   string
+	offset uint64
+}
+
+// binarySymbols returns the functions of the binary at path that match,
+// looking them up in its separate debug info too if it's stripped. See
+// debugInfoFiles for root.
+func binarySymbols(root, path string, match func(string) bool) ([]uprobeSymbol, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %v", path, err)
+	}
+	defer f.Close()
+
+	addrs := funcSymbols(f)
+	if f.Section(".symtab") == nil {
+		for _, file := range debugInfoFiles(f, root, path) {
+			debug, err := elf.Open(file)
+			if err != nil {
+				continue
+			}
+			for name, addr := range funcSymbols(debug) {
+				if _, ok := addrs[name]; !ok {
+					addrs[name] = addr
+				}
+			}
+			debug.Close()
+			break
+		}
+	}
+
+	var symbols []uprobeSymbol
+	for name, addr := range addrs {
+		if !match(name) {
+			continue
+		}
+		offset, ok := addrFileOffset(f.Progs, addr)
+		if !ok {
+			return nil, fmt.Errorf("symbol %q at %#x of %q is not in an executable segment", name, addr, path)
+		}
+		symbols = append(symbols, uprobeSymbol{name: name, offset: offset})
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].name < symbols[j].name })
+	return symbols, nil
+}
+
+// ResolveUprobeSymbol returns the path of the program or library name, and
+// the offset in it of the function symbol, which uprobes are attached at.
+// name is a path, the name of a library, e.g. libc.so.6 or c, looked up
+// among the libraries of the process pid, if positive, and in
+// ld.so.cache, or the name of a program in PATH.
+//
+// For a positive pid, name is resolved in the mount namespace of the
+// process, e.g. in its container, and the path returned leads to the binary
+// through /proc/<pid>/root.
+func ResolveUprobeSymbol(name, symbol string, pid int) (string, uint64, error) {
+	path, err := resolveBinaryPath(name, pid)
+	if err != nil {
+		return "", 0, err
+	}
+	symbols, err := binarySymbols(procRoot(pid), path, func(s string) bool { return s == symbol })
+	if err != nil {
+		return "", 0, err
+	}
+	if len(symbols) == 0 {
+		return "", 0, fmt.Errorf("symbol %q not found in %q", symbol, path)
+	}
+	return path, symbols[0].offset, nil
+}
+
+// AttachProcessUprobe attaches the uprobe to the program or library at the
+// given path and offset in the process pid. path is in the mount namespace
+// of the process, e.g. the path of a library in its container.
+func AttachProcessUprobe(uprobe *Uprobe, path string, offset uint64, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("invalid pid %d", pid)
+	}
+	path, err := resolveBinaryPath(path, pid)
+	if err != nil {
+		return err
+	}
+	return attachUprobe(uprobe, path, offset, 0, pid)
+}
+
+// AttachUprobeSymbol attaches the uprobe to the function symbol of the
+// program or library name, see ResolveUprobeSymbol, in the process pid,
+// or in all processes if pid is -1.
+func AttachUprobeSymbol(uprobe *Uprobe, name, symbol string, pid int) error {
+	path, offset, err := ResolveUprobeSymbol(name, symbol, pid)
+	if err != nil {
+		return err
+	}
+	return attachUprobe(uprobe, path, offset, 0, pid)
+}
+
+// AttachMatchingUprobes attaches the uprobe to all the functions of the
+// program or library name, see ResolveUprobeSymbol, whose symbol matches
+// the regular expression match, in the process pid, or in all processes if
+// pid is -1. Aliases of a function are only attached once.
+func AttachMatchingUprobes(uprobe *Uprobe, name, match string, pid int) error {
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", match, err)
+	}
+	path, err := resolveBinaryPath(name, pid)
+	if err != nil {
+		return err
+	}
+	symbols, err := binarySymbols(procRoot(pid), path, re.MatchString)
+	if err != nil {
+		return err
+	}
+	if len(symbols) == 0 {
+		return fmt.Errorf("no symbols matching %s for %s found", match, name)
+	}
+	attached := make(map[uint64]bool)
+	for _, symbol := range symbols {
+		if attached[symbol.offset] {
+			continue
+		}
+		if err := attachUprobe(uprobe, path, symbol.offset, 0, pid); err != nil {
+			return fmt.Errorf("error attaching uprobe to %q: %v", symbol.name, err)
+		}
+		attached[symbol.offset] = true
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// buildLDCache encodes entries in the new format of ld.so.cache, preceded
+// by an old format header without entries if old is set.
+func buildLDCache(entries []ldCacheEntry, old bool) []byte {
+	const headerSize, entrySize = 48, 24
+	data := make([]byte, headerSize+len(entries)*entrySize)
+	copy(data, ldCacheMagicNew)
+	binary.LittleEndian.PutUint32(data[20:24], uint32(len(entries)))
+	data[28] = 2
+	for i, entry := range entries {
+		e := data[headerSize+i*entrySize:]
+		binary.LittleEndian.PutUint32(e[0:4], uint32(entry.flags))
+		binary.LittleEndian.PutUint32(e[4:8], uint32(len(data)))
+		data = append(data, entry.soname+"\x00"...)
+		e = data[headerSize+i*entrySize:]
+		binary.LittleEndian.PutUint32(e[8:12], uint32(len(data)))
+		data = append(data, entry.path+"\x00"...)
+	}
+	if old {
+		header := make([]byte, 16)
+		copy(header, ldCacheMagic)
+		data = append(header, data...)
+	}
+	return data
+}
+
+func TestParseLDCache(t *testing.T) {
+	entries := []ldCacheEntry{
+		{flags: 0x0303, soname: "libc.so.6", path: "/lib/x86_64-linux-gnu/libc.so.6"},
+		{flags: 0x0003, soname: "libc.so.6", path: "/lib/i386-linux-gnu/libc.so.6"},
+	}
+
+	for _, old := range []bool{false, true} {
+		parsed, err := parseLDCache(buildLDCache(entries, old))
+		if err != nil {
+			t.Fatalf("old %v: %v", old, err)
+		}
+		if len(parsed) != len(entries) {
+			t.Fatalf("old %v: expected %d entries but got %d", old, len(entries), len(parsed))
+		}
+		for i := range entries {
+			if parsed[i] != entries[i] {
+				t.Fatalf("old %v: expected %+v but got %+v", old, entries[i], parsed[i])
+			}
+		}
+	}
+
+	if _, err := parseLDCache([]byte("garbage")); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+	data := buildLDCache(entries, false)
+	if _, err := parseLDCache(data[:60]); err == nil {
+		t.Fatal("expected an error for a truncated cache")
+	}
+}
+
+func TestMatchLibrary(t *testing.T) {
+	tests := []struct {
+		fileName string
+		name     string
+		expected bool
+	}{
+		{fileName: "libc.so.6", name: "c", expected: true},
+		{fileName: "libc.so.6", name: "libc.so.6", expected: true},
+		{fileName: "libcrypto.so.3", name: "c", expected: false},
+		{fileName: "libpthread.so.0", name: "pthread", expected: true},
+	}
+
+	for _, tt := range tests {
+		if matchLibrary(tt.fileName, tt.name) != tt.expected {
+			t.Fatalf("%q %q: expected %v", tt.fileName, tt.name, tt.expected)
+		}
+	}
+}
+
+func TestAddrFileOffset(t *testing.T) {
+	progs := []*elf.Prog{
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Flags: elf.PF_R, Off: 0, Vaddr: 0, Memsz: 0x25388}},
+		{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Off: 0x26000, Vaddr: 0x426000, Memsz: 0x15503c}},
+	}
+
+	if offset, ok := addrFileOffset(progs, 0x498920); !ok || offset != 0x98920 {
+		t.Fatalf("expected offset 0x98920 but got %#x, %v", offset, ok)
+	}
+	if _, ok := addrFileOffset(progs, 0x1000); ok {
+		t.Fatal("expected no offset for an address of a segment that's not executable")
+	}
+}
+
+func TestResolveBinaryPathInProcess(t *testing.T) {
+	pid := os.Getpid()
+	root := fmt.Sprintf("/proc/%d/root", pid)
+
+	for _, name := range []string{"/bin/sh", "sh"} {
+		path, err := resolveBinaryPath(name, pid)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		if !strings.HasPrefix(path, root+"/") {
+			t.Fatalf("%q: expected a path in %q but got %q", name, root, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+
+	if path, err := resolveBinaryPath("/bin/sh", -1); err != nil || path != "/bin/sh" {
+		t.Fatalf("expected /bin/sh for all processes but got %q, %v", path, err)
+	}
+}
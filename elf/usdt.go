@@ -0,0 +1,564 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package elf
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// type and owner of the notes of sys/sdt.h
+	ntStapSDT    = 3
+	stapSDTOwner = "stapsdt"
+
+	// USDTMaxArgs is the maximum number of arguments of a probe, as
+	// sys/sdt.h defines it.
+	USDTMaxArgs = 12
+)
+
+// USDTArgKind tells where the value of an argument of a USDT probe is.
+type USDTArgKind uint32
+
+const (
+	// USDTArgConst is a constant, Value.
+	USDTArgConst USDTArgKind = iota
+	// USDTArgReg is in the register at RegOffset in struct pt_regs.
+	USDTArgReg
+	// USDTArgRegDeref is in memory, at Value bytes from the address in the
+	// register at RegOffset in struct pt_regs.
+	USDTArgRegDeref
+)
+
+// USDTArg is an argument of a USDT probe, decoded from its specification
+// in the note of the probe, e.g. -4@%eax or 8@-8(%rbp) on x86-64.
+type USDTArg struct {
+	// Size is the size of the argument, in bytes.
+	Size   int
+	Signed bool
+	Kind   USDTArgKind
+	// Register is the name of the register, as given by the specification,
+	// unless the argument is a constant.
+	Register  string
+	RegOffset int
+	// Value is the constant, or the offset from the register.
+	Value int64
+}
+
+// USDTProbe is a location of a USDT probe, defined by the DTRACE_PROBE
+// macros of sys/sdt.h. A probe used in several places of a binary has a
+// location for each of them.
+type USDTProbe struct {
+	Provider string
+	Name     string
+	// Address is the virtual address of the probe in the binary, and
+	// Offset its offset in the file, which uprobes are attached at.
+	Address uint64
+	Offset  uint64
+	// SemaphoreAddress and SemaphoreOffset locate the semaphore of the
+	// probe, if any: a counter tracers increment to tell the program the
+	// probe is enabled, which then evaluates the arguments.
+	SemaphoreAddress uint64
+	SemaphoreOffset  uint64
+	// ArgSpec is the specification of the arguments in the note of the
+	// probe, decoded into Args.
+	ArgSpec string
+	Args    []USDTArg
+}
+
+// USDTSpecArg is an argument of a USDTSpec.
+type USDTSpecArg struct {
+	Value     int64
+	Kind      USDTArgKind
+	RegOffset int16
+	Size      uint8
+	Signed    uint8
+}
+
+// USDTSpec is the layout of the arguments of a probe for BPF programs,
+// which reads them from the struct pt_regs of the probe, e.g. stored in a
+// map keyed by the address of the probe:
+//
+//	struct usdt_arg {
+//		__s64 value;
+//		__u32 kind;
+//		__s16 reg_off;
+//		__u8 size;
+//		__u8 is_signed;
+//	};
+//
+//	struct usdt_spec {
+//		struct usdt_arg args[12];
+//		__u32 arg_cnt;
+//	};
+type USDTSpec struct {
+	Args   [USDTMaxArgs]USDTSpecArg
+	ArgCnt uint32
+}
+
+// Spec returns the specification of the arguments of the probe for BPF
+// programs.
+func (p *USDTProbe) Spec() USDTSpec {
+	var spec USDTSpec
+	for i, arg := range p.Args {
+		spec.Args[i] = USDTSpecArg{
+			Value:     arg.Value,
+			Kind:      arg.Kind,
+			RegOffset: int16(arg.RegOffset),
+			Size:      uint8(arg.Size),
+		}
+		if arg.Signed {
+			spec.Args[i].Signed = 1
+		}
+	}
+	spec.ArgCnt = uint32(len(p.Args))
+	return spec
+}
+
+// usdtRegisters are the offsets of the registers in struct pt_regs, by
+// name, for the machines whose argument specifications are known.
+var usdtRegisters = map[elf.Machine]map[string]int{
+	elf.EM_X86_64:  x86_64Registers(),
+	elf.EM_AARCH64: aarch64Registers(),
+}
+
+func x86_64Registers() map[string]int {
+	regs := make(map[string]int)
+	for off, names := range map[int][]string{
+		0:   {"r15", "r15d", "r15w", "r15b"},
+		8:   {"r14", "r14d", "r14w", "r14b"},
+		16:  {"r13", "r13d", "r13w", "r13b"},
+		24:  {"r12", "r12d", "r12w", "r12b"},
+		32:  {"rbp", "ebp", "bp", "bpl"},
+		40:  {"rbx", "ebx", "bx", "bl"},
+		48:  {"r11", "r11d", "r11w", "r11b"},
+		56:  {"r10", "r10d", "r10w", "r10b"},
+		64:  {"r9", "r9d", "r9w", "r9b"},
+		72:  {"r8", "r8d", "r8w", "r8b"},
+		80:  {"rax", "eax", "ax", "al"},
+		88:  {"rcx", "ecx", "cx", "cl"},
+		96:  {"rdx", "edx", "dx", "dl"},
+		104: {"rsi", "esi", "si", "sil"},
+		112: {"rdi", "edi", "di", "dil"},
+		128: {"rip"},
+		152: {"rsp", "esp", "sp", "spl"},
+	} {
+		for _, name := range names {
+			regs[name] = off
+		}
+	}
+	return regs
+}
+
+func aarch64Registers() map[string]int {
+	regs := map[string]int{"sp": 31 * 8}
+	for i := 0; i <= 30; i++ {
+		regs[fmt.Sprintf("x%d", i)] = i * 8
+		regs[fmt.Sprintf("w%d", i)] = i * 8
+	}
+	return regs
+}
+
+// splitUSDTArgs splits the specification of the arguments of a probe,
+// separated by spaces, some of which are part of the arguments on arm64,
+// e.g. 8@[sp, 16].
+func splitUSDTArgs(spec string) []string {
+	var args []string
+	var depth int
+	start := -1
+	for i, c := range spec {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ' ' && depth == 0:
+			if start >= 0 {
+				args = append(args, spec[start:i])
+			}
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		args = append(args, spec[start:])
+	}
+	return args
+}
+
+// parseUSDTArgs decodes the specification of the arguments of a probe of a
+// binary for the machine.
+func parseUSDTArgs(spec string, machine elf.Machine) ([]USDTArg, error) {
+	regs, ok := usdtRegisters[machine]
+	if !ok {
+		return nil, fmt.Errorf("USDT arguments of %v binaries are not supported", machine)
+	}
+	specs := splitUSDTArgs(spec)
+	if len(specs) > USDTMaxArgs {
+		return nil, fmt.Errorf("too many USDT arguments in %q", spec)
+	}
+	args := make([]USDTArg, 0, len(specs))
+	for _, s := range specs {
+		arg, err := parseUSDTArg(s, machine, regs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid USDT argument %q: %v", s, err)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func parseUSDTArg(spec string, machine elf.Machine, regs map[string]int) (USDTArg, error) {
+	// [-]size@location, the size defaulting to a long
+	arg := USDTArg{Size: 8}
+	loc := spec
+	if i := strings.Index(spec, "@"); i >= 0 {
+		size, err := strconv.Atoi(spec[:i])
+		if err != nil {
+			return arg, errors.New("invalid size")
+		}
+		if size < 0 {
+			arg.Signed, size = true, -size
+		}
+		if size != 1 && size != 2 && size != 4 && size != 8 {
+			return arg, fmt.Errorf("invalid size %d", size)
+		}
+		arg.Size, loc = size, spec[i+1:]
+	}
+
+	register := func(name string) error {
+		off, ok := regs[name]
+		if !ok {
+			return fmt.Errorf("unknown register %q", name)
+		}
+		arg.Register, arg.RegOffset = name, off
+		return nil
+	}
+
+	var err error
+	switch machine {
+	case elf.EM_X86_64:
+		switch {
+		case strings.HasPrefix(loc, "$"):
+			// $imm
+			arg.Kind = USDTArgConst
+			arg.Value, err = strconv.ParseInt(loc[1:], 0, 64)
+		case strings.HasPrefix(loc, "%"):
+			// %reg
+			arg.Kind = USDTArgReg
+			err = register(loc[1:])
+		case strings.HasSuffix(loc, ")"):
+			// [off](%reg)
+			i := strings.Index(loc, "(")
+			if i < 0 || !strings.HasPrefix(loc[i+1:], "%") {
+				return arg, errors.New("invalid memory operand")
+			}
+			arg.Kind = USDTArgRegDeref
+			if i > 0 {
+				if arg.Value, err = strconv.ParseInt(loc[:i], 0, 64); err != nil {
+					return arg, errors.New("unsupported memory operand")
+				}
+			}
+			err = register(loc[i+2 : len(loc)-1])
+		default:
+			return arg, errors.New("unsupported location")
+		}
+	case elf.EM_AARCH64:
+		switch {
+		case strings.HasPrefix(loc, "[") && strings.HasSuffix(loc, "]"):
+			// [reg] or [reg, off]
+			arg.Kind = USDTArgRegDeref
+			parts := strings.SplitN(loc[1:len(loc)-1], ",", 2)
+			if len(parts) == 2 {
+				if arg.Value, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 0, 64); err != nil {
+					return arg, errors.New("invalid memory operand")
+				}
+			}
+			err = register(strings.TrimSpace(parts[0]))
+		case loc != "" && (loc[0] == '-' || loc[0] >= '0' && loc[0] <= '9'):
+			arg.Kind = USDTArgConst
+			arg.Value, err = strconv.ParseInt(loc, 0, 64)
+		default:
+			arg.Kind = USDTArgReg
+			err = register(loc)
+		}
+	}
+	return arg, err
+}
+
+// parseUSDTNotes decodes the probes of the .note.stapsdt section of the
+// binary.
+func parseUSDTNotes(f *elf.File) ([]USDTProbe, error) {
+	s := f.Section(".note.stapsdt")
+	if s == nil {
+		return nil, nil
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil, fmt.Errorf("error reading .note.stapsdt: %v", err)
+	}
+	addrSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		addrSize = 4
+	}
+	addr := func(b []byte) uint64 {
+		if addrSize == 4 {
+			return uint64(f.ByteOrder.Uint32(b))
+		}
+		return f.ByteOrder.Uint64(b)
+	}
+	// the probes are relative to the address of .stapsdt.base the binary
+	// was linked with, which prelink may have changed since
+	var baseAddr uint64
+	if base := f.Section(".stapsdt.base"); base != nil {
+		baseAddr = base.Addr
+	}
+
+	var probes []USDTProbe
+	for len(data) > 0 {
+		// namesz, descsz and type, followed by the name and the
+		// description, each padded to 4 bytes
+		if len(data) < 12 {
+			return nil, errors.New("truncated note in .note.stapsdt")
+		}
+		nameSize := uint64(f.ByteOrder.Uint32(data[0:4]))
+		descSize := uint64(f.ByteOrder.Uint32(data[4:8]))
+		typ := f.ByteOrder.Uint32(data[8:12])
+		descStart := 12 + (nameSize+3)&^3
+		next := descStart + (descSize+3)&^3
+		if next > uint64(len(data)) {
+			return nil, errors.New("truncated note in .note.stapsdt")
+		}
+		name := string(bytes.TrimRight(data[12:12+nameSize], "\x00"))
+		desc := data[descStart : descStart+descSize]
+		data = data[next:]
+		if typ != ntStapSDT || name != stapSDTOwner {
+			continue
+		}
+
+		// pc, base and semaphore addresses, followed by the provider, the
+		// name and the arguments, each null terminated
+		if len(desc) < 3*addrSize {
+			return nil, errors.New("truncated USDT note")
+		}
+		probe := USDTProbe{
+			Address:          addr(desc[0:]),
+			SemaphoreAddress: addr(desc[2*addrSize:]),
+		}
+		if noteBase := addr(desc[addrSize:]); baseAddr != 0 && noteBase != 0 {
+			probe.Address += baseAddr - noteBase
+			if probe.SemaphoreAddress != 0 {
+				probe.SemaphoreAddress += baseAddr - noteBase
+			}
+		}
+		strs := bytes.SplitN(desc[3*addrSize:], []byte{0}, 4)
+		if len(strs) < 4 {
+			return nil, errors.New("truncated USDT note")
+		}
+		probe.Provider, probe.Name, probe.ArgSpec = string(strs[0]), string(strs[1]), string(strs[2])
+		if probe.Args, err = parseUSDTArgs(probe.ArgSpec, f.Machine); err != nil {
+			return nil, fmt.Errorf("probe %s:%s: %v", probe.Provider, probe.Name, err)
+		}
+
+		var ok bool
+		if probe.Offset, ok = addrFileOffset(f.Progs, probe.Address); !ok {
+			return nil, fmt.Errorf("probe %s:%s at %#x is not in an executable segment", probe.Provider, probe.Name, probe.Address)
+		}
+		if probe.SemaphoreAddress != 0 {
+			if probe.SemaphoreOffset, ok = dataFileOffset(f.Progs, probe.SemaphoreAddress); !ok {
+				return nil, fmt.Errorf("semaphore of probe %s:%s at %#x is not in a segment", probe.Provider, probe.Name, probe.SemaphoreAddress)
+			}
+		}
+		probes = append(probes, probe)
+	}
+	return probes, nil
+}
+
+// dataFileOffset converts a virtual address to the offset in the file of
+// the data loaded at it.
+func dataFileOffset(progs []*elf.Prog, addr uint64) (uint64, bool) {
+	for _, prog := range progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if addr >= prog.Vaddr && addr < prog.Vaddr+prog.Filesz {
+			return addr - prog.Vaddr + prog.Off, true
+		}
+	}
+	return 0, false
+}
+
+// USDTProbes returns the locations of the USDT probes of the program or
+// library name, see ResolveUprobeSymbol for how name is looked up.
+func USDTProbes(name string, pid int) ([]USDTProbe, error) {
+	path, err := resolveBinaryPath(name, pid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %v", path, err)
+	}
+	defer f.Close()
+	probes, err := parseUSDTNotes(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading USDT probes of %q: %v", path, err)
+	}
+	return probes, nil
+}
+
+// usdtSemaphore is a semaphore of a USDT probe, at addr in the memory of the
+// process pid, in the byte order of its binary.
+type usdtSemaphore struct {
+	pid       int
+	addr      uint64
+	byteOrder binary.ByteOrder
+}
+
+// update adds delta to the semaphore. A semaphore of a process that exited
+// is left alone.
+func (s usdtSemaphore) update(delta int16) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", s.pid), os.O_RDWR, 0)
+	if os.IsNotExist(err) || err == syscall.ESRCH {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening memory of process %d: %v", s.pid, err)
+	}
+	defer f.Close()
+
+	// semaphores are unsigned shorts
+	var buf [2]byte
+	if _, err := f.ReadAt(buf[:], int64(s.addr)); err != nil {
+		return fmt.Errorf("error reading semaphore at %#x of process %d: %v", s.addr, s.pid, err)
+	}
+	s.byteOrder.PutUint16(buf[:], uint16(int16(s.byteOrder.Uint16(buf[:]))+delta))
+	if _, err := f.WriteAt(buf[:], int64(s.addr)); err != nil {
+		return fmt.Errorf("error writing semaphore at %#x of process %d: %v", s.addr, s.pid, err)
+	}
+	return nil
+}
+
+// mappedAddress returns the address the offset in the file at path is
+// mapped at in the process pid.
+func mappedAddress(path string, offset uint64, pid int) (uint64, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %q: %v", path, err)
+	}
+	ino := st.Sys().(*syscall.Stat_t).Ino
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0, fmt.Errorf("error reading mappings of process %d: %v", pid, err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// address perms offset dev inode path
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		if mapIno, err := strconv.ParseUint(fields[4], 10, 64); err != nil || mapIno != ino {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		start, err1 := strconv.ParseUint(bounds[0], 16, 64)
+		end, err2 := strconv.ParseUint(bounds[1], 16, 64)
+		mapOffset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		if offset >= mapOffset && offset < mapOffset+end-start {
+			return start + offset - mapOffset, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("error reading mappings of process %d: %v", pid, err)
+	}
+	return 0, fmt.Errorf("offset %#x of %q not mapped by process %d", offset, path, pid)
+}
+
+// AttachUSDT attaches the uprobe to all the locations of the USDT probe
+// provider:name of the program or library binary, see ResolveUprobeSymbol,
+// in the process pid, or in all processes if pid is -1.
+//
+// The semaphore of the probe, if any, is incremented in the process pid,
+// and decremented when the module is closed. For all processes, the kernel
+// increments it in the processes the probe is hit in, which requires Linux
+// 4.20.
+//
+// The arguments of the probe are read by the program from the registers and
+// memory of the process, as the Args of the probes returned by USDTProbes
+// tell; see USDTSpec.
+func AttachUSDT(uprobe *Uprobe, binary, provider, name string, pid int) error {
+	path, err := resolveBinaryPath(binary, pid)
+	if err != nil {
+		return err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %q: %v", path, err)
+	}
+	probes, err := parseUSDTNotes(f)
+	byteOrder := f.ByteOrder
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error reading USDT probes of %q: %v", path, err)
+	}
+
+	var found bool
+	semaphores := make(map[uint64]bool)
+	for _, probe := range probes {
+		if probe.Provider != provider || probe.Name != name {
+			continue
+		}
+		found = true
+		var refCtrOffset uint64
+		if probe.SemaphoreOffset != 0 {
+			if pid > 0 {
+				semaphores[probe.SemaphoreOffset] = true
+			} else {
+				refCtrOffset = probe.SemaphoreOffset
+			}
+		}
+		if err := attachUprobe(uprobe, path, probe.Offset, refCtrOffset, pid); err != nil {
+			return fmt.Errorf("error attaching USDT probe %s:%s at %#x: %v", provider, name, probe.Offset, err)
+		}
+	}
+	if !found {
+		return fmt.Errorf("USDT probe %s:%s not found in %q", provider, name, path)
+	}
+
+	// the probe is enabled once attached, so that its arguments are
+	// evaluated as soon as they're traced
+	for offset := range semaphores {
+		addr, err := mappedAddress(path, offset, pid)
+		if err != nil {
+			return fmt.Errorf("error enabling USDT probe %s:%s: %v", provider, name, err)
+		}
+		sema := usdtSemaphore{pid: pid, addr: addr, byteOrder: byteOrder}
+		if err := sema.update(1); err != nil {
+			return fmt.Errorf("error enabling USDT probe %s:%s: %v", provider, name, err)
+		}
+		uprobe.semaphores = append(uprobe.semaphores, sema)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"debug/elf"
+	"reflect"
+	"testing"
+)
+
+func TestParseUSDTArgs(t *testing.T) {
+	tests := []struct {
+		spec     string
+		machine  elf.Machine
+		expected []USDTArg
+	}{
+		{
+			spec:    "-4@%eax 8@-8(%rbp) 4@$5 -2@(%rdi) 1@$-1",
+			machine: elf.EM_X86_64,
+			expected: []USDTArg{
+				{Size: 4, Signed: true, Kind: USDTArgReg, Register: "eax", RegOffset: 80},
+				{Size: 8, Kind: USDTArgRegDeref, Register: "rbp", RegOffset: 32, Value: -8},
+				{Size: 4, Kind: USDTArgConst, Value: 5},
+				{Size: 2, Signed: true, Kind: USDTArgRegDeref, Register: "rdi", RegOffset: 112},
+				{Size: 1, Kind: USDTArgConst, Value: -1},
+			},
+		},
+		{
+			spec:    "-4@x0 %r8",
+			machine: elf.EM_AARCH64,
+		},
+		{
+			spec:    "-4@w0 8@[sp, 16] 8@[x1] -4@-9",
+			machine: elf.EM_AARCH64,
+			expected: []USDTArg{
+				{Size: 4, Signed: true, Kind: USDTArgReg, Register: "w0", RegOffset: 0},
+				{Size: 8, Kind: USDTArgRegDeref, Register: "sp", RegOffset: 248, Value: 16},
+				{Size: 8, Kind: USDTArgRegDeref, Register: "x1", RegOffset: 8},
+				{Size: 4, Signed: true, Kind: USDTArgConst, Value: -9},
+			},
+		},
+		{
+			spec:     "",
+			machine:  elf.EM_X86_64,
+			expected: []USDTArg{},
+		},
+		{
+			spec:    "8@foo(%rip)",
+			machine: elf.EM_X86_64,
+		},
+		{
+			spec:    "3@%eax",
+			machine: elf.EM_X86_64,
+		},
+		{
+			spec:    "4@r0",
+			machine: elf.EM_ARM,
+		},
+	}
+
+	for _, tt := range tests {
+		args, err := parseUSDTArgs(tt.spec, tt.machine)
+		if tt.expected == nil {
+			if err == nil {
+				t.Fatalf("%q: expected an error but got %+v", tt.spec, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Fatalf("%q: expected %+v but got %+v", tt.spec, tt.expected, args)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package elf
+
+import (
+	"fmt"
+	"syscall"
+)
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/include/uapi -I${SRCDIR}/include
+
+#include <linux/bpf.h>
+#include <linux/if_link.h>
+#include "libbpf.h"
+*/
+import "C"
+
+const (
+	XDP_FLAGS_UPDATE_IF_NOEXIST = uint32(1) << iota
+	XDP_FLAGS_SKB_MODE
+	XDP_FLAGS_DRV_MODE
+	XDP_FLAGS_HW_MODE
+	XDP_FLAGS_REPLACE
+	XDP_FLAGS_MODES = XDP_FLAGS_SKB_MODE | XDP_FLAGS_DRV_MODE | XDP_FLAGS_HW_MODE
+	XDP_FLAGS_MASK  = XDP_FLAGS_UPDATE_IF_NOEXIST | XDP_FLAGS_MODES | XDP_FLAGS_REPLACE
+)
+
+// XDPMode is the mode XDP programs are attached to a device in.
+type XDPMode uint8
+
+const (
+	XDPModeNone  XDPMode = C.XDP_ATTACHED_NONE
+	XDPModeDrv   XDPMode = C.XDP_ATTACHED_DRV
+	XDPModeSkb   XDPMode = C.XDP_ATTACHED_SKB
+	XDPModeHw    XDPMode = C.XDP_ATTACHED_HW
+	XDPModeMulti XDPMode = C.XDP_ATTACHED_MULTI
+)
+
+func (m XDPMode) String() string {
+	switch m {
+	case XDPModeNone:
+		return "none"
+	case XDPModeDrv:
+		return "drv"
+	case XDPModeSkb:
+		return "skb"
+	case XDPModeHw:
+		return "hw"
+	case XDPModeMulti:
+		return "multi"
+	}
+	return fmt.Sprintf("XDPMode(%d)", uint8(m))
+}
+
+// XDPInfo describes the XDP programs attached to a device.
+type XDPInfo struct {
+	Mode XDPMode
+	// ProgramID is the ID of the attached program, unless programs are
+	// attached in several modes, see XDPModeMulti, in which case the IDs
+	// of the programs are only given per mode.
+	ProgramID    uint32
+	DrvProgramID uint32
+	SkbProgramID uint32
+	HwProgramID  uint32
+}
+
+// QueryXDP returns the XDP programs attached to the device.
+func QueryXDP(devName string) (*XDPInfo, error) {
+	ifindex, err := ifIndex(devName)
+	if err != nil {
+		return nil, err
+	}
+	var info C.struct_xdp_link_info
+	if ret := C.bpf_get_link_xdp_info(C.int(ifindex), &info); ret < 0 {
+		return nil, fmt.Errorf("failed to query BPF xdp of device %s: %v", devName, syscall.Errno(-ret))
+	}
+	return &XDPInfo{
+		Mode:         XDPMode(info.attach_mode),
+		ProgramID:    uint32(info.prog_id),
+		DrvProgramID: uint32(info.drv_prog_id),
+		SkbProgramID: uint32(info.skb_prog_id),
+		HwProgramID:  uint32(info.hw_prog_id),
+	}, nil
+}
+
+// ReplaceXDP atomically replaces the XDP program attached to the device
+// with the program of the xdp section secName, provided the attached
+// program is oldFd: the device keeps processing packets with either
+// program, and the call fails if another program was attached in the
+// meantime. flags select the mode as for AttachXDPWithFlags.
+func (b *Module) ReplaceXDP(devName string, secName string, oldFd int, flags uint32) error {
+	xdp, ok := b.xdpPrograms[secName]
+	if !ok {
+		return fmt.Errorf("no such XDP hook %q", secName)
+	}
+	return attachXDP(devName, xdp.fd, flags|XDP_FLAGS_REPLACE, oldFd, true)
+}
@@ -0,0 +1,267 @@
+//go:build linux
+// +build linux
+
+// Package ringbuf reads the records of BPF ring buffers, maps of type
+// BPF_MAP_TYPE_RINGBUF, available since Linux 5.8.
+//
+// Unlike perf buffers, which have a buffer per CPU, a ring buffer is shared
+// by all CPUs: its records are read in the order they were reserved by the
+// BPF programs, across all CPUs.
+package ringbuf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// flags of the length of a record, see include/uapi/linux/bpf.h
+	busyBit    = 1 << 31
+	discardBit = 1 << 30
+
+	// length of the header of a record, followed by the sample
+	headerSize = 8
+
+	// busyWait is how long Read waits for a record being written to be
+	// committed before it checks again
+	busyWait = 100 * time.Microsecond
+)
+
+// ErrClosed is returned by Read once the reader is closed.
+var ErrClosed = errors.New("ring buffer reader closed")
+
+// Reader reads the records of a ring buffer. Read must not be called
+// concurrently, but Close may be called while Read waits, which unblocks
+// it.
+type Reader struct {
+	// mu is held by Read, and deadlineMu guards deadline, set while Read
+	// waits
+	mu         sync.Mutex
+	deadlineMu sync.Mutex
+	deadline   time.Time
+
+	epollFd int
+	// wakeFd is an eventfd Close and SetDeadline signal to unblock Read
+	wakeFd int
+
+	// consumer page, written by the reader, and producer page followed by
+	// the data pages, which are mapped twice in a row for records that wrap
+	// around to be read in one piece
+	consumer []byte
+	producer []byte
+	data     []byte
+	mask     uint64
+
+	closing int32
+	closed  bool
+}
+
+// NewReader maps the ring buffer mapFd, whose size, its max_entries, is
+// size bytes: a power of 2 and a multiple of the page size.
+func NewReader(mapFd int, size int) (*Reader, error) {
+	pageSize := os.Getpagesize()
+	if size <= 0 || size&(size-1) != 0 || size%pageSize != 0 {
+		return nil, fmt.Errorf("invalid ring buffer size %d", size)
+	}
+
+	r := &Reader{epollFd: -1, wakeFd: -1, mask: uint64(size - 1)}
+	var err error
+	if r.consumer, err = syscall.Mmap(mapFd, 0, pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return nil, fmt.Errorf("error mapping consumer page: %v", err)
+	}
+	if r.producer, err = syscall.Mmap(mapFd, int64(pageSize), pageSize+2*size, syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		r.release()
+		return nil, fmt.Errorf("error mapping producer pages: %v", err)
+	}
+	r.data = r.producer[pageSize:]
+
+	if r.epollFd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		r.release()
+		return nil, fmt.Errorf("error creating epoll instance: %v", err)
+	}
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		r.release()
+		return nil, fmt.Errorf("error creating eventfd: %v", errno)
+	}
+	r.wakeFd = int(fd)
+	for _, fd := range []int{mapFd, r.wakeFd} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(r.epollFd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+			r.release()
+			return nil, fmt.Errorf("error adding fd %d to epoll instance: %v", fd, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) consumerPos() *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.consumer[0]))
+}
+
+func (r *Reader) producerPos() *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.producer[0]))
+}
+
+// next returns the sample of the next record, skipping discarded records,
+// or false if there's none, or it's still being written: it's then read,
+// along with the records reserved after it, once committed.
+func (r *Reader) next() ([]byte, bool) {
+	for {
+		consumer := atomic.LoadUint64(r.consumerPos())
+		producer := atomic.LoadUint64(r.producerPos())
+		if consumer == producer {
+			return nil, false
+		}
+
+		off := consumer & r.mask
+		length := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[off])))
+		if length&busyBit != 0 {
+			return nil, false
+		}
+		size := uint64(length &^ (busyBit | discardBit))
+
+		var sample []byte
+		if length&discardBit == 0 {
+			sample = make([]byte, size)
+			copy(sample, r.data[off+headerSize:off+headerSize+size])
+		}
+		// records are aligned to 8 bytes
+		atomic.StoreUint64(r.consumerPos(), consumer+(headerSize+size+7)&^7)
+		if sample != nil {
+			return sample, true
+		}
+	}
+}
+
+// busy tells whether the next record is still being written, which holds
+// back next.
+func (r *Reader) busy() bool {
+	consumer := atomic.LoadUint64(r.consumerPos())
+	if consumer == atomic.LoadUint64(r.producerPos()) {
+		return false
+	}
+	length := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[consumer&r.mask])))
+	return length&busyBit != 0
+}
+
+// SetDeadline sets the time after which Read fails with
+// os.ErrDeadlineExceeded when no record is available, including for a Read
+// already waiting. A zero time, the default, means Read waits for a record
+// as long as it takes.
+func (r *Reader) SetDeadline(t time.Time) {
+	r.deadlineMu.Lock()
+	r.deadline = t
+	r.deadlineMu.Unlock()
+	r.wake()
+}
+
+// wake unblocks Read, if it's waiting, for it to check whether it's closed
+// and its deadline.
+func (r *Reader) wake() error {
+	var one [8]byte
+	*(*uint64)(unsafe.Pointer(&one[0])) = 1
+	if _, err := syscall.Write(r.wakeFd, one[:]); err != nil && err != syscall.EAGAIN {
+		return fmt.Errorf("error waking up reader: %v", err)
+	}
+	return nil
+}
+
+// Read returns the sample of the next record of the ring buffer, waiting for
+// one to be committed if there's none.
+func (r *Reader) Read() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		if r.closed || atomic.LoadInt32(&r.closing) != 0 {
+			return nil, ErrClosed
+		}
+		if sample, ok := r.next(); ok {
+			return sample, nil
+		}
+
+		r.deadlineMu.Lock()
+		deadline := r.deadline
+		r.deadlineMu.Unlock()
+		timeout := -1
+		left := time.Duration(-1)
+		if !deadline.IsZero() {
+			left = time.Until(deadline)
+			if left <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			// round up, not to wake up right before the deadline
+			timeout = int((left + time.Millisecond - 1) / time.Millisecond)
+		}
+		if r.busy() {
+			// the ring buffer stays readable until the record is
+			// committed: back off instead of spinning on epoll
+			if left < 0 || left > busyWait {
+				left = busyWait
+			}
+			time.Sleep(left)
+			continue
+		}
+		n, err := syscall.EpollWait(r.epollFd, events, timeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error waiting for ring buffer: %v", err)
+		}
+		for _, event := range events[:n] {
+			if int(event.Fd) == r.wakeFd {
+				// reset the eventfd
+				var buf [8]byte
+				syscall.Read(r.wakeFd, buf[:])
+			}
+		}
+	}
+}
+
+// Close unmaps the ring buffer, once Read, if it's waiting, returns. The map
+// itself is left open.
+func (r *Reader) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closing, 0, 1) {
+		return nil
+	}
+	// Read returns ErrClosed once woken up, even if the eventfd couldn't be
+	// signaled, at the latest when its deadline or a record comes
+	r.wake()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.release()
+}
+
+func (r *Reader) release() error {
+	var err error
+	if r.consumer != nil {
+		if e := syscall.Munmap(r.consumer); e != nil {
+			err = fmt.Errorf("error unmapping consumer page: %v", e)
+		}
+		r.consumer = nil
+	}
+	if r.producer != nil {
+		if e := syscall.Munmap(r.producer); e != nil && err == nil {
+			err = fmt.Errorf("error unmapping producer pages: %v", e)
+		}
+		r.producer, r.data = nil, nil
+	}
+	for _, fd := range []*int{&r.epollFd, &r.wakeFd} {
+		if *fd >= 0 {
+			syscall.Close(*fd)
+			*fd = -1
+		}
+	}
+	return err
+}
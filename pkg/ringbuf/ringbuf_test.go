@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package ringbuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+func nativeEndian() binary.ByteOrder {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// testRingBuffer is a ring buffer in memory, its data mapped twice in a row
+// as the kernel does.
+type testRingBuffer struct {
+	r        *Reader
+	producer uint64
+}
+
+func newTestRingBuffer(size int) *testRingBuffer {
+	r := &Reader{
+		consumer: make([]byte, 8),
+		producer: make([]byte, 8+2*size),
+		mask:     uint64(size - 1),
+	}
+	r.data = r.producer[8:]
+	return &testRingBuffer{r: r}
+}
+
+// write reserves a record of the sample, with the flags of its length, and
+// returns its position.
+func (b *testRingBuffer) write(sample []byte, flags uint32) uint64 {
+	bo := nativeEndian()
+	size := uint64(len(b.r.data) / 2)
+	record := make([]byte, headerSize+len(sample))
+	bo.PutUint32(record, uint32(len(sample))|flags)
+	copy(record[headerSize:], sample)
+	for i, c := range record {
+		off := (b.producer + uint64(i)) & b.r.mask
+		b.r.data[off] = c
+		b.r.data[off+size] = c
+	}
+	pos := b.producer
+	b.producer += (uint64(len(record)) + 7) &^ 7
+	bo.PutUint64(b.r.producer, b.producer)
+	return pos
+}
+
+// commit clears the busy bit of the record at pos.
+func (b *testRingBuffer) commit(pos uint64) {
+	bo := nativeEndian()
+	size := uint64(len(b.r.data) / 2)
+	off := pos & b.r.mask
+	length := bo.Uint32(b.r.data[off:]) &^ busyBit
+	bo.PutUint32(b.r.data[off:], length)
+	bo.PutUint32(b.r.data[off+size:], length)
+}
+
+func TestNext(t *testing.T) {
+	b := newTestRingBuffer(128)
+
+	b.write([]byte("first"), 0)
+	b.write([]byte("discarded"), discardBit)
+	busy := b.write([]byte("busy"), busyBit)
+	b.write([]byte("last"), 0)
+
+	if sample, ok := b.r.next(); !ok || !bytes.Equal(sample, []byte("first")) {
+		t.Fatalf("expected first but got %q, %v", sample, ok)
+	}
+	// the discarded record is skipped, and the busy one holds back the
+	// records after it
+	if sample, ok := b.r.next(); ok {
+		t.Fatalf("expected no sample before the busy record is committed but got %q", sample)
+	}
+	if !b.r.busy() {
+		t.Fatal("expected the next record to be busy")
+	}
+	b.commit(busy)
+	for _, expected := range []string{"busy", "last"} {
+		if sample, ok := b.r.next(); !ok || string(sample) != expected {
+			t.Fatalf("expected %s but got %q, %v", expected, sample, ok)
+		}
+	}
+	if sample, ok := b.r.next(); ok {
+		t.Fatalf("expected no sample but got %q", sample)
+	}
+	if b.r.busy() {
+		t.Fatal("expected no busy record")
+	}
+
+	// records wrapping around the end of the buffer are read in one piece
+	for i := 0; i < 10; i++ {
+		sample := bytes.Repeat([]byte{byte(i)}, 20)
+		b.write(sample, 0)
+		if got, ok := b.r.next(); !ok || !bytes.Equal(got, sample) {
+			t.Fatalf("record %d: expected %v but got %v, %v", i, sample, got, ok)
+		}
+	}
+}